@@ -0,0 +1,172 @@
+// Command bench load-tests an isgpt server with concurrent requests of a
+// fixed-size payload and reports latency percentiles, throughput and error
+// rate.
+//
+//	bench -concurrency 8 -duration 1m -size 2000
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"isgpt-server/api"
+	"isgpt-server/client"
+)
+
+// sampleText is repeated to build the payload. It is ordinary prose so that
+// sentence splitting and chunking behave as they would on real input.
+const sampleText = "The committee met on Tuesday to review the budget for the coming year. " +
+	"Several members raised concerns about the cost of the new library wing, " +
+	"while others argued that the investment would pay for itself within a decade. " +
+	"After a long discussion, they agreed to revisit the proposal next month. "
+
+func main() {
+	serverURL := flag.String("server", client.DefaultBaseURL, "isgpt server URL")
+	endpoint := flag.String("endpoint", "infer", "Endpoint to load: infer or perplexity")
+	concurrency := flag.Int("concurrency", 4, "Requests in flight at once")
+	duration := flag.Duration("duration", 30*time.Second, "How long to run (ignored if -requests is set)")
+	requests := flag.Int("requests", 0, "Stop after this many requests instead of after -duration")
+	size := flag.Int("size", 2000, "Payload size in characters")
+	warmup := flag.Int("warmup", 5, "Requests sent before measuring")
+	timeout := flag.Duration("timeout", time.Minute, "Per-request timeout")
+	flag.Parse()
+
+	if *endpoint != "infer" && *endpoint != "perplexity" {
+		fmt.Fprintf(os.Stderr, "Error: unknown endpoint %q (use infer or perplexity)\n", *endpoint)
+		os.Exit(1)
+	}
+	if *concurrency < 1 || *size < 1 || *requests < 0 || *warmup < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -concurrency and -size must be positive, -requests and -warmup non-negative\n")
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c := client.New(*serverURL, client.WithTimeout(*timeout))
+	text := payload(*size)
+	send := func(ctx context.Context) error {
+		if *endpoint == "perplexity" {
+			_, err := c.Perplexity(ctx, text)
+			return err
+		}
+		_, err := c.Infer(ctx, text, api.InferOptions{})
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Warming up with %d requests...\n", *warmup)
+	for i := 0; i < *warmup; i++ {
+		if err := send(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: warmup request failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	runCtx := ctx
+	if *requests == 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+		fmt.Fprintf(os.Stderr, "Running for %s with %d workers...\n", *duration, *concurrency)
+	} else {
+		fmt.Fprintf(os.Stderr, "Sending %d requests with %d workers...\n", *requests, *concurrency)
+	}
+
+	res := run(runCtx, *concurrency, *requests, send)
+	res.print(*endpoint, *size, *concurrency)
+}
+
+// payload returns size characters of prose.
+func payload(size int) string {
+	var b strings.Builder
+	for b.Len() < size {
+		b.WriteString(sampleText)
+	}
+	return b.String()[:size]
+}
+
+// results collects the outcome of a run.
+type results struct {
+	latencies []time.Duration // Successful requests only
+	errors    int
+	elapsed   time.Duration
+}
+
+// run calls send from concurrency workers until ctx is done or, if limit is
+// positive, limit requests have been started. Requests cut short by the end
+// of the run are not counted.
+func run(ctx context.Context, concurrency, limit int, send func(context.Context) error) *results {
+	var (
+		mu      sync.Mutex
+		res     results
+		started atomic.Int64
+		wg      sync.WaitGroup
+	)
+
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if limit > 0 && started.Add(1) > int64(limit) {
+					return
+				}
+				t := time.Now()
+				err := send(ctx)
+				latency := time.Since(t)
+				if err != nil && ctx.Err() != nil {
+					return
+				}
+
+				mu.Lock()
+				if err != nil {
+					res.errors++
+				} else {
+					res.latencies = append(res.latencies, latency)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	return &res
+}
+
+func (r *results) print(endpoint string, size, concurrency int) {
+	total := len(r.latencies) + r.errors
+	fmt.Printf("endpoint:     /%s\n", endpoint)
+	fmt.Printf("payload:      %d chars\n", size)
+	fmt.Printf("concurrency:  %d\n", concurrency)
+	fmt.Printf("requests:     %d in %s\n", total, r.elapsed.Round(time.Millisecond))
+	if total == 0 {
+		return
+	}
+	fmt.Printf("throughput:   %.2f req/s\n", float64(len(r.latencies))/r.elapsed.Seconds())
+	fmt.Printf("error rate:   %.2f%% (%d)\n", 100*float64(r.errors)/float64(total), r.errors)
+	if len(r.latencies) == 0 {
+		return
+	}
+
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	fmt.Printf("latency p50:  %s\n", percentile(r.latencies, 50))
+	fmt.Printf("latency p95:  %s\n", percentile(r.latencies, 95))
+	fmt.Printf("latency p99:  %s\n", percentile(r.latencies, 99))
+	fmt.Printf("latency max:  %s\n", r.latencies[len(r.latencies)-1].Round(time.Microsecond))
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	rank = max(0, min(rank, len(sorted)-1))
+	return sorted[rank].Round(time.Microsecond)
+}
@@ -0,0 +1,367 @@
+// Command score runs every row of a JSONL corpus through an isgpt server and
+// writes the rows back out, in order, with "perplexity" and "label" added.
+//
+//	score -in corpus.jsonl -out scored.jsonl -concurrency 8
+//
+// Re-running with the same -out resumes after the last complete output row.
+// Rows that fail are written with an "error" field; -retry-errors scores
+// them again, along with any rows not yet written.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"isgpt-server/api"
+	"isgpt-server/client"
+)
+
+func main() {
+	serverURL := flag.String("server", client.DefaultBaseURL, "isgpt server URL")
+	inPath := flag.String("in", "", "Input JSONL file (required)")
+	outPath := flag.String("out", "", "Output JSONL file (required); resumed if it exists")
+	field := flag.String("field", "text", "Name of the field holding the text to score")
+	concurrency := flag.Int("concurrency", 4, "Requests in flight at once")
+	timeout := flag.Duration("timeout", 2*time.Minute, "Per-request timeout")
+	every := flag.Duration("progress", 10*time.Second, "How often to report throughput on stderr")
+	retryErrors := flag.Bool("retry-errors", false, "Score rows of -out that were written with an error again")
+	flag.Parse()
+
+	if *inPath == "" || *outPath == "" || *concurrency < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s -in <file.jsonl> -out <file.jsonl> [options]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	s := &scorer{
+		client:      client.New(*serverURL, client.WithTimeout(*timeout)),
+		field:       *field,
+		concurrency: *concurrency,
+		retryErrors: *retryErrors,
+	}
+	if err := s.run(ctx, *inPath, *outPath, *every); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// scorer scores rows concurrently while writing them in input order.
+type scorer struct {
+	client      *client.Client
+	field       string
+	concurrency int
+	retryErrors bool // Rescore rows already written with an error
+
+	done   atomic.Int64 // Rows written this run
+	failed atomic.Int64 // Rows written with an error
+}
+
+type job struct {
+	index int
+	line  []byte
+	kept  bool // line is an output row kept from an earlier run, not scored
+}
+
+type result struct {
+	index    int
+	line     []byte
+	kept     bool
+	canceled bool // Interrupted rather than scored; must not be written
+}
+
+func (s *scorer) run(ctx context.Context, inPath, outPath string, every time.Duration) error {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, skip, err := openResumable(outPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// To retry errors the rows already written are read back and written
+	// again, scored or kept, to a new file that replaces the old one once
+	// complete
+	var prior [][]byte
+	retryPath := ""
+	if s.retryErrors && skip > 0 {
+		if prior, err = readRows(out); err != nil {
+			return err
+		}
+		tmp, err := os.CreateTemp(filepath.Dir(outPath), filepath.Base(outPath)+".retry-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name()) // Fails harmlessly once renamed
+		defer tmp.Close()
+		out, retryPath = tmp, tmp.Name()
+		fmt.Fprintf(os.Stderr, "Retrying rows with errors among %d already in %s\n", skip, outPath)
+		skip = 0
+	} else if skip > 0 {
+		fmt.Fprintf(os.Stderr, "Resuming after %d rows already in %s\n", skip, outPath)
+	}
+
+	jobs := make(chan job)
+	results := make(chan result)
+	// Bounds rows that are read but not yet written, so one slow request
+	// can't make the reorder buffer grow without limit
+	slots := make(chan struct{}, 2*s.concurrency)
+
+	var workers sync.WaitGroup
+	for i := 0; i < s.concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				if j.kept {
+					results <- result{index: j.index, line: j.line, kept: true}
+					continue
+				}
+				line := s.score(ctx, j.line)
+				results <- result{index: j.index, line: line, canceled: ctx.Err() != nil}
+			}
+		}()
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+		readErr <- s.read(ctx, in, skip, prior, jobs, slots)
+	}()
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	start := time.Now()
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	w := bufio.NewWriter(out)
+	pending := make(map[int]result)
+	next := 0
+	stopped := false // Set on interrupt; later rows are rescored on resume
+	for {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				// Rows kept from the earlier run that weren't reached before
+				// an interrupt are written back as they were
+				for _, line := range prior[min(next, len(prior)):] {
+					if _, err := w.Write(append(line, '\n')); err != nil {
+						return err
+					}
+				}
+				if err := w.Flush(); err != nil {
+					return err
+				}
+				if retryPath != "" {
+					if err := out.Close(); err != nil {
+						return err
+					}
+					if err := os.Rename(retryPath, outPath); err != nil {
+						return err
+					}
+				}
+				s.report(start, true)
+				if err := <-readErr; err != nil {
+					return err
+				}
+				return ctx.Err()
+			}
+			pending[r.index] = r
+			for p, ok := pending[next]; ok && !stopped; p, ok = pending[next] {
+				delete(pending, next)
+				if p.canceled {
+					stopped = true
+					break
+				}
+				if _, err := w.Write(append(p.line, '\n')); err != nil {
+					return err
+				}
+				next++
+				if !p.kept {
+					s.done.Add(1)
+				}
+				<-slots
+			}
+		case <-ticker.C:
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			if !stopped {
+				s.report(start, false)
+			}
+		}
+	}
+}
+
+// read sends each input row after the first skip to jobs. Blank lines are
+// passed through so output rows stay aligned with input rows. Rows with a
+// scored row in prior, the output of an earlier run, send that row instead.
+func (s *scorer) read(ctx context.Context, in io.Reader, skip int, prior [][]byte, jobs chan<- job, slots chan struct{}) error {
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	row := 0
+	for sc.Scan() {
+		row++
+		if row <= skip {
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+		if i := row - skip - 1; i < len(prior) && !hasError(prior[i]) {
+			jobs <- job{index: i, line: prior[i], kept: true}
+			continue
+		}
+		line := append([]byte(nil), sc.Bytes()...)
+		jobs <- job{index: row - skip - 1, line: line}
+	}
+	return sc.Err()
+}
+
+// score returns line with the server's verdict added, or with an "error"
+// field if it could not be scored.
+func (s *scorer) score(ctx context.Context, line []byte) []byte {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return line
+	}
+
+	var row map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	if err := dec.Decode(&row); err != nil {
+		return s.fail(map[string]interface{}{"raw": string(line)}, fmt.Errorf("invalid JSON: %w", err))
+	}
+
+	text, ok := row[s.field].(string)
+	if !ok {
+		return s.fail(row, fmt.Errorf("missing string field %q", s.field))
+	}
+
+	resp, err := s.client.Infer(ctx, text, api.InferOptions{})
+	if err != nil {
+		return s.fail(row, err)
+	}
+	row["perplexity"] = resp.Perplexity
+	row["label"] = resp.Label
+	if resp.Label == nil {
+		row["status"] = resp.Status
+	}
+	return marshalRow(row)
+}
+
+func (s *scorer) fail(row map[string]interface{}, err error) []byte {
+	s.failed.Add(1)
+	row["error"] = err.Error()
+	return marshalRow(row)
+}
+
+func marshalRow(row map[string]interface{}) []byte {
+	data, err := json.Marshal(row)
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+	return data
+}
+
+func (s *scorer) report(start time.Time, final bool) {
+	done := s.done.Load()
+	elapsed := time.Since(start)
+	prefix := "Progress"
+	if final {
+		prefix = "Done"
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d rows (%d failed) in %s, %.1f rows/s\n",
+		prefix, done, s.failed.Load(), elapsed.Round(time.Second), float64(done)/elapsed.Seconds())
+}
+
+// hasError reports whether an output row was written with an error.
+func hasError(line []byte) bool {
+	var row map[string]json.RawMessage
+	if err := json.Unmarshal(line, &row); err != nil {
+		return false
+	}
+	_, ok := row["error"]
+	return ok
+}
+
+// readRows reads back the complete rows of an output file opened by
+// openResumable.
+func readRows(f *os.File) ([][]byte, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	rows := bytes.SplitAfter(data, []byte("\n"))
+	rows = rows[:len(rows)-1] // Everything after the last newline, which is nothing
+	for i, row := range rows {
+		rows[i] = bytes.TrimSuffix(row, []byte("\n"))
+	}
+	return rows, nil
+}
+
+// openResumable opens path for appending and returns how many complete rows
+// it already holds. A partial last row, left by an interrupted run, is cut
+// off so it is scored again.
+func openResumable(path string) (*os.File, int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows := 0
+	var end int64 // Offset just past the last newline
+	var offset int64
+	r := bufio.NewReader(f)
+	for {
+		chunk, err := r.ReadSlice('\n')
+		offset += int64(len(chunk))
+		if err == nil {
+			rows++
+			end = offset
+			continue
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		f.Close()
+		return nil, 0, err
+	}
+
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, rows, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"isgpt-server/client"
+)
+
+// Rows that failed are written with an error, and -retry-errors scores just
+// those again, keeping the rows that were scored.
+func TestRetryErrors(t *testing.T) {
+	var down atomic.Bool
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		body := new(bytes.Buffer)
+		body.ReadFrom(r.Body)
+		if down.Load() && strings.Contains(body.String(), "flaky") {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"perplexity": 42.5, "label": 1}`))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "in.jsonl")
+	outPath := filepath.Join(dir, "out.jsonl")
+	input := `{"id": 1, "text": "steady one"}
+{"id": 2, "text": "flaky two"}
+
+{"id": 3, "text": "steady three"}
+`
+	if err := os.WriteFile(inPath, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(retry bool) []map[string]any {
+		t.Helper()
+		s := &scorer{client: client.New(server.URL), field: "text", concurrency: 2, retryErrors: retry}
+		if err := s.run(context.Background(), inPath, outPath, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(outPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rows []map[string]any
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			row := map[string]any{}
+			if line != "" {
+				if err := json.Unmarshal([]byte(line), &row); err != nil {
+					t.Fatalf("bad output row %q: %v", line, err)
+				}
+			}
+			rows = append(rows, row)
+		}
+		if len(rows) != 4 {
+			t.Fatalf("got %d output rows, want 4", len(rows))
+		}
+		return rows
+	}
+
+	down.Store(true)
+	rows := run(false)
+	if _, ok := rows[1]["error"]; !ok {
+		t.Fatalf("row 2 = %v, want an error", rows[1])
+	}
+	if _, ok := rows[0]["error"]; ok {
+		t.Fatalf("row 1 = %v, want it scored", rows[0])
+	}
+
+	down.Store(false)
+	requests.Store(0)
+	rows = run(true)
+	for i, row := range rows {
+		if _, ok := row["error"]; ok {
+			t.Errorf("row %d still has an error: %v", i+1, row)
+		}
+		if i != 2 && row["perplexity"] != 42.5 {
+			t.Errorf("row %d = %v, want it scored", i+1, row)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("retry made %d requests, want 1 for the failed row", n)
+	}
+	if matches, _ := filepath.Glob(outPath + ".retry-*"); len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
@@ -3,6 +3,11 @@ module github.com/shortontech/isgpt/cli
 go 1.25.4
 
 require (
-	golang.org/x/sys v0.39.0 // indirect
-	golang.org/x/term v0.38.0 // indirect
+	github.com/fsnotify/fsnotify v1.9.0
+	golang.org/x/term v0.38.0
+	isgpt-server v0.0.0
 )
+
+require golang.org/x/sys v0.39.0 // indirect
+
+replace isgpt-server => ../goserver
@@ -1,30 +1,65 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"strings"
-)
+	"time"
 
-type InferenceRequest struct {
-	Sentence string `json:"sentence"`
-	Verbose  bool   `json:"verbose"`
-}
+	"isgpt-server/api"
+	"isgpt-server/client"
+)
 
+// Build identity, set with -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = "unknown"
+)
 
 func main() {
 	serverURL := flag.String("server", "http://localhost:9081", "isgpt server URL")
-	verbose := flag.Bool("verbose", false, "Show verbose JSON output with metrics")
+	format := flag.String("format", "text", "Output format: text, json, or csv")
+	verbose := flag.Bool("verbose", false, "Show verbose JSON output with metrics (same as --format json)")
+	noColor := flag.Bool("no-color", false, "Disable colored output (also honors NO_COLOR)")
+	watchDir := flag.String("watch", "", "Watch a directory and analyze text files as they are created or modified")
+	debounce := flag.Duration("debounce", 500*time.Millisecond, "Quiet period after the last change before a watched file is analyzed")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Printf("isgpt %s (commit %s)\n", version, commit)
+		return
+	}
+
+	if *verbose {
+		*format = "json"
+	}
+	if *format != "text" && *format != "json" && *format != "csv" {
+		fmt.Fprintf(os.Stderr, "Error: unknown format %q (use text, json, or csv)\n", *format)
+		os.Exit(1)
+	}
+
+	a := &analyzer{
+		client: client.New(*serverURL),
+		format: *format,
+		color:  *format == "text" && useColor(os.Stdout, *noColor),
+	}
+
+	if *watchDir != "" {
+		if err := watch(context.Background(), *watchDir, *debounce, a); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Require filename as positional argument
 	if flag.NArg() != 1 {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <filename>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [options] --watch <dir>\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		flag.PrintDefaults()
 		os.Exit(1)
@@ -32,6 +67,21 @@ func main() {
 
 	filename := flag.Arg(0)
 
+	// Stream large files instead of reading them into memory
+	if info, err := os.Stat(filename); err == nil && info.Size() > streamThreshold {
+		f, err := os.Open(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading file: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		if err := a.analyzeReader(context.Background(), f); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Read file
 	data, err := os.ReadFile(filename)
 	if err != nil {
@@ -45,40 +95,62 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Make request to server
-	result, err := analyze(text, *serverURL, *verbose)
-	if err != nil {
+	if err := a.analyze(context.Background(), text); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+}
 
-	// Display results (server returns plain text by default)
-	fmt.Print(result)
+// analyzer sends text to the server and prints the result in the chosen
+// format.
+type analyzer struct {
+	client *client.Client
+	format string
+	color  bool
 }
 
-func analyze(text, serverURL string, verbose bool) (string, error) {
-	reqBody := InferenceRequest{Sentence: text, Verbose: verbose}
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
-	}
+// streamThreshold is the file size above which the CLI streams the file to
+// the server as a text/plain body instead of reading it into a JSON request.
+const streamThreshold = 1 << 20
 
-	resp, err := http.Post(serverURL+"/infer", "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to connect to server: %w", err)
-	}
-	defer resp.Body.Close()
+func (a *analyzer) analyze(ctx context.Context, text string) error {
+	return a.report(
+		func() (string, error) { return a.client.InferText(ctx, text, api.InferOptions{}) },
+		func() (*api.InferenceResponse, error) { return a.client.Infer(ctx, text, api.InferOptions{}) },
+	)
+}
+
+// analyzeReader is analyze for text streamed from r.
+func (a *analyzer) analyzeReader(ctx context.Context, r io.Reader) error {
+	return a.report(
+		func() (string, error) { return a.client.InferTextReader(ctx, r, api.InferOptions{}) },
+		func() (*api.InferenceResponse, error) { return a.client.InferReader(ctx, r, api.InferOptions{}) },
+	)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("server returned error %d: %s", resp.StatusCode, string(body))
+// report prints the result in the chosen format, calling text for the
+// server's plain-text report or full for the verbose response.
+func (a *analyzer) report(text func() (string, error), full func() (*api.InferenceResponse, error)) error {
+	if a.format == "text" && !a.color {
+		// Display results (server returns plain text by default)
+		result, err := text()
+		if err != nil {
+			return err
+		}
+		fmt.Print(result)
+		return nil
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	result, err := full()
 	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
+		return err
+	}
+	switch a.format {
+	case "csv":
+		return writeCSV(os.Stdout, result)
+	case "json":
+		return writeJSON(os.Stdout, result)
+	default:
+		return writeColorText(os.Stdout, result)
 	}
-
-	return string(body), nil
 }
-
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"golang.org/x/term"
+
+	"isgpt-server/api"
+)
+
+const (
+	ansiRed   = "\x1b[31m"
+	ansiGreen = "\x1b[32m"
+	ansiDim   = "\x1b[2m"
+	ansiReset = "\x1b[0m"
+)
+
+// useColor reports whether output to f should be colorized: f must be a
+// terminal, and neither --no-color nor NO_COLOR may be set.
+func useColor(f *os.File, noColor bool) bool {
+	if noColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// sentenceColor picks red for AI, green for Human, and dim for sentences in
+// the uncertain band.
+func sentenceColor(sent api.SentenceDetail) string {
+	switch {
+	case sent.IsUncertain:
+		return ansiDim
+	case sent.Label == 1:
+		return ansiGreen
+	default:
+		return ansiRed
+	}
+}
+
+// writeColorText writes the same layout as the server's plain-text report,
+// with each sentence colored by its verdict.
+func writeColorText(w io.Writer, result *api.InferenceResponse) error {
+	for _, sent := range result.Sentences {
+		_, err := fmt.Fprintf(w, "%s%s <%s, %.0f%%>%s\n",
+			sentenceColor(sent), sent.Text, verdictName(sent), sent.Confidence, ansiReset)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "\n%s\n", result.Message)
+	return err
+}
+
+// labelName maps a numeric label to its display name.
+func labelName(label int) string {
+	if label == 1 {
+		return "Human"
+	}
+	return "AI"
+}
+
+// verdictName is labelName, except that uncertain sentences are "Uncertain".
+func verdictName(sent api.SentenceDetail) string {
+	if sent.IsUncertain {
+		return "Uncertain"
+	}
+	return labelName(sent.Label)
+}
+
+// writeJSON writes the raw verbose response.
+func writeJSON(w io.Writer, result *api.InferenceResponse) error {
+	return json.NewEncoder(w).Encode(result)
+}
+
+// writeCSV writes one row per sentence with a header row. encoding/csv
+// quotes text containing commas, quotes, or newlines.
+func writeCSV(w io.Writer, result *api.InferenceResponse) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"text", "label", "confidence", "perplexity"}); err != nil {
+		return err
+	}
+	for _, sent := range result.Sentences {
+		row := []string{
+			sent.Text,
+			verdictName(sent),
+			strconv.FormatFloat(sent.Confidence, 'f', -1, 64),
+			strconv.FormatFloat(sent.Perplexity, 'f', -1, 64),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("failed to write CSV: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watch analyzes text files in dir as they are created or modified, until ctx
+// is cancelled. Changes to the same file within debounce of each other are
+// coalesced into a single analysis.
+func watch(ctx context.Context, dir string, debounce time.Duration, a *analyzer) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(dir); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+	fmt.Fprintf(os.Stderr, "Watching %s for text files...\n", dir)
+
+	ready := make(chan fileChange)
+	pending := make(map[string]*debounced)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if isIgnoredName(filepath.Base(event.Name)) {
+				continue
+			}
+
+			// Restart the quiet period on every change to the file. A timer
+			// can't be reliably reset once it may have fired, so each change
+			// starts a new one and the older ones' sends are dropped
+			path := event.Name
+			d, ok := pending[path]
+			if ok {
+				d.timer.Stop()
+			} else {
+				d = &debounced{}
+				pending[path] = d
+			}
+			d.gen++
+			change := fileChange{path: path, gen: d.gen}
+			d.timer = time.AfterFunc(debounce, func() {
+				select {
+				case ready <- change:
+				case <-ctx.Done():
+				}
+			})
+
+		case change := <-ready:
+			if d, ok := pending[change.path]; !ok || d.gen != change.gen {
+				continue // Superseded by a later change to the file
+			}
+			delete(pending, change.path)
+			analyzeWatchedFile(ctx, change.path, a)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "Watch error: %v\n", err)
+		}
+	}
+}
+
+// debounced is a file waiting out its quiet period. gen counts the changes
+// to it, so a timer that fired before a later change can be told apart.
+type debounced struct {
+	timer *time.Timer
+	gen   int
+}
+
+// fileChange is sent when the quiet period after change gen to path ends.
+type fileChange struct {
+	path string
+	gen  int
+}
+
+// analyzeWatchedFile prints the analysis of one file under a header,
+// skipping anything that isn't non-empty text.
+func analyzeWatchedFile(ctx context.Context, path string, a *analyzer) {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", path, err)
+		return
+	}
+	if !isText(data) || strings.TrimSpace(string(data)) == "" {
+		return
+	}
+
+	fmt.Printf("==> %s <==\n", path)
+	if err := a.analyze(ctx, string(data)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error analyzing %s: %v\n", path, err)
+	}
+	fmt.Println()
+}
+
+// isText sniffs data and reports whether it looks like text.
+func isText(data []byte) bool {
+	return strings.HasPrefix(http.DetectContentType(data), "text/")
+}
+
+// isIgnoredName skips hidden files and common editor temp/backup files.
+func isIgnoredName(name string) bool {
+	return strings.HasPrefix(name, ".") ||
+		strings.HasSuffix(name, "~") ||
+		strings.HasSuffix(name, ".swp") ||
+		strings.HasSuffix(name, ".tmp")
+}
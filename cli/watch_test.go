@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"isgpt-server/client"
+)
+
+// Several quick writes to a file are analyzed once, after the last of them.
+func TestWatchDebounce(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("ok\n"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	const debounce = 100 * time.Millisecond
+	go func() {
+		done <- watch(ctx, dir, debounce, &analyzer{client: client.New(server.URL), format: "text"})
+	}()
+	time.Sleep(debounce) // Let the watcher start
+
+	path := filepath.Join(dir, "essay.txt")
+	for i := 0; i < 5; i++ {
+		if err := os.WriteFile(path, []byte("Some text, revision "+string(rune('0'+i))+".\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(debounce / 4)
+	}
+	time.Sleep(3 * debounce)
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d analyses after a burst of writes, want 1", n)
+	}
+
+	if err := os.WriteFile(path, []byte("The final revision.\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * debounce)
+	if n := requests.Load(); n != 2 {
+		t.Errorf("%d analyses after a later write, want 2", n)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("watch returned %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+)
+
+// adminMux serves operator-only endpoints. It is only ever bound to
+// ADMIN_ADDR, never to the public listener.
+func adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/config", adminConfigHandler)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// adminConfigHandler returns the resolved configuration, secrets redacted.
+// It is only served with ADMIN_TOKEN set: even redacted, the configuration
+// maps out the deployment for anyone who can reach the admin listener.
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if config.AdminToken == "" {
+		http.Error(w, "/admin/config is disabled; set ADMIN_TOKEN to enable it", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed - use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encodeJSON(w, config.redacted())
+}
+
+// adminAuth requires the bearer token ADMIN_TOKEN, if set, on every admin
+// request.
+func adminAuth(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveAdmin runs the admin listener. A failure is logged rather than fatal,
+// as the public server can carry on without it.
+func serveAdmin(addr string) {
+	slog.Info("starting admin server", "addr", addr, "auth", config.AdminToken != "")
+	if err := http.ListenAndServe(addr, adminAuth(config.AdminToken, adminMux())); err != nil {
+		slog.Error("admin server failed", "error", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminGet(t *testing.T, path, auth string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	adminAuth(config.AdminToken, adminMux()).ServeHTTP(w, r)
+	return w
+}
+
+// TestAdminConfigRequiresToken checks /admin/config is only served behind
+// ADMIN_TOKEN, and never shows the token itself.
+func TestAdminConfigRequiresToken(t *testing.T) {
+	old := config
+	t.Cleanup(func() { config = old })
+
+	config.AdminToken = ""
+	if w := adminGet(t, "/admin/config", ""); w.Code != http.StatusNotFound {
+		t.Errorf("without ADMIN_TOKEN: status %d, want 404", w.Code)
+	}
+	if w := adminGet(t, "/debug/pprof/", ""); w.Code != http.StatusOK {
+		t.Errorf("pprof without ADMIN_TOKEN: status %d, want 200", w.Code)
+	}
+
+	config.AdminToken = "s3cret"
+	for _, auth := range []string{"", "Bearer wrong"} {
+		if w := adminGet(t, "/admin/config", auth); w.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status %d, want 401", auth, w.Code)
+		}
+	}
+	w := adminGet(t, "/admin/config", "Bearer s3cret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("with the token: status %d, want 200", w.Code)
+	}
+	if body := w.Body.String(); strings.Contains(body, "s3cret") || !strings.Contains(body, "REDACTED") {
+		t.Errorf("config = %s, want the token redacted", body)
+	}
+}
@@ -0,0 +1,459 @@
+// Package api defines the JSON request and response types of the isgpt HTTP
+// API. It is shared by the server and the Go client so the two never drift.
+package api
+
+// SchemaVersion is the current InferenceResponse schema. It is incremented
+// whenever an existing field changes meaning or name; new optional fields
+// don't change it.
+//
+//	1: original schema
+//	2: Perplexity_per_line renamed to avg_perplexity_per_line
+const SchemaVersion = 2
+
+// UncertainHeader is set on /infer responses whose verdict is uncertain.
+// With UNCERTAIN_STATUS set these responses aren't 200, and the header tells
+// clients the body is still a normal result.
+const UncertainHeader = "X-Isgpt-Uncertain"
+
+// InferenceRequest is the body of POST /infer.
+type InferenceRequest struct {
+	Sentence string `json:"sentence"`
+	InferOptions
+}
+
+// InferOptions are the tunable parts of an InferenceRequest.
+type InferOptions struct {
+	Detailed      bool   `json:"detailed"`
+	Verbose       bool   `json:"verbose"`
+	Method        string `json:"method"`              // "perplexity" (default) or "detectgpt"
+	Perturbations int    `json:"perturbations"`       // DetectGPT perturbation count; 0 uses the server default
+	MinChars      *int   `json:"min_chars,omitempty"` // Minimum alphanumeric characters; nil uses the server default
+	StripMarkup   bool   `json:"strip_markup"`        // Remove markdown syntax and HTML tags before scoring
+	Locale        string `json:"locale,omitempty"`    // Language of messages, e.g. "de"; defaults to Accept-Language, then English
+	Force         bool   `json:"force"`               // Analyze non-English text even when the server requires English
+	AllowShort    bool   `json:"allow_short"`         // Analyze text below min_chars, marking the result low_confidence_short_text
+	MaxSentences  int    `json:"max_sentences"`       // Return only this many sentences, the most anomalous; 0 returns all
+	Sort          string `json:"sort,omitempty"`      // Order of sentences: "document" (default), "perplexity_asc" or "confidence_desc"
+
+	// PerSentence, when false, skips per-line analysis: the verdict comes
+	// from the whole-document perplexity alone and no sentences, per-line
+	// aggregates, histogram or confidence interval are returned. nil or
+	// true analyzes each line as usual.
+	PerSentence *bool `json:"per_sentence,omitempty"`
+
+	// MaxLineInferences caps the scoring passes of per-line analysis. A text
+	// with more lines than that has consecutive lines scored together in
+	// that many groups, each line reporting its group's perplexity, and the
+	// response is marked line_inferences_capped. The document perplexity
+	// still covers the whole text. 0 uses the server's MAX_LINE_INFERENCES;
+	// a request can lower that cap but not raise it.
+	MaxLineInferences int `json:"max_line_inferences"`
+
+	// NormalizeWhitespace turns CRLF into LF and non-breaking and other
+	// Unicode spaces into single ASCII spaces, and removes zero-width and
+	// control characters, before tokenizing. Offsets still refer to the text
+	// as sent. nil uses the server's NORMALIZE_WHITESPACE.
+	NormalizeWhitespace *bool `json:"normalize_whitespace,omitempty"`
+
+	// ResultLine ends a plain-text response with a machine-readable line
+	// such as "#RESULT label=1 confidence=87.5 perplexity=92.3
+	// uncertain=false", after the human-readable report. nil uses the
+	// server's PLAIN_RESULT_LINE. JSON responses ignore it.
+	ResultLine *bool `json:"result_line,omitempty"`
+
+	// Contextual scores each line's tokens within the document-level pass,
+	// conditioned on the text before them, instead of running each line in
+	// isolation. Lines read as less surprising, short ones especially, and
+	// no extra inference is needed.
+	Contextual bool `json:"contextual"`
+
+	// WeightByTokens bases the verdict on the mean line perplexity weighted
+	// by each line's token count, so short fragments count for less. nil
+	// uses the server's WEIGHT_BY_TOKENS.
+	WeightByTokens *bool `json:"weight_by_tokens,omitempty"`
+
+	// Temperature divides the logits before softmax (default 1.0). Values
+	// other than 1 change the perplexity scale, so the classification
+	// thresholds no longer apply as calibrated.
+	Temperature *float64 `json:"temperature,omitempty"`
+
+	// MaxInferenceMS bounds scoring wall-clock time; once exceeded, no more
+	// windows are added and the response is marked Truncated. 0 uses the
+	// server's MAX_INFERENCE_MS.
+	MaxInferenceMS int `json:"max_inference_ms"`
+
+	// SampleRate, between 0 and 1, scores only that fraction of the
+	// document's sliding windows, spread evenly, and marks the perplexity
+	// Approximate. It trades accuracy for speed on long texts; 0 or 1
+	// scores every window.
+	SampleRate float64 `json:"sample_rate"`
+
+	// NonOverlapping advances each window by the full max_length instead
+	// of STRIDE, so every token is run once. The first token of each window
+	// after the first then has no context and isn't scored, which changes
+	// the perplexity slightly in exchange for about half the work.
+	NonOverlapping bool `json:"non_overlapping"`
+
+	// StrideFraction sets how much consecutive windows overlap, as a
+	// fraction of max_length from 0 (no overlap) to just under 1, instead
+	// of STRIDE: windows advance by round((1-StrideFraction)*max_length)
+	// tokens, which must come to at least 1. The stride used is returned
+	// as stride. Can't be combined with non_overlapping.
+	StrideFraction *float64 `json:"stride_fraction,omitempty"`
+
+	// Truncate scores only the first max_length tokens of a longer text
+	// and marks the response Truncated, instead of windowing over all of it.
+	Truncate bool `json:"truncate"`
+
+	// Range scores only the given characters of the text, conditioned on
+	// as much of the text before them as fits in the window, and returns
+	// their perplexity and verdict with no per-line analysis. Offsets are
+	// as in char_start/char_end.
+	Range *CharRange `json:"range,omitempty"`
+
+	// WindowInfo returns windows, the sliding windows of the document
+	// perplexity, showing where tokens were scored on truncated context.
+	WindowInfo bool `json:"window_info"`
+
+	// DocumentPerplexity, when false, skips the whole-document pass and
+	// scores only the lines, for callers that just highlight sentences.
+	// perplexity and the fields derived from it are then omitted; the
+	// verdict comes from the lines as usual. nil or true scores the
+	// document.
+	DocumentPerplexity *bool `json:"document_perplexity,omitempty"`
+
+	// TopK, if positive, returns the k most likely tokens at each position
+	// of the document alongside the actual token. At most MAX_TOPK, and only
+	// the first MAX_TOPK_POSITIONS positions are reported.
+	TopK int `json:"topk"`
+
+	// ReturnLogits returns the model's raw logits at every position. Each
+	// position is a full vocabulary row (50257 values for GPT2), so this is
+	// limited to texts of at most MAX_LOGITS_TOKENS tokens.
+	ReturnLogits bool `json:"return_logits"`
+
+	// Explain adds a short English explanation of the verdict, built from
+	// the perplexity and burstiness it was based on and the thresholds they
+	// were compared with. Not supported with method detectgpt.
+	Explain bool `json:"explain"`
+
+	// BorderlineMargin marks verdicts and sentences whose perplexity is
+	// within this distance of a threshold (60 or 80) as borderline, listing
+	// the labels on both sides. The labels themselves are unchanged. nil
+	// uses the server's BORDERLINE_MARGIN; 0 turns it off.
+	BorderlineMargin *float64 `json:"borderline_margin,omitempty"`
+
+	// Entropy returns the mean predictive entropy of the document.
+	Entropy bool `json:"entropy"`
+
+	// LogRank returns the mean log-rank of the document's tokens.
+	LogRank bool `json:"log_rank"`
+
+	// Segmentation selects how the text is divided for per-line analysis:
+	// "sentence" (default), "paragraph" (split at blank lines) or "window"
+	// (chunks of SegmentTokens tokens; 0 uses the server default of 128).
+	Segmentation  string `json:"segmentation,omitempty"`
+	SegmentTokens int    `json:"segment_tokens"`
+
+	// Rolling requests a perplexity track over sliding token windows.
+	Rolling *RollingOptions `json:"rolling,omitempty"`
+
+	// Histogram requests bucketed counts of per-line perplexity, using
+	// HistogramEdges if set, else HistogramBuckets equal-width buckets
+	// (0 uses the server default of 10).
+	Histogram        bool      `json:"histogram"`
+	HistogramBuckets int       `json:"histogram_buckets"`
+	HistogramEdges   []float64 `json:"histogram_edges,omitempty"`
+
+	// CI requests a confidence interval for the document perplexity at
+	// CILevel (between 0 and 1; 0 uses 0.95), estimated from the spread of
+	// the per-line perplexities.
+	CI      bool    `json:"ci"`
+	CILevel float64 `json:"ci_level"`
+}
+
+// RollingOptions select the windows of a rolling perplexity track: Window
+// tokens each (at most the model's max_length), starting every Step tokens.
+type RollingOptions struct {
+	Window int `json:"window"`
+	Step   int `json:"step"`
+}
+
+// RollingPoint is the perplexity of tokens [StartToken, EndToken), which
+// cover characters [CharStart, CharEnd) of the text. The character range is
+// left out if the tokenizer returned no offsets for the window's tokens.
+type RollingPoint struct {
+	StartToken int     `json:"start_token"`
+	EndToken   int     `json:"end_token"`
+	CharStart  *int    `json:"char_start,omitempty"`
+	CharEnd    *int    `json:"char_end,omitempty"`
+	Perplexity float64 `json:"perplexity"`
+}
+
+// CharRange selects the characters [Start, End) of a text, counted in
+// Unicode code points.
+type CharRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// RangeResult describes what a range request scored: the characters
+// [Start, End) it asked for, the tokens [TokenStart, TokenEnd) that overlap
+// them, and the ContextTokens before them the model saw as context.
+type RangeResult struct {
+	Start         int `json:"start"`
+	End           int `json:"end"`
+	TokenStart    int `json:"token_start"`
+	TokenEnd      int `json:"token_end"`
+	ContextTokens int `json:"context_tokens"`
+}
+
+// WindowInfo describes one forward pass of a sliding-window perplexity. It
+// ran on tokens [StartToken, EndToken) and scored those from ScoredStart on;
+// the ContextTokens before ScoredStart were context only. A window with
+// TruncatedContext starts after the beginning of the text (or of its
+// <|endoftext|>-delimited document), so the model saw at most max_length
+// tokens of what came before: scores of its tokens are less reliable the
+// smaller ContextTokens is, and are most affected near ScoredStart.
+type WindowInfo struct {
+	StartToken       int  `json:"start_token"`
+	EndToken         int  `json:"end_token"`
+	ScoredStart      int  `json:"scored_start"`
+	ContextTokens    int  `json:"context_tokens"`
+	TruncatedContext bool `json:"truncated_context"`
+}
+
+// TokenPrediction shows what the model expected at one position of the
+// document: the token that actually appeared, its probability and rank
+// (1 = the model's top choice), and the most likely alternatives.
+type TokenPrediction struct {
+	Position     int                `json:"position"` // Token index in the document
+	Token        string             `json:"token"`
+	TokenID      uint32             `json:"token_id"`
+	Probability  float64            `json:"probability"`
+	Rank         int                `json:"rank"`
+	Alternatives []TokenAlternative `json:"alternatives"`
+}
+
+// TokenAlternative is one of the model's top predictions for a position.
+type TokenAlternative struct {
+	Token       string  `json:"token"`
+	TokenID     uint32  `json:"token_id"`
+	Probability float64 `json:"probability"`
+}
+
+// ConfidenceInterval bounds the document perplexity at the given Level,
+// e.g. 0.95.
+type ConfidenceInterval struct {
+	Level float64 `json:"level"`
+	Low   float64 `json:"low"`
+	High  float64 `json:"high"`
+}
+
+// ClassProbabilities is a distribution over the verdict classes, summing
+// to 1.
+type ClassProbabilities struct {
+	AI    float64 `json:"ai"`
+	Human float64 `json:"human"`
+}
+
+// Histogram holds bucketed per-line perplexity counts. Counts[i] is the
+// number of lines with perplexity in [Edges[i], Edges[i+1]).
+type Histogram struct {
+	Edges  []float64 `json:"edges"`
+	Counts []int     `json:"counts"`
+}
+
+type SentenceDetail struct {
+	Index          int     `json:"index"` // Position in the document, kept when sentences are sorted
+	Text           string  `json:"text"`
+	Perplexity     float64 `json:"perplexity,omitempty"`
+	Label          int     `json:"label"`
+	Classification string  `json:"classification"`
+	Confidence     float64 `json:"confidence"`
+	IsUncertain    bool    `json:"is_uncertain"` // Perplexity is in the borderline band; Label is 0 but shouldn't be trusted
+
+	// TokenStart and TokenEnd are the range [TokenStart, TokenEnd) of the
+	// document's tokens that belong to the sentence, and CharStart and
+	// CharEnd the range of Unicode characters Text was taken from. Both
+	// count from the start of the scored text, after any strip_markup.
+	// Sentences scored together as one chunk share its perplexity but keep
+	// their own ranges.
+	TokenStart int `json:"token_start"`
+	TokenEnd   int `json:"token_end"`
+	CharStart  int `json:"char_start"`
+	CharEnd    int `json:"char_end"`
+
+	// NormalizedScore is the 0-1 AI-likeness of Perplexity, comparable
+	// across models. Set only when the server has reference distributions.
+	NormalizedScore *float64 `json:"normalized_score,omitempty"`
+
+	// ZScore is the perplexity's distance from the document's mean line
+	// perplexity, in standard deviations. It is not set on streamed
+	// sentences, which are sent before the document statistics are known.
+	ZScore *float64 `json:"z_score,omitempty"`
+
+	// Borderline is set when Perplexity lies within borderline_margin of a
+	// threshold; see InferenceResponse.Borderline.
+	Borderline *Borderline `json:"borderline,omitempty"`
+}
+
+// InferenceResponse is the verbose (JSON) response of POST /infer.
+type InferenceResponse struct {
+	SchemaVersion        int                 `json:"schema_version"` // See SchemaVersion
+	Status               string              `json:"status,omitempty"`
+	Perplexity           *float64            `json:"Perplexity,omitempty"`
+	NormalizedScore      *float64            `json:"normalized_score,omitempty"`             // 0-1 AI-likeness of Perplexity; needs reference distributions
+	AvgPerplexityPerLine *float64            `json:"avg_perplexity_per_line,omitempty"`      // Mean perplexity of the scored lines; formerly Perplexity_per_line
+	WeightedPerplexity   *float64            `json:"weighted_perplexity_per_line,omitempty"` // Mean line perplexity weighted by token count
+	WeightedByTokens     bool                `json:"weighted_by_tokens,omitempty"`           // The verdict used WeightedPerplexity rather than AvgPerplexityPerLine
+	Burstiness           *float64            `json:"Burstiness,omitempty"`
+	Label                *int                `json:"label,omitempty"`
+	IsUncertain          bool                `json:"is_uncertain,omitempty"`  // The document verdict is borderline; route it to human review
+	Probabilities        *ClassProbabilities `json:"probabilities,omitempty"` // Probability of each class for the perplexity the verdict used
+	Confidence           *float64            `json:"confidence,omitempty"`    // Confidence, in percent, of the document verdict
+	Message              string              `json:"message,omitempty"`
+	Explanation          string              `json:"explanation,omitempty"`               // Why the verdict was reached, for explain
+	DetectedLanguage     string              `json:"detected_language,omitempty"`         // ISO 639-1 guess at the text's language; empty if unsure
+	LowConfidenceShort   bool                `json:"low_confidence_short_text,omitempty"` // The text was below min_chars and analyzed anyway, for allow_short
+	Warning              string              `json:"warning,omitempty"`                   // Caveat about the result, e.g. for non-English text
+	Sentences            []SentenceDetail    `json:"sentences,omitempty"`
+	SentenceCount        int                 `json:"sentence_count,omitempty"`         // Sentences analyzed, including any left out of Sentences
+	TruncatedSentences   bool                `json:"truncated_sentences,omitempty"`    // Sentences was cut to max_sentences
+	LineInferencesCapped bool                `json:"line_inferences_capped,omitempty"` // Lines were scored in merged groups to stay within max_line_inferences
+	MarkedText           string              `json:"marked_text,omitempty"`
+	TokenCount           int                 `json:"token_count,omitempty"`
+	Method               string              `json:"method,omitempty"`
+	DetectGPTScore       *float64            `json:"detectgpt_score,omitempty"`
+	Histogram            *Histogram          `json:"histogram,omitempty"`
+	CI                   *ConfidenceInterval `json:"ci,omitempty"`
+	Rolling              []RollingPoint      `json:"rolling,omitempty"`
+	TopK                 []TokenPrediction   `json:"topk,omitempty"`
+	Logits               [][]float32         `json:"logits,omitempty"`            // Raw logits per position, for return_logits
+	MeanEntropy          *float64            `json:"mean_entropy,omitempty"`      // Mean Shannon entropy (nats) of the model's predictions; lower suggests AI
+	MeanLogRank          *float64            `json:"mean_log_rank,omitempty"`     // Mean ln(rank) of the actual tokens (rank 1 = top choice); lower suggests AI
+	Truncated            bool                `json:"truncated,omitempty"`         // The inference budget ran out or truncate applied; results cover only part of the text
+	EOSFound             bool                `json:"eos_found,omitempty"`         // The text contained <|endoftext|> markers, which reset the context
+	Approximate          bool                `json:"approximate,omitempty"`       // Perplexity was estimated from a sample of windows
+	WindowsProcessed     int                 `json:"windows_processed,omitempty"` // Forward passes run for the document perplexity
+	TotalNLL             *float64            `json:"total_nll,omitempty"`         // Summed negative log-likelihood (nats) of the document's scored tokens
+	TotalTokens          int                 `json:"total_tokens,omitempty"`      // Tokens TotalNLL covers; Perplexity is exp(TotalNLL/TotalTokens)
+	Stride               int                 `json:"stride,omitempty"`            // Tokens each window advanced by
+	MaxLength            int                 `json:"max_length,omitempty"`        // Tokens per window
+
+	// ContextTruncated is set if any window of the document perplexity
+	// started after the start of the text, so its tokens were scored
+	// without the text before it; see WindowInfo. Windows lists every
+	// window, for window_info.
+	ContextTruncated bool         `json:"context_truncated,omitempty"`
+	Windows          []WindowInfo `json:"windows,omitempty"`
+
+	// Range is set for a range request; Perplexity and the verdict then
+	// refer to the range alone.
+	Range *RangeResult `json:"range,omitempty"`
+
+	// Borderline is set when the perplexity the verdict used lies within
+	// borderline_margin of a threshold, where near-identical texts can get
+	// different labels.
+	Borderline *Borderline `json:"borderline,omitempty"`
+
+	// Repetition is the fraction of the text's 4-token sequences that
+	// repeat an earlier one. Looping or copy-pasted text scores a very low
+	// perplexity however it was written, so HighRepetition, set once
+	// Repetition reaches REPETITION_THRESHOLD, means the verdict shouldn't
+	// be trusted. The verdict itself is not adjusted.
+	Repetition     *float64 `json:"repetition,omitempty"`
+	HighRepetition bool     `json:"high_repetition,omitempty"`
+}
+
+// Borderline marks a verdict whose perplexity is within Margin of
+// Threshold. Labels are the verdicts on either side of it ("ai",
+// "uncertain" or "human"), lower perplexity first, each with the distance
+// from the perplexity to that verdict's side of the threshold: 0 for the
+// verdict given.
+type Borderline struct {
+	Threshold float64           `json:"threshold"`
+	Margin    float64           `json:"margin"`
+	Labels    []BorderlineLabel `json:"labels"`
+}
+
+// BorderlineLabel is one of the verdicts next to a borderline perplexity.
+type BorderlineLabel struct {
+	Label    string  `json:"label"`
+	Distance float64 `json:"distance"`
+}
+
+// PerplexityRequest is the body of POST /perplexity.
+type PerplexityRequest struct {
+	Sentence       string   `json:"sentence"`
+	MinChars       *int     `json:"min_chars,omitempty"`   // Minimum alphanumeric characters; nil uses the server default
+	StripMarkup    bool     `json:"strip_markup"`          // Remove markdown syntax and HTML tags before scoring
+	Locale         string   `json:"locale,omitempty"`      // Language of the status message
+	Temperature    *float64 `json:"temperature,omitempty"` // Softmax temperature; nil uses 1.0
+	MaxInferenceMS int      `json:"max_inference_ms"`      // Scoring budget; 0 uses the server default
+	SampleRate     float64  `json:"sample_rate"`           // Fraction of windows scored; 0 or 1 scores all
+	NonOverlapping bool     `json:"non_overlapping"`       // Advance windows by max_length rather than STRIDE
+	Truncate       bool     `json:"truncate"`              // Score only the first max_length tokens
+
+	// PositionOffset starts the text's position ids at this value rather
+	// than 0, for a completion scored apart from the prompt of that many
+	// tokens it followed. Offset plus the text's tokens must fit in
+	// max_length.
+	PositionOffset int `json:"position_offset"`
+
+	// WindowInfo is as for /infer.
+	WindowInfo bool `json:"window_info"`
+
+	// NormalizeWhitespace is as for /infer.
+	NormalizeWhitespace *bool `json:"normalize_whitespace,omitempty"`
+
+	// StrideFraction is as for /infer.
+	StrideFraction *float64 `json:"stride_fraction,omitempty"`
+
+	// Prefix is context the sentence is scored after, e.g. a prompt, and is
+	// not itself scored. Together they must fit in one window. With a
+	// KV-cache model the prefix's state is reused across requests.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// Job is the response of POST /jobs and GET /jobs/{id}. Status is queued,
+// running, done or failed; Result holds the verbose /infer response once the
+// job is done, and Error the reason it failed.
+type Job struct {
+	ID     string             `json:"id"`
+	Status string             `json:"status"`
+	Result *InferenceResponse `json:"result,omitempty"`
+	Error  string             `json:"error,omitempty"`
+
+	// While the job runs, WindowsDone of the WindowsTotal scoring passes
+	// have finished, Progress percent, and Sentences holds the sentences
+	// scored so far. Progress is 100 once the job is done.
+	WindowsDone  int              `json:"windows_done,omitempty"`
+	WindowsTotal int              `json:"windows_total,omitempty"`
+	Progress     *float64         `json:"progress,omitempty"`
+	Sentences    []SentenceDetail `json:"sentences,omitempty"`
+}
+
+// PerplexityResponse is the response of POST /perplexity.
+type PerplexityResponse struct {
+	Status           string   `json:"status,omitempty"`
+	Perplexity       *float64 `json:"perplexity,omitempty"`
+	NormalizedScore  *float64 `json:"normalized_score,omitempty"` // 0-1 AI-likeness of Perplexity; needs reference distributions
+	TokenCount       int      `json:"token_count,omitempty"`
+	Truncated        bool     `json:"truncated,omitempty"`         // The inference budget ran out or truncate applied; perplexity covers only part of the text
+	EOSFound         bool     `json:"eos_found,omitempty"`         // The text contained <|endoftext|> markers, which reset the context
+	Approximate      bool     `json:"approximate,omitempty"`       // Perplexity was estimated from a sample of windows
+	PrefixCached     bool     `json:"prefix_cached,omitempty"`     // The prefix's KV state came from the cache
+	WindowsProcessed int      `json:"windows_processed,omitempty"` // Forward passes run
+	TotalNLL         *float64 `json:"total_nll,omitempty"`         // Summed negative log-likelihood (nats) of the scored tokens
+	TotalTokens      int      `json:"total_tokens,omitempty"`      // Tokens TotalNLL covers; Perplexity is exp(TotalNLL/TotalTokens)
+	Stride           int      `json:"stride,omitempty"`            // Tokens each window advanced by
+	MaxLength        int      `json:"max_length,omitempty"`        // Tokens per window
+
+	// ContextTruncated is set if any window of the document perplexity
+	// started after the start of the text, so its tokens were scored
+	// without the text before it; see WindowInfo. Windows lists every
+	// window, for window_info.
+	ContextTruncated bool         `json:"context_truncated,omitempty"`
+	Windows          []WindowInfo `json:"windows,omitempty"`
+}
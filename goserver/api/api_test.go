@@ -0,0 +1,45 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// avg_perplexity_per_line is a single number, and the old name that read
+// like an array is gone.
+func TestAvgPerplexityPerLineRoundTrip(t *testing.T) {
+	avg, weighted := 37.25, 41.5
+	in := InferenceResponse{
+		SchemaVersion:        SchemaVersion,
+		AvgPerplexityPerLine: &avg,
+		WeightedPerplexity:   &weighted,
+		Sentences:            []SentenceDetail{{Text: "One.", Perplexity: 30}, {Index: 1, Text: "Two.", Perplexity: 44.5}},
+	}
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := raw["avg_perplexity_per_line"].(float64); !ok || v != avg {
+		t.Errorf("avg_perplexity_per_line = %#v, want the number %v", raw["avg_perplexity_per_line"], avg)
+	}
+	if _, ok := raw["Perplexity_per_line"]; ok {
+		t.Error("the old Perplexity_per_line field is still sent")
+	}
+	if raw["schema_version"] != float64(2) {
+		t.Errorf("schema_version = %v, want 2", raw["schema_version"])
+	}
+
+	var out InferenceResponse
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip changed the response:\n got %+v\nwant %+v", out, in)
+	}
+}
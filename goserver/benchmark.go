@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// benchmarkText is the canned document of the SIGUSR1 self-benchmark: a few
+// paragraphs, so a run covers tokenizing, the document pass and per-line
+// scoring like a typical request.
+const benchmarkText = `The committee met on Tuesday to review the budget for the coming year. Most of the discussion centered on the library, whose roof has leaked for three winters running. Nobody disputed that it needed fixing; the argument was over whether to patch it again or replace it outright.
+
+Replacing the roof would cost roughly twice as much up front. Supporters pointed out that the patches had already added up to half that figure, and that each repair bought a single season at best. Opponents worried that the money would come out of the reading programs, which had only just recovered from the last round of cuts.
+
+In the end the committee voted to replace the roof, spreading the cost over two years. The reading programs were left untouched, and the treasurer promised a revised plan by the end of the month.`
+
+// benchmarkRunning is set while a self-benchmark runs, so signals that
+// arrive meanwhile don't start another.
+var benchmarkRunning atomic.Bool
+
+// watchBenchmarkSignal runs the self-benchmark each time the process gets
+// SIGUSR1. It does nothing if BENCHMARK_RUNS is 0.
+func watchBenchmarkSignal(runs int) {
+	if runs <= 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			if !benchmarkRunning.CompareAndSwap(false, true) {
+				slog.Warn("self-benchmark already running, ignoring SIGUSR1")
+				continue
+			}
+			go func() {
+				defer benchmarkRunning.Store(false)
+				runBenchmark(runs)
+			}()
+		}
+	}()
+}
+
+// runBenchmark analyzes benchmarkText runs times, one after another, and
+// logs the latency percentiles. Requests are served as usual meanwhile; the
+// benchmark only takes its turn at the model like any other request, so
+// their latencies include it.
+func runBenchmark(runs int) {
+	m := model.Load()
+	if m == nil || !modelReady.Load() {
+		slog.Warn("self-benchmark skipped, model is not ready")
+		return
+	}
+	slog.Info("self-benchmark started", "runs", runs)
+
+	latencies := make([]time.Duration, 0, runs)
+	for i := 0; i < runs; i++ {
+		params, err := resolveParams(InferenceRequest{}, "")
+		if err != nil {
+			slog.Error("self-benchmark failed", "error", err)
+			return
+		}
+		start := time.Now()
+		if _, err := m.Infer(context.Background(), benchmarkText, params, nil); err != nil {
+			slog.Error("self-benchmark failed", "run", i+1, "error", err)
+			return
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	slog.Info("self-benchmark finished",
+		"runs", runs,
+		"min", latencies[0],
+		"p50", latencyPercentile(latencies, 50),
+		"p90", latencyPercentile(latencies, 90),
+		"p99", latencyPercentile(latencies, 99),
+		"max", latencies[len(latencies)-1],
+	)
+}
+
+// latencyPercentile returns the p-th percentile of sorted by the
+// nearest-rank method.
+func latencyPercentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	return sorted[max(rank, 1)-1]
+}
@@ -0,0 +1,44 @@
+package main
+
+import "math"
+
+// verdictThresholds are the perplexities getResults splits verdicts at,
+// with the verdict on either side.
+var verdictThresholds = []struct {
+	at           float64
+	below, above string
+}{
+	{60, "ai", "uncertain"},
+	{80, "uncertain", "human"},
+}
+
+// borderline reports whether ppl lies within margin of a threshold, giving
+// the threshold and the verdicts on both sides with how far ppl is from
+// each. It returns nil if ppl is clear of every threshold or margin is 0.
+// If the margins of both thresholds overlap, the nearer one is reported.
+// Only the label ppl gets is at distance 0: like getResults, a perplexity
+// exactly at a threshold takes the verdict above it, and is the smallest
+// step from the one below.
+func borderline(ppl, margin float64) *Borderline {
+	if margin <= 0 || !isFinite(ppl) {
+		return nil
+	}
+	var result *Borderline
+	nearest := math.Inf(1)
+	for _, t := range verdictThresholds {
+		d := math.Abs(ppl - t.at)
+		if d > margin || d >= nearest {
+			continue
+		}
+		nearest = d
+		result = &Borderline{
+			Threshold: t.at,
+			Margin:    margin,
+			Labels: []BorderlineLabel{
+				{Label: t.below, Distance: math.Max(ppl-math.Nextafter(t.at, math.Inf(-1)), 0)},
+				{Label: t.above, Distance: math.Max(t.at-ppl, 0)},
+			},
+		}
+	}
+	return result
+}
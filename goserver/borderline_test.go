@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBorderline(t *testing.T) {
+	below60 := 60 - math.Nextafter(60, 0)
+	for _, tc := range []struct {
+		name      string
+		ppl       float64
+		margin    float64
+		threshold float64 // 0 for no borderline
+		below     float64 // Distances of the labels below and above it
+		above     float64
+	}{
+		{"just below 60", 59.2, 2, 60, 0, 0.8},
+		{"just above 60", 61.5, 2, 60, 1.5 + below60, 0},
+		{"exactly 60", 60, 2, 60, below60, 0},
+		{"exactly 80", 80, 2, 80, 80 - math.Nextafter(80, 0), 0},
+		{"at the edge of the margin", 58, 2, 60, 0, 2},
+		{"outside the margin", 57.9, 2, 0, 0, 0},
+		{"clear of both", 70, 2, 0, 0, 0},
+		{"margin 0 is off", 60, 0, 0, 0, 0},
+		{"negative margin is off", 60, -1, 0, 0, 0},
+		{"not finite", math.NaN(), 2, 0, 0, 0},
+		{"overlapping margins, nearer 60", 68, 15, 60, 8 + below60, 0},
+		{"overlapping margins, nearer 80", 73, 15, 80, 0, 7},
+		{"overlapping margins, a tie takes 60", 70, 15, 60, 10 + below60, 0},
+	} {
+		b := borderline(tc.ppl, tc.margin)
+		if tc.threshold == 0 {
+			if b != nil {
+				t.Errorf("%s: borderline(%v, %v) = %+v, want nil", tc.name, tc.ppl, tc.margin, b)
+			}
+			continue
+		}
+		if b == nil {
+			t.Errorf("%s: borderline(%v, %v) = nil, want threshold %v", tc.name, tc.ppl, tc.margin, tc.threshold)
+			continue
+		}
+		if b.Threshold != tc.threshold || b.Margin != tc.margin || len(b.Labels) != 2 {
+			t.Errorf("%s: borderline(%v, %v) = %+v, want threshold %v", tc.name, tc.ppl, tc.margin, b, tc.threshold)
+			continue
+		}
+		if math.Abs(b.Labels[0].Distance-tc.below) > 1e-12 || math.Abs(b.Labels[1].Distance-tc.above) > 1e-12 {
+			t.Errorf("%s: distances = %v, %v; want %v, %v", tc.name, b.Labels[0].Distance, b.Labels[1].Distance, tc.below, tc.above)
+		}
+
+		// The label at distance 0 is the one getResults gives
+		_, label, _, uncertain := getResults(tc.ppl, catalogs[defaultLocale])
+		verdict := "human"
+		switch {
+		case uncertain:
+			verdict = "uncertain"
+		case label == 0:
+			verdict = "ai"
+		}
+		for _, l := range b.Labels {
+			if (l.Distance == 0) != (l.Label == verdict) {
+				t.Errorf("%s: %s at distance %v, but getResults says %s", tc.name, l.Label, l.Distance, verdict)
+			}
+		}
+	}
+}
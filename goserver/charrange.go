@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/daulet/tokenizers"
+)
+
+// errRange is returned by Infer when a request's range doesn't fit the text
+// or covers no tokens.
+var errRange = errors.New("invalid range")
+
+// validateRange checks a request's range for the options it can be combined
+// with; its bounds are checked against the text in Infer.
+func validateRange(req InferenceRequest) (*CharRange, error) {
+	r := req.Range
+	if r == nil {
+		return nil, nil
+	}
+	if r.Start < 0 || r.End <= r.Start {
+		return nil, fmt.Errorf("range must have 0 <= start < end")
+	}
+	switch {
+	case req.Method == "detectgpt":
+		return nil, fmt.Errorf("range is not supported with method detectgpt")
+	case req.Rolling != nil, req.Histogram, req.CI, req.ReturnLogits, req.TopK > 0, req.Entropy, req.LogRank:
+		return nil, fmt.Errorf("range returns only the range's perplexity and verdict; drop rolling, histogram, ci, return_logits, topk, entropy and log_rank")
+	}
+	return r, nil
+}
+
+// inferRange scores the characters [r.Start, r.End) of the text as sent,
+// chars.text, given the encoding of the text as scored, which chars maps
+// back to it. The range is scored in one window with as much of the text
+// before it as fits, so its tokens keep their document context; a range
+// longer than one window is scored on its own.
+func (m *GPT2Model) inferRange(ctx context.Context, r CharRange, ids []uint32, offsets []tokenizers.Offset, chars *charOffsets, params inferParams, response *InferenceResponse) error {
+	if n := utf8.RuneCountInString(chars.text); r.End > n {
+		return fmt.Errorf("%w: end %d is past the end of the text (%d characters)", errRange, r.End, n)
+	}
+	from, to := byteOffset(chars.text, r.Start), byteOffset(chars.text, r.End)
+	from, to = chars.origin.clean(from), chars.origin.clean(to)
+
+	// The range takes every token that overlaps it
+	tokStart := 0
+	for tokStart < len(offsets) && int(offsets[tokStart][1]) <= from {
+		tokStart++
+	}
+	tokEnd := tokStart
+	for tokEnd < len(offsets) && int(offsets[tokEnd][0]) < to {
+		tokEnd++
+	}
+	if tokStart >= tokEnd {
+		return fmt.Errorf("%w: the range covers no tokens", errRange)
+	}
+
+	ctxStart := tokStart
+	if tokEnd-tokStart <= m.maxLength {
+		ctxStart = max(tokEnd-m.maxLength, 0)
+	}
+	opts := params.score.withoutStats()
+	opts.truncate = false
+	opts.tokenNLLs = newTokenNLLs(tokEnd - ctxStart)
+	opts.progress.plan(m.windowCount(ids[ctxStart:tokEnd], opts))
+	result, err := m.getPPLIDs(ctx, ids[ctxStart:tokEnd], opts)
+	if errors.Is(err, errNoTokens) {
+		return fmt.Errorf("%w: the range covers no scorable tokens", errRange)
+	}
+	if err != nil {
+		return err
+	}
+	// The text's first token has no context and no score of its own
+	ppl, err := opts.tokenNLLs.perplexity(tokStart-ctxStart, tokEnd-ctxStart)
+	if err != nil {
+		return fmt.Errorf("%w: the range covers no scorable tokens", errRange)
+	}
+
+	response.Range = &RangeResult{
+		Start:         r.Start,
+		End:           r.End,
+		TokenStart:    tokStart,
+		TokenEnd:      tokEnd,
+		ContextTokens: tokStart - ctxStart,
+	}
+	response.Perplexity = &ppl
+	response.NormalizedScore = normalizedScore(ppl)
+	response.TokenCount = tokEnd - tokStart
+	response.Truncated = result.Truncated
+	response.WindowsProcessed = result.Windows
+	response.Stride = m.strideFor(opts)
+	response.MaxLength = m.maxLength
+
+	message, label, confidence, uncertain := getResults(ppl, params.msgs)
+	response.Label = &label
+	response.Confidence = &confidence
+	response.Message = message
+	response.IsUncertain = uncertain
+	response.Probabilities = classProbabilities(ppl)
+	response.Borderline = borderline(ppl, params.borderlineMargin)
+	if params.explain {
+		response.Explanation = explainVerdict("Range perplexity", ppl, nil)
+	}
+	return nil
+}
+
+// byteOffset returns the byte offset of the n-th character of s, or len(s)
+// if s has n characters.
+func byteOffset(s string, n int) int {
+	for i := range s {
+		if n == 0 {
+			return i
+		}
+		n--
+	}
+	return len(s)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// cleanText normalizes the invisible differences copy-pasted text tends to
+// carry, so texts that read the same tokenize the same:
+//
+//   - CRLF and lone CR become LF
+//   - non-breaking and other Unicode spaces become ASCII spaces, and runs of
+//     spaces collapse to one
+//   - zero-width spaces, word joiners, byte order marks and soft hyphens are
+//     removed, as are control characters other than tab and newline
+//
+// Zero-width joiners and non-joiners are kept, as they change how emoji and
+// some scripts read. The returned textMap maps offsets in the cleaned text
+// back to text; it is nil if nothing changed.
+func cleanText(text string) (string, *textMap) {
+	var b strings.Builder
+	m := &textMap{}
+	changed, lastSpace := false, false
+
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		next := i + size
+		switch {
+		case r == '\r':
+			if next < len(text) && text[next] == '\n' {
+				m.skip(b.Len(), next) // Drop the CR; the LF follows as itself
+			} else {
+				b.WriteByte('\n')
+			}
+			lastSpace, changed = false, true
+		case r == ' ' || r != '\t' && r != '\n' && unicode.IsSpace(r):
+			if lastSpace {
+				m.skip(b.Len(), next) // Collapsed into the space before
+				changed = true
+				break
+			}
+			b.WriteByte(' ')
+			if r != ' ' {
+				m.skip(b.Len(), next)
+				changed = true
+			}
+			lastSpace = true
+		case isInvisible(r):
+			m.skip(b.Len(), next)
+			changed = true
+		default:
+			b.WriteString(text[i:next])
+			lastSpace = false
+		}
+		i = next
+	}
+
+	if !changed {
+		return text, nil
+	}
+	return b.String(), m
+}
+
+// isInvisible reports whether cleanText removes r: characters that render
+// as nothing but still reach the tokenizer.
+func isInvisible(r rune) bool {
+	switch r {
+	case '\u200b', '\u2060', '\ufeff', '\u00ad': // Zero-width space, word joiner, BOM, soft hyphen
+		return true
+	case '\t', '\n':
+		return false
+	}
+	return unicode.IsControl(r)
+}
+
+// textMap maps byte offsets in a text cleaned by cleanText back to the text
+// it came from. Between shifts, offsets advance together; each shift records
+// that cleaned offset clean corresponds to original offset orig. A nil
+// *textMap is the identity.
+type textMap struct {
+	shifts []textShift
+}
+
+type textShift struct {
+	clean, orig int
+}
+
+// skip records that the cleaned text at offset clean continues from
+// original offset orig.
+func (m *textMap) skip(clean, orig int) {
+	if n := len(m.shifts); n > 0 && m.shifts[n-1].clean == clean {
+		m.shifts[n-1].orig = orig
+		return
+	}
+	m.shifts = append(m.shifts, textShift{clean, orig})
+}
+
+// start returns the original offset of the character at cleaned offset n.
+func (m *textMap) start(n int) int {
+	if m == nil {
+		return n
+	}
+	i := sort.Search(len(m.shifts), func(i int) bool { return m.shifts[i].clean > n })
+	if i == 0 {
+		return n
+	}
+	s := m.shifts[i-1]
+	return s.orig + n - s.clean
+}
+
+// clean returns the cleaned offset of original offset o. An offset inside
+// something cleanText removed or collapsed maps to where it was removed.
+func (m *textMap) clean(o int) int {
+	if m == nil {
+		return o
+	}
+	i := sort.Search(len(m.shifts), func(i int) bool { return m.shifts[i].orig > o })
+	c := o
+	if i > 0 {
+		s := m.shifts[i-1]
+		c = s.clean + o - s.orig
+	}
+	if i < len(m.shifts) {
+		c = min(c, m.shifts[i].clean)
+	}
+	return c
+}
+
+// end returns the original offset just after a range that ends at cleaned
+// offset n. Unlike start, it doesn't take in characters cleanText removed
+// after the range.
+func (m *textMap) end(n int) int {
+	if m == nil || n == 0 {
+		return n
+	}
+	return m.start(n-1) + 1
+}
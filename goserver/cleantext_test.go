@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCleanText(t *testing.T) {
+	for _, tc := range []struct {
+		text, want string
+	}{
+		{"plain text", "plain text"},
+		{"no\u00a0break", "no break"},
+		{"two \u00a0spaces", "two spaces"},
+		{"line\r\nbreak\rhere", "line\nbreak\nhere"},
+		{"zero\u200bwidth soft\u00adhyphen", "zerowidth softhyphen"},
+		{"tab\tand\nnewline", "tab\tand\nnewline"},
+	} {
+		got, origin := cleanText(tc.text)
+		if got != tc.want {
+			t.Errorf("cleanText(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+		if (origin == nil) != (got == tc.text) {
+			t.Errorf("cleanText(%q): nil textMap = %v, want %v", tc.text, origin == nil, got == tc.text)
+		}
+		// The last character maps back to the last character of the original
+		if end := origin.end(len(got)); end != len(tc.text) {
+			t.Errorf("cleanText(%q): end maps to %d, want %d", tc.text, end, len(tc.text))
+		}
+	}
+}
+
+// A no-break space scores exactly as the space it stands for, and maps back
+// to its own offsets.
+func TestCleanTextNBSPScoresAsSpace(t *testing.T) {
+	m, _ := newTestModel(t, 64, 64)
+	spaced := "one two three four"
+	nbsp := "one\u00a0two\u00a0three\u00a0four"
+
+	cleaned, origin := cleanText(nbsp)
+	if cleaned != spaced {
+		t.Fatalf("cleanText(%q) = %q, want %q", nbsp, cleaned, spaced)
+	}
+	want, err := m.getPPL(context.Background(), spaced, defaultScoreOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.getPPL(context.Background(), cleaned, defaultScoreOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Perplexity != want.Perplexity || got.Tokens != want.Tokens {
+		t.Errorf("NBSP text = perplexity %v over %d tokens, want %v over %d", got.Perplexity, got.Tokens, want.Perplexity, want.Tokens)
+	}
+	if _, err := m.getPPL(context.Background(), nbsp, defaultScoreOptions); !errors.Is(err, errNoTokens) {
+		t.Error("uncleaned NBSP text scored, want it to run together into one token")
+	}
+
+	// Each no-break space is two bytes: "two" starts at 4 cleaned and 5
+	// originally, "four" at 14 and 17
+	if got := origin.start(4); got != 5 {
+		t.Errorf("start(4) = %d, want 5", got)
+	}
+	if got := origin.start(14); got != 17 {
+		t.Errorf("start(14) = %d, want 17", got)
+	}
+}
@@ -0,0 +1,242 @@
+// Package client is a Go client for the isgpt HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"isgpt-server/api"
+)
+
+// DefaultBaseURL is where the server listens by default.
+const DefaultBaseURL = "http://localhost:9081"
+
+// ErrNoVerdict is returned by Classify when the server analyzed the text but
+// did not reach a verdict, e.g. because the text is too short.
+var ErrNoVerdict = errors.New("isgpt: server returned no verdict")
+
+// APIError is returned when the server responds with a non-200 status.
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("server returned error %d: %s", e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+// Client talks to an isgpt server. Its zero value is not usable; create one
+// with New.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithTimeout bounds each request made by the client.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.httpClient.Timeout = d }
+}
+
+// WithAPIKey sends key as a bearer token on every request.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithHTTPClient replaces the underlying http.Client.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// New returns a Client for the server at baseURL (DefaultBaseURL if empty).
+func New(baseURL string, opts ...Option) *Client {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Infer runs the full analysis on text and returns the verbose response.
+func (c *Client) Infer(ctx context.Context, text string, opts api.InferOptions) (*api.InferenceResponse, error) {
+	opts.Verbose = true
+	req := api.InferenceRequest{Sentence: text, InferOptions: opts}
+
+	var resp api.InferenceResponse
+	if err := c.postJSON(ctx, "/infer", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// InferText runs the full analysis on text and returns the server's
+// human-readable plain-text report.
+func (c *Client) InferText(ctx context.Context, text string, opts api.InferOptions) (string, error) {
+	opts.Verbose = false
+	req := api.InferenceRequest{Sentence: text, InferOptions: opts}
+
+	body, err := c.post(ctx, "/infer", req)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// InferReader is Infer for text read from r, which is streamed to the server
+// as a text/plain body rather than held in memory and wrapped in JSON.
+func (c *Client) InferReader(ctx context.Context, r io.Reader, opts api.InferOptions) (*api.InferenceResponse, error) {
+	opts.Verbose = true
+	data, err := c.postText(ctx, "/infer", r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp api.InferenceResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &resp, nil
+}
+
+// InferTextReader is InferText for text read from r, streamed as in
+// InferReader.
+func (c *Client) InferTextReader(ctx context.Context, r io.Reader, opts api.InferOptions) (string, error) {
+	opts.Verbose = false
+	data, err := c.postText(ctx, "/infer", r, opts)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Classify returns only the document-level label (0 = AI, 1 = Human) and
+// message. It returns ErrNoVerdict if the server did not classify the text.
+func (c *Client) Classify(ctx context.Context, text string) (int, string, error) {
+	resp, err := c.Infer(ctx, text, api.InferOptions{})
+	if err != nil {
+		return 0, "", err
+	}
+	if resp.Label == nil {
+		return 0, resp.Message, fmt.Errorf("%w: %s", ErrNoVerdict, resp.Status)
+	}
+	return *resp.Label, resp.Message, nil
+}
+
+// Perplexity returns the raw document perplexity of text.
+func (c *Client) Perplexity(ctx context.Context, text string) (*api.PerplexityResponse, error) {
+	var resp api.PerplexityResponse
+	if err := c.postJSON(ctx, "/perplexity", api.PerplexityRequest{Sentence: text}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// postJSON posts body to path and decodes the JSON response into out.
+func (c *Client) postJSON(ctx context.Context, path string, body, out interface{}) error {
+	data, err := c.post(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// post sends body as JSON to path and returns the raw response body.
+func (c *Client) post(ctx context.Context, path string, body interface{}) ([]byte, error) {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	return c.do(ctx, path, "application/json", bytes.NewReader(jsonData))
+}
+
+// postText streams body to path as text/plain, passing opts as query
+// parameters, and returns the raw response body.
+func (c *Client) postText(ctx context.Context, path string, body io.Reader, opts interface{}) ([]byte, error) {
+	query, err := optionsQuery(opts)
+	if err != nil {
+		return nil, err
+	}
+	if query != "" {
+		path += "?" + query
+	}
+	return c.do(ctx, path, "text/plain; charset=utf-8", body)
+}
+
+// optionsQuery encodes the JSON fields of opts as query parameters, the form
+// the server accepts alongside a text/plain body. Strings are sent as they
+// are and other values as JSON, false and 0 included: for pointer options
+// such as MinChars an explicit zero differs from the server default. Only
+// fields omitempty leaves out, or that are null, are left to the server.
+func optionsQuery(opts interface{}) (string, error) {
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal options: %w", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", fmt.Errorf("failed to marshal options: %w", err)
+	}
+
+	query := url.Values{}
+	for key, raw := range fields {
+		if string(raw) == "null" {
+			continue
+		}
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			query.Set(key, s)
+		} else {
+			query.Set(key, string(raw))
+		}
+	}
+	return query.Encode(), nil
+}
+
+// do posts body to path and returns the raw response body.
+func (c *Client) do(ctx context.Context, path, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	// An uncertain verdict may come with the server's UNCERTAIN_STATUS, but
+	// is a result all the same
+	if resp.StatusCode != http.StatusOK && resp.Header.Get(api.UncertainHeader) == "" {
+		return nil, &APIError{StatusCode: resp.StatusCode, Body: string(data)}
+	}
+	return data, nil
+}
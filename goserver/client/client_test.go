@@ -0,0 +1,51 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"isgpt-server/api"
+)
+
+// Explicit false and 0 pointer options must reach the server on the
+// text/plain path, as they do in a JSON body; nil ones must not.
+func TestInferReaderSendsExplicitZeroOptions(t *testing.T) {
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"label":1}`))
+	}))
+	defer srv.Close()
+
+	zero, no := 0, false
+	opts := api.InferOptions{
+		MinChars:            &zero,
+		PerSentence:         &no,
+		NormalizeWhitespace: &no,
+		DocumentPerplexity:  &no,
+	}
+	if _, err := New(srv.URL).InferReader(context.Background(), strings.NewReader("some text"), opts); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"min_chars":            "0",
+		"per_sentence":         "false",
+		"normalize_whitespace": "false",
+		"document_perplexity":  "false",
+		"verbose":              "true",
+	} {
+		if got, ok := query[key]; !ok || got[0] != want {
+			t.Errorf("%s = %q (sent %v), want %q", key, query.Get(key), ok, want)
+		}
+	}
+	for _, key := range []string{"weight_by_tokens", "temperature", "result_line"} {
+		if query.Has(key) {
+			t.Errorf("%s = %q sent for a nil option", key, query.Get(key))
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config holds the server settings resolved from the environment at startup.
+type Config struct {
+	Host        string
+	Port        string
+	GzipMinSize int // Smallest response body, in bytes, worth gzipping
+	Model       ModelConfig
+
+	MaxDecompressedBytes int64 // Largest request body, once decompressed
+
+	// HTTP server timeouts; 0 disables each. WriteTimeout must cover the
+	// longest inference, and is lifted for event streams.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// Responses to POSTs with an Idempotency-Key are replayed for
+	// IdempotencyTTL (0 disables this), holding at most
+	// IdempotencyMaxEntries of them
+	IdempotencyTTL        time.Duration
+	IdempotencyMaxEntries int
+
+	// POST /jobs queues at most JobQueueSize analyses (0 disables /jobs)
+	// for JobWorkers to run; results are kept JobTTL after they finish, at
+	// most JobMaxFinished of them
+	JobQueueSize   int
+	JobWorkers     int
+	JobTTL         time.Duration
+	JobMaxFinished int
+
+	// /stats summarizes the inferences of the last StatsWindow, keeping at
+	// most StatsMaxEntries of them (0 disables /stats)
+	StatsWindow     time.Duration
+	StatsMaxEntries int
+
+	// A CloudEvent is posted to WebhookURL (empty disables this) after each
+	// inference, from a queue of WebhookQueueSize events; failed deliveries
+	// are retried WebhookRetries times
+	WebhookURL       string
+	WebhookQueueSize int
+	WebhookRetries   int
+	WebhookTimeout   time.Duration
+
+	DetectGPTPerturbations int     // Default perturbations for method=detectgpt
+	MinChars               int     // Default minimum alphanumeric characters to analyze
+	MaxInferenceMS         int     // Default per-request scoring budget; 0 means unlimited
+	InvalidUTF8            string  // "reject" or "repair" request bodies that aren't valid UTF-8
+	MessagesFile           string  // Optional JSON file overriding or adding message locales
+	PlainTemplate          string  // text/template for plain-text /infer responses; empty uses the default
+	PlainResultLine        bool    // End plain-text /infer responses with a #RESULT line
+	NormalizeWhitespace    bool    // Clean invisible characters and odd spaces before tokenizing
+	EnableH2C              bool    // Serve cleartext HTTP/2 alongside HTTP/1.1
+	RequireEnglish         bool    // Refuse non-English text unless the request sends force
+	WeightByTokens         bool    // Base the verdict on the token-weighted mean line perplexity
+	UncertainStatus        int     // HTTP status of /infer responses with an uncertain verdict
+	AdminAddr              string  // Listen address for operator endpoints (pprof); empty disables them
+	AdminToken             string  // Bearer token the admin endpoints require; empty requires none
+	MaxTopK                int     // Largest "topk" a request may ask for
+	MaxTopKPositions       int     // Positions reported when "topk" is set
+	MaxLogitsTokens        int     // Longest text, in tokens, that return_logits accepts
+	MaxTokens              int     // Longest text, in tokens, scored at all; 0 means no limit
+	BenchmarkRuns          int     // Runs of the SIGUSR1 self-benchmark; 0 ignores the signal
+	MaxLineInferences      int     // Most per-line scoring passes per /infer request; 0 means no cap
+	ProbFloor              float64 // Smallest token probability counted; 0 means no clamp
+	ConfidenceFloor        float64 // Minimum confidence, in percent, of an AI or Human verdict
+	BorderlineMargin       float64 // Perplexity distance from a threshold reported as borderline; 0 disables it
+	RepetitionThreshold    float64 // Repetition from which a text is flagged high_repetition
+	FloatPrecision         int     // Decimals kept in JSON floats; negative keeps full precision
+
+	// Reference distributions for normalized scores; nil disables them
+	Reference *referenceDists
+}
+
+// ModelConfig describes which model files to load and how to window them.
+type ModelConfig struct {
+	ModelPath     string // Local path or http(s) URL
+	TokenizerPath string // Local path or http(s) URL
+
+	ModelSHA256     string // Expected hex SHA-256 of the model file, if set
+	TokenizerSHA256 string // Expected hex SHA-256 of the tokenizer file, if set
+	CacheDir        string // Where files fetched from URLs are kept
+
+	MaxLength   int // Tokens per inference window (GPT2's n_positions)
+	Stride      int // Tokens the window advances by; must be <= MaxLength
+	BatchSize   int // Per-line chunks scored per forward pass
+	KVCacheSize int // Prefixes whose KV state is kept, for models with past_key_values
+
+	// Tokens the startup check text must encode to; 0 skips the count check
+	TokenizerCheckTokens int
+	EOSReset             bool // Restart the context at each <|endoftext|> in the text
+	TokenizerTruncation  bool // Let the tokenizer cut texts at MaxLength tokens instead of windowing
+
+	// Names of the model's token id and position id inputs and its logits
+	// output; empty detects them
+	InputIDsName    string
+	PositionIDsName string
+	LogitsName      string
+}
+
+func loadConfig() (Config, error) {
+	cfg := Config{
+		Host:          getEnv("HOST", "0.0.0.0"),
+		Port:          getEnv("PORT", "9081"),
+		InvalidUTF8:   getEnv("INVALID_UTF8", "reject"),
+		MessagesFile:  os.Getenv("MESSAGES_FILE"),
+		PlainTemplate: os.Getenv("PLAIN_TEMPLATE"),
+		AdminAddr:     os.Getenv("ADMIN_ADDR"),
+		AdminToken:    os.Getenv("ADMIN_TOKEN"),
+		WebhookURL:    os.Getenv("WEBHOOK_URL"),
+		Model: ModelConfig{
+			ModelPath:     getEnv("MODEL_PATH", "/app/models/model.onnx"),
+			TokenizerPath: getEnv("TOKENIZER_PATH", "/app/models/tokenizer.json"),
+
+			ModelSHA256:     os.Getenv("MODEL_SHA256"),
+			TokenizerSHA256: os.Getenv("TOKENIZER_SHA256"),
+			CacheDir:        getEnv("MODEL_CACHE_DIR", "/app/models/cache"),
+
+			InputIDsName:    os.Getenv("INPUT_IDS_NAME"),
+			PositionIDsName: os.Getenv("POSITION_IDS_NAME"),
+			LogitsName:      os.Getenv("LOGITS_NAME"),
+		},
+	}
+
+	var err error
+	if cfg.Model.MaxLength, err = getEnvInt("MAX_LENGTH", 1024); err != nil {
+		return cfg, err
+	}
+	if cfg.Model.Stride, err = getEnvInt("STRIDE", 512); err != nil {
+		return cfg, err
+	}
+	if cfg.Model.BatchSize, err = getEnvInt("BATCH_SIZE", 1); err != nil {
+		return cfg, err
+	}
+	if cfg.Model.TokenizerCheckTokens, err = getEnvInt("TOKENIZER_CHECK_TOKENS", 10); err != nil {
+		return cfg, err
+	}
+	if cfg.Model.KVCacheSize, err = getEnvInt("KV_CACHE_SIZE", 8); err != nil {
+		return cfg, err
+	}
+	if cfg.Model.EOSReset, err = getEnvBool("EOS_RESET", true); err != nil {
+		return cfg, err
+	}
+	if cfg.Model.TokenizerTruncation, err = getEnvBool("TOKENIZER_TRUNCATION", false); err != nil {
+		return cfg, err
+	}
+	if cfg.GzipMinSize, err = getEnvInt("GZIP_MIN_SIZE", 1024); err != nil {
+		return cfg, err
+	}
+	maxDecompressed, err := getEnvInt("MAX_DECOMPRESSED_BYTES", 32<<20)
+	if err != nil {
+		return cfg, err
+	}
+	if maxDecompressed <= 0 {
+		return cfg, fmt.Errorf("MAX_DECOMPRESSED_BYTES must be positive")
+	}
+	cfg.MaxDecompressedBytes = int64(maxDecompressed)
+	if cfg.DetectGPTPerturbations, err = getEnvInt("DETECTGPT_PERTURBATIONS", 10); err != nil {
+		return cfg, err
+	}
+	if cfg.DetectGPTPerturbations < minPerturbations || cfg.DetectGPTPerturbations > maxPerturbations {
+		return cfg, fmt.Errorf("DETECTGPT_PERTURBATIONS must be between %d and %d", minPerturbations, maxPerturbations)
+	}
+	if cfg.MinChars, err = getEnvInt("MIN_CHARS", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.MinChars < 0 {
+		return cfg, fmt.Errorf("MIN_CHARS must not be negative")
+	}
+	if cfg.MaxInferenceMS, err = getEnvInt("MAX_INFERENCE_MS", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxInferenceMS < 0 {
+		return cfg, fmt.Errorf("MAX_INFERENCE_MS must not be negative")
+	}
+
+	if cfg.EnableH2C, err = getEnvBool("ENABLE_H2C", false); err != nil {
+		return cfg, err
+	}
+	if cfg.RequireEnglish, err = getEnvBool("REQUIRE_ENGLISH", false); err != nil {
+		return cfg, err
+	}
+	if cfg.PlainResultLine, err = getEnvBool("PLAIN_RESULT_LINE", false); err != nil {
+		return cfg, err
+	}
+	if cfg.NormalizeWhitespace, err = getEnvBool("NORMALIZE_WHITESPACE", true); err != nil {
+		return cfg, err
+	}
+	if cfg.WeightByTokens, err = getEnvBool("WEIGHT_BY_TOKENS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.UncertainStatus, err = getEnvInt("UNCERTAIN_STATUS", http.StatusOK); err != nil {
+		return cfg, err
+	}
+	if cfg.UncertainStatus < 200 || cfg.UncertainStatus > 599 ||
+		cfg.UncertainStatus == http.StatusNoContent || cfg.UncertainStatus == http.StatusNotModified {
+		return cfg, fmt.Errorf("UNCERTAIN_STATUS must be a 2xx-5xx status that allows a body")
+	}
+
+	if cfg.ReadHeaderTimeout, err = getEnvDuration("READ_HEADER_TIMEOUT", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.ReadTimeout, err = getEnvDuration("READ_TIMEOUT", time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.WriteTimeout, err = getEnvDuration("WRITE_TIMEOUT", 5*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.IdleTimeout, err = getEnvDuration("IDLE_TIMEOUT", 2*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.IdempotencyTTL, err = getEnvDuration("IDEMPOTENCY_TTL", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.IdempotencyMaxEntries, err = getEnvInt("IDEMPOTENCY_MAX_ENTRIES", 10000); err != nil {
+		return cfg, err
+	}
+	if cfg.IdempotencyMaxEntries <= 0 {
+		return cfg, fmt.Errorf("IDEMPOTENCY_MAX_ENTRIES must be positive")
+	}
+	if cfg.JobQueueSize, err = getEnvInt("JOB_QUEUE_SIZE", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.JobQueueSize < 0 {
+		return cfg, fmt.Errorf("JOB_QUEUE_SIZE must not be negative")
+	}
+	if cfg.JobWorkers, err = getEnvInt("JOB_WORKERS", 1); err != nil {
+		return cfg, err
+	}
+	if cfg.JobWorkers <= 0 {
+		return cfg, fmt.Errorf("JOB_WORKERS must be positive")
+	}
+	if cfg.JobTTL, err = getEnvDuration("JOB_TTL", time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.JobTTL <= 0 {
+		return cfg, fmt.Errorf("JOB_TTL must be positive")
+	}
+	if cfg.JobMaxFinished, err = getEnvInt("JOB_MAX_FINISHED", 1000); err != nil {
+		return cfg, err
+	}
+	if cfg.JobMaxFinished <= 0 {
+		return cfg, fmt.Errorf("JOB_MAX_FINISHED must be positive")
+	}
+	if cfg.StatsWindow, err = getEnvDuration("STATS_WINDOW", 5*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.StatsWindow <= 0 {
+		return cfg, fmt.Errorf("STATS_WINDOW must be positive")
+	}
+	if cfg.StatsMaxEntries, err = getEnvInt("STATS_MAX_ENTRIES", 1000); err != nil {
+		return cfg, err
+	}
+	if cfg.StatsMaxEntries < 0 {
+		return cfg, fmt.Errorf("STATS_MAX_ENTRIES must not be negative")
+	}
+	if cfg.WebhookQueueSize, err = getEnvInt("WEBHOOK_QUEUE_SIZE", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.WebhookQueueSize <= 0 {
+		return cfg, fmt.Errorf("WEBHOOK_QUEUE_SIZE must be positive")
+	}
+	if cfg.WebhookRetries, err = getEnvInt("WEBHOOK_RETRIES", 3); err != nil {
+		return cfg, err
+	}
+	if cfg.WebhookRetries < 0 {
+		return cfg, fmt.Errorf("WEBHOOK_RETRIES must not be negative")
+	}
+	if cfg.WebhookTimeout, err = getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.WebhookTimeout <= 0 {
+		return cfg, fmt.Errorf("WEBHOOK_TIMEOUT must be positive")
+	}
+	if cfg.WebhookURL != "" && !isRemotePath(cfg.WebhookURL) {
+		return cfg, fmt.Errorf("WEBHOOK_URL must be an http(s) URL")
+	}
+
+	if cfg.MaxTopK, err = getEnvInt("MAX_TOPK", 20); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxTopKPositions, err = getEnvInt("MAX_TOPK_POSITIONS", 1000); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxTopK < 0 || cfg.MaxTopKPositions < 0 {
+		return cfg, fmt.Errorf("MAX_TOPK and MAX_TOPK_POSITIONS must not be negative")
+	}
+	if cfg.MaxTokens, err = getEnvInt("MAX_TOKENS", 32768); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxTokens < 0 {
+		return cfg, fmt.Errorf("MAX_TOKENS must not be negative")
+	}
+	if cfg.MaxLineInferences, err = getEnvInt("MAX_LINE_INFERENCES", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxLineInferences < 0 {
+		return cfg, fmt.Errorf("MAX_LINE_INFERENCES must not be negative")
+	}
+	if cfg.BenchmarkRuns, err = getEnvInt("BENCHMARK_RUNS", 20); err != nil {
+		return cfg, err
+	}
+	if cfg.BenchmarkRuns < 0 {
+		return cfg, fmt.Errorf("BENCHMARK_RUNS must not be negative")
+	}
+	if cfg.MaxLogitsTokens, err = getEnvInt("MAX_LOGITS_TOKENS", 8); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxLogitsTokens < 0 || cfg.MaxLogitsTokens > cfg.Model.MaxLength {
+		return cfg, fmt.Errorf("MAX_LOGITS_TOKENS must be between 0 and MAX_LENGTH")
+	}
+	if cfg.ConfidenceFloor, err = getEnvFloat("CONFIDENCE_FLOOR", 50); err != nil {
+		return cfg, err
+	}
+	if cfg.ConfidenceFloor < 0 || cfg.ConfidenceFloor > 100 {
+		return cfg, fmt.Errorf("CONFIDENCE_FLOOR must be between 0 and 100")
+	}
+	if cfg.RepetitionThreshold, err = getEnvFloat("REPETITION_THRESHOLD", 0.3); err != nil {
+		return cfg, err
+	}
+	if cfg.RepetitionThreshold <= 0 || cfg.RepetitionThreshold > 1 {
+		return cfg, fmt.Errorf("REPETITION_THRESHOLD must be greater than 0 and at most 1")
+	}
+	if cfg.BorderlineMargin, err = getEnvFloat("BORDERLINE_MARGIN", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.BorderlineMargin < 0 {
+		return cfg, fmt.Errorf("BORDERLINE_MARGIN must not be negative")
+	}
+	if cfg.ProbFloor, err = getEnvFloat("PROB_FLOOR", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.ProbFloor < 0 || cfg.ProbFloor >= 1 {
+		return cfg, fmt.Errorf("PROB_FLOOR must be at least 0 and below 1")
+	}
+	if cfg.FloatPrecision, err = getEnvInt("FLOAT_PRECISION", -1); err != nil {
+		return cfg, err
+	}
+	if cfg.Reference, err = loadReferenceDists(); err != nil {
+		return cfg, err
+	}
+
+	if cfg.InvalidUTF8 != "reject" && cfg.InvalidUTF8 != "repair" {
+		return cfg, fmt.Errorf("INVALID_UTF8 must be reject or repair")
+	}
+
+	return cfg, nil
+}
+
+// getEnv returns the value of the environment variable name, or def if unset.
+func getEnv(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// redacted returns c with secrets masked, for logging and /admin/config:
+// the admin token, and any credentials or query string (e.g. a signature)
+// in model, tokenizer and webhook URLs.
+func (c Config) redacted() Config {
+	if c.AdminToken != "" {
+		c.AdminToken = "REDACTED"
+	}
+	c.Model.ModelPath = redactURL(c.Model.ModelPath)
+	c.Model.TokenizerPath = redactURL(c.Model.TokenizerPath)
+	c.WebhookURL = redactURL(c.WebhookURL)
+	return c
+}
+
+// redactURL masks the password and query of an http(s) URL p. Local paths
+// are returned as they are.
+func redactURL(p string) string {
+	if !isRemotePath(p) {
+		return p
+	}
+	u, err := url.Parse(p)
+	if err != nil {
+		return "REDACTED"
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "REDACTED"
+	}
+	return u.String()
+}
+
+// getEnvInt parses the environment variable name as an integer, or returns def if unset.
+func getEnvInt(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, v, err)
+	}
+	return n, nil
+}
+
+// getEnvFloat parses the environment variable name as a finite float, or returns def if unset.
+func getEnvFloat(name string, def float64) (float64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || !isFinite(f) {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return f, nil
+}
+
+// getEnvDuration parses the environment variable name as a non-negative
+// duration such as "30s", or returns def if unset.
+func getEnvDuration(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return d, nil
+}
+
+// getEnvBool parses the environment variable name as a boolean, or returns def if unset.
+func getEnvBool(name string, def bool) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %w", name, v, err)
+	}
+	return b, nil
+}
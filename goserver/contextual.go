@@ -0,0 +1,49 @@
+package main
+
+import "math"
+
+// tokenNLLs records the NLL of every token the document pass scores, by
+// document position, so per-line perplexities can be taken from the same
+// forward passes with full preceding context. It is set in scoreOptions only
+// for the document-level pass of a contextual request. A nil *tokenNLLs
+// records nothing.
+type tokenNLLs struct {
+	base int       // Document position of the next target, set per window
+	nll  []float64 // NaN where a token wasn't scored
+}
+
+// newTokenNLLs returns a recorder for a document of n tokens.
+func newTokenNLLs(n int) *tokenNLLs {
+	t := &tokenNLLs{nll: make([]float64, n)}
+	for i := range t.nll {
+		t.nll[i] = math.NaN()
+	}
+	return t
+}
+
+// record stores the NLL of the i-th target of the current window.
+func (t *tokenNLLs) record(i int, nll float64) {
+	if t == nil {
+		return
+	}
+	if pos := t.base + i; pos >= 0 && pos < len(t.nll) {
+		t.nll[pos] = nll
+	}
+}
+
+// perplexity returns the perplexity of the scored tokens in [start, end), or
+// errNoTokens if none were: the document's first token, and tokens in
+// windows left out by sampling or the deadline, have no score.
+func (t *tokenNLLs) perplexity(start, end int) (float64, error) {
+	sum, n := 0.0, 0
+	for _, v := range t.nll[start:min(end, len(t.nll))] {
+		if !math.IsNaN(v) {
+			sum += v
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, errNoTokens
+	}
+	return math.Exp(sum / float64(n)), nil
+}
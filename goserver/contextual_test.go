@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestTokenNLLsPerplexity(t *testing.T) {
+	nlls := newTokenNLLs(5)
+	nlls.base = 1 // The first token has no context
+	for i, v := range []float64{1, 2, 3} {
+		nlls.record(i, v)
+	}
+
+	if got, err := nlls.perplexity(0, 3); err != nil || math.Abs(got-math.Exp(1.5)) > 1e-12 {
+		t.Errorf("perplexity(0, 3) = %v, %v; want %v, the unscored first token left out", got, err, math.Exp(1.5))
+	}
+	if got, err := nlls.perplexity(2, 10); err != nil || math.Abs(got-math.Exp(2.5)) > 1e-12 {
+		t.Errorf("perplexity(2, 10) = %v, %v; want %v", got, err, math.Exp(2.5))
+	}
+	for _, r := range [][2]int{{0, 1}, {4, 5}} {
+		if _, err := nlls.perplexity(r[0], r[1]); !errors.Is(err, errNoTokens) {
+			t.Errorf("perplexity(%d, %d): err = %v, want errNoTokens", r[0], r[1], err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// explainVerdict describes, in English, how the verdict on ppl was reached,
+// e.g. "Average perplexity 92.3 exceeds the human threshold 80; burstiness
+// 115.2 indicates natural variation." basis names the perplexity the verdict
+// used. burstiness is left out of the explanation when nil, as it is when
+// lines weren't scored.
+func explainVerdict(basis string, ppl float64, burstiness *float64) string {
+	var parts []string
+	switch {
+	case ppl < 60:
+		parts = append(parts, fmt.Sprintf("%s %.1f is below the AI threshold 60", basis, ppl))
+	case ppl < 80:
+		parts = append(parts, fmt.Sprintf("%s %.1f is between the AI threshold 60 and the human threshold 80, so the verdict is uncertain", basis, ppl))
+	default:
+		parts = append(parts, fmt.Sprintf("%s %.1f exceeds the human threshold 80", basis, ppl))
+	}
+
+	// Burstiness is the highest line perplexity: people tend to write at
+	// least one surprising line, while generated text stays even
+	if burstiness != nil {
+		if *burstiness >= 80 {
+			parts = append(parts, fmt.Sprintf("burstiness %.1f indicates natural variation", *burstiness))
+		} else {
+			parts = append(parts, fmt.Sprintf("burstiness %.1f shows little variation between lines", *burstiness))
+		}
+	}
+	return strings.Join(parts, "; ") + "."
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fetchTimeout bounds a single model or tokenizer download.
+const fetchTimeout = 30 * time.Minute
+
+// isRemotePath reports whether p is an http(s) URL rather than a local file.
+func isRemotePath(p string) bool {
+	return strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://")
+}
+
+// localFile returns a local path for p. Plain paths are returned as is. URLs
+// are downloaded into cacheDir once and reused on later starts; if checksum
+// (hex SHA-256) is set, both cached and fresh downloads must match it.
+func localFile(p, checksum, cacheDir string) (string, error) {
+	if !isRemotePath(p) {
+		return p, nil
+	}
+	checksum = strings.ToLower(checksum)
+
+	// Key the cache on the URL so different files with the same name don't
+	// collide, keeping the name readable
+	key := sha256.Sum256([]byte(p))
+	name := hex.EncodeToString(key[:8]) + "-" + path.Base(strings.SplitN(p, "?", 2)[0])
+	cached := filepath.Join(cacheDir, name)
+
+	if _, err := os.Stat(cached); err == nil {
+		if checksum == "" {
+			slog.Info("using cached download", "url", p, "path", cached)
+			return cached, nil
+		}
+		sum, err := fileSHA256(cached)
+		if err != nil {
+			return "", err
+		}
+		if sum == checksum {
+			slog.Info("using cached download", "url", p, "path", cached)
+			return cached, nil
+		}
+		slog.Warn("cached download has the wrong checksum, fetching again", "url", p, "path", cached)
+	}
+
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	slog.Info("downloading", "url", p, "path", cached)
+	if err := download(p, cached, checksum); err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", p, err)
+	}
+	return cached, nil
+}
+
+// download fetches url to dest, hashing it on the way. It writes to a
+// temporary file and renames it into place only once complete and verified,
+// so an interrupted download never leaves a truncated file to be reused.
+func download(url, dest, checksum string) error {
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), filepath.Base(dest)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); checksum != "" && sum != checksum {
+		return fmt.Errorf("checksum mismatch: got %s, want %s", sum, checksum)
+	}
+	return os.Rename(tmp.Name(), dest)
+}
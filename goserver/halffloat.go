@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// logitsTensor is the output tensor for a forward pass's logits, in the
+// element type the model produces. float16 exports write into raw bytes,
+// which data widens to float32; the NLL math then runs in float64 as usual.
+type logitsTensor struct {
+	value  ort.Value
+	floats []float32 // Backing slice for float32 logits
+	half   []byte    // Backing slice for float16 logits
+}
+
+// newLogitsTensor allocates a logits output of the given shape in the
+// model's logits type.
+func (m *GPT2Model) newLogitsTensor(shape ort.Shape) (*logitsTensor, error) {
+	if m.logitsType == ort.TensorElementDataTypeFloat16 {
+		half := make([]byte, 2*shape.FlattenedSize())
+		t, err := newCustomTensor(shape, half, ort.TensorElementDataTypeFloat16)
+		if err != nil {
+			return nil, err
+		}
+		return &logitsTensor{value: t, half: half}, nil
+	}
+	floats := make([]float32, shape.FlattenedSize())
+	t, err := newFloat32Tensor(shape, floats)
+	if err != nil {
+		return nil, err
+	}
+	return &logitsTensor{value: t, floats: floats}, nil
+}
+
+// data returns the logits as float32. Every float16 value is exactly
+// representable in float32, so widening loses nothing.
+func (t *logitsTensor) data() []float32 {
+	if t.half == nil {
+		return t.floats
+	}
+	out := make([]float32, len(t.half)/2)
+	for i := range out {
+		out[i] = float16ToFloat32(binary.LittleEndian.Uint16(t.half[2*i:]))
+	}
+	return out
+}
+
+func (t *logitsTensor) Destroy() error {
+	return t.value.Destroy()
+}
+
+// float16ToFloat32 decodes an IEEE 754 half-precision value.
+func float16ToFloat32(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	frac := uint32(h) & 0x3ff
+
+	switch {
+	case exp == 0x1f: // Inf or NaN
+		return math.Float32frombits(sign | 0xff<<23 | frac<<13)
+	case exp != 0: // Normal: rebias the exponent from 15 to 127
+		return math.Float32frombits(sign | (exp+127-15)<<23 | frac<<13)
+	case frac == 0: // Signed zero
+		return math.Float32frombits(sign)
+	}
+	// Subnormal: frac × 2^-24, which float32 holds as a normal number
+	f := float32(frac) * (1.0 / (1 << 24))
+	if sign != 0 {
+		f = -f
+	}
+	return f
+}
+
+// logitsTypeName is the name /info reports for a supported logits type.
+func logitsTypeName(t ort.TensorElementDataType) string {
+	switch t {
+	case ort.TensorElementDataTypeFloat:
+		return "float32"
+	case ort.TensorElementDataTypeFloat16:
+		return "float16"
+	}
+	return fmt.Sprint(t)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFloat16ToFloat32(t *testing.T) {
+	for _, tc := range []struct {
+		h    uint16
+		want float32
+	}{
+		{0x0000, 0},
+		{0x8000, float32(math.Copysign(0, -1))},
+		{0x3c00, 1},
+		{0xc000, -2},
+		{0x3555, 0.333251953125},
+		{0x7bff, 65504},                  // Largest normal
+		{0x0400, 6.103515625e-05},        // Smallest normal, 2^-14
+		{0x03ff, 6.097555160522461e-05},  // Largest subnormal
+		{0x0001, 5.960464477539063e-08},  // Smallest subnormal, 2^-24
+		{0x8001, -5.960464477539063e-08}, // Negative subnormal
+		{0x0200, 3.0517578125e-05},       // Subnormal, 2^-15
+		{0x7c00, float32(math.Inf(1))},   // +Inf
+		{0xfc00, float32(math.Inf(-1))},  // -Inf
+	} {
+		got := float16ToFloat32(tc.h)
+		if math.Float32bits(got) != math.Float32bits(tc.want) {
+			t.Errorf("float16ToFloat32(%#04x) = %v (%#08x), want %v (%#08x)", tc.h, got, math.Float32bits(got), tc.want, math.Float32bits(tc.want))
+		}
+	}
+
+	for _, h := range []uint16{0x7e00, 0x7c01, 0xfe00, 0x7fff} {
+		if got := float16ToFloat32(h); !math.IsNaN(float64(got)) {
+			t.Errorf("float16ToFloat32(%#04x) = %v, want NaN", h, got)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	defaultHistogramBuckets = 10
+	maxHistogramBuckets     = 100
+)
+
+// validateHistogram checks the histogram options of a request.
+func validateHistogram(buckets int, edges []float64) error {
+	if buckets < 0 || buckets > maxHistogramBuckets {
+		return fmt.Errorf("histogram_buckets must be between 0 and %d", maxHistogramBuckets)
+	}
+	if edges == nil {
+		return nil
+	}
+	if len(edges) < 2 || len(edges) > maxHistogramBuckets+1 {
+		return fmt.Errorf("histogram_edges must have between 2 and %d values", maxHistogramBuckets+1)
+	}
+	for i, e := range edges {
+		if !isFinite(e) {
+			return fmt.Errorf("histogram_edges must be finite")
+		}
+		if i > 0 && e <= edges[i-1] {
+			return fmt.Errorf("histogram_edges must be strictly increasing")
+		}
+	}
+	return nil
+}
+
+// perplexityHistogram buckets values. With explicit edges, bucket i counts
+// values in [edges[i], edges[i+1]) and values outside the range are clamped
+// into the first or last bucket. Without edges, that many equal-width buckets
+// span the observed minimum to maximum.
+func perplexityHistogram(values []float64, buckets int, edges []float64) *Histogram {
+	if edges == nil {
+		edges = evenEdges(values, buckets)
+	}
+
+	counts := make([]int, len(edges)-1)
+	for _, v := range values {
+		// Index of the first edge greater than v, minus one, is v's bucket
+		i := sort.SearchFloat64s(edges, math.Nextafter(v, math.Inf(1))) - 1
+		i = max(0, min(i, len(counts)-1))
+		counts[i]++
+	}
+
+	return &Histogram{Edges: edges, Counts: counts}
+}
+
+// evenEdges returns buckets+1 equally spaced edges from min(values) to
+// max(values). values must not be empty.
+func evenEdges(values []float64, buckets int) []float64 {
+	lo, hi := values[0], values[0]
+	for _, v := range values {
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	if hi == lo {
+		// A single distinct value still needs a non-empty range
+		hi = lo + 1
+	}
+
+	edges := make([]float64, buckets+1)
+	width := (hi - lo) / float64(buckets)
+	for i := range edges {
+		edges[i] = lo + float64(i)*width
+	}
+	edges[buckets] = hi
+	return edges
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idempotencyKeyHeader names the client-chosen id of a retry-safe request,
+// and idempotentReplayedHeader marks a response served from the cache.
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
+// idempotentResponse is a recorded response, or a placeholder while the
+// first request with its key is still being served.
+type idempotentResponse struct {
+	done    bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// idempotencyCache holds the responses to requests that carried an
+// Idempotency-Key, for ttl. Once it holds size entries, expired ones are
+// swept out; if none have expired, new keys go unrecorded until some do.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*idempotentResponse
+}
+
+// begin returns the recorded response for key, or reserves key for the
+// caller to fill with finish and reports reserved. inFlight reports that
+// another request holds the reservation. With neither, the cache is full
+// and the request should run unrecorded.
+func (c *idempotencyCache) begin(key string) (cached *idempotentResponse, inFlight, reserved bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*idempotentResponse)
+	}
+
+	now := time.Now()
+	if e, ok := c.entries[key]; ok {
+		if !e.done {
+			return nil, true, false
+		}
+		if now.Before(e.expires) {
+			return e, false, false
+		}
+		delete(c.entries, key)
+	}
+	if len(c.entries) >= c.size {
+		for k, e := range c.entries {
+			if e.done && !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.size {
+			return nil, false, false
+		}
+	}
+	c.entries[key] = &idempotentResponse{}
+	return nil, false, true
+}
+
+// finish records resp for key, or with a nil resp releases the key so a
+// retry runs again.
+func (c *idempotencyCache) finish(key string, resp *idempotentResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if resp == nil {
+		delete(c.entries, key)
+		return
+	}
+	resp.done = true
+	resp.expires = time.Now().Add(c.ttl)
+	c.entries[key] = resp
+}
+
+var idempotency idempotencyCache
+
+// idempotencyMiddleware replays the recorded response to a POST whose
+// Idempotency-Key was seen within IDEMPOTENCY_TTL, rather than running it
+// again, so at-least-once clients can retry safely. Keys are scoped to the
+// path. A retry that arrives while the first is still running gets 409.
+// Server errors and event streams are not recorded.
+func idempotencyMiddleware(next http.Handler) http.Handler {
+	if config.IdempotencyTTL <= 0 {
+		return next
+	}
+	idempotency.ttl = config.IdempotencyTTL
+	idempotency.size = config.IdempotencyMaxEntries
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+		key = r.URL.Path + "\x00" + key
+
+		cached, inFlight, reserved := idempotency.begin(key)
+		if inFlight {
+			http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+			return
+		}
+		if cached != nil {
+			for k, v := range cached.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.WriteHeader(cached.status)
+			w.Write(cached.body)
+			return
+		}
+		if !reserved {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			// Also runs on panic, so the key isn't left reserved
+			if !completed || rec.status >= 500 || rec.streaming {
+				idempotency.finish(key, nil)
+				return
+			}
+			idempotency.finish(key, &idempotentResponse{status: rec.status, header: rec.header, body: rec.body.Bytes()})
+		}()
+		next.ServeHTTP(rec, r)
+		completed = true
+	})
+}
+
+// recordingWriter passes a response through while keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	wroteHeader bool
+	streaming   bool // An event stream, which isn't recorded
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.wroteHeader = true
+		rw.status = status
+		rw.header = rw.Header().Clone()
+		rw.header.Del("X-Request-ID") // Belongs to the original request
+		rw.streaming = strings.HasPrefix(rw.header.Get("Content-Type"), "text/event-stream")
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.streaming {
+		rw.body.Write(b)
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *recordingWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// idempotentHandler returns idempotencyMiddleware over a handler that counts
+// its calls and answers with the status and Content-Type the request's
+// X-Status and X-Type headers ask for, and a body naming the call.
+func idempotentHandler(t *testing.T, maxEntries int) (http.Handler, *atomic.Int32) {
+	t.Helper()
+	saved := config
+	config.IdempotencyTTL = time.Hour
+	config.IdempotencyMaxEntries = maxEntries
+	idempotency = idempotencyCache{}
+	t.Cleanup(func() {
+		config = saved
+		idempotency = idempotencyCache{}
+	})
+
+	calls := new(atomic.Int32)
+	handler := idempotencyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		status := http.StatusOK
+		fmt.Sscan(r.Header.Get("X-Status"), &status)
+		if ct := r.Header.Get("X-Type"); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "call %d", n)
+	}))
+	return handler, calls
+}
+
+func postWithKey(handler http.Handler, path, key string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, nil)
+	r.Header.Set(idempotencyKeyHeader, key)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotencyReplays(t *testing.T) {
+	handler, calls := idempotentHandler(t, 10)
+
+	first := postWithKey(handler, "/infer", "k1", "X-Status", "202")
+	again := postWithKey(handler, "/infer", "k1", "X-Status", "202")
+	if calls.Load() != 1 {
+		t.Fatalf("handler ran %d times, want once", calls.Load())
+	}
+	if again.Code != first.Code || again.Body.String() != first.Body.String() {
+		t.Errorf("replay = %d %q, want %d %q", again.Code, again.Body, first.Code, first.Body)
+	}
+	if again.Header().Get(idempotentReplayedHeader) != "true" || first.Header().Get(idempotentReplayedHeader) != "" {
+		t.Errorf("%s = %q on the first, %q on the replay", idempotentReplayedHeader,
+			first.Header().Get(idempotentReplayedHeader), again.Header().Get(idempotentReplayedHeader))
+	}
+
+	// Keys are scoped to the path, and requests without one always run
+	postWithKey(handler, "/perplexity", "k1")
+	postWithKey(handler, "/infer", "")
+	postWithKey(handler, "/infer", "")
+	if calls.Load() != 4 {
+		t.Errorf("handler ran %d times, want 4", calls.Load())
+	}
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	idempotentHandler(t, 10) // For the cache; this test needs a slow handler
+	entered, release := make(chan struct{}), make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		w.Write([]byte("done"))
+	})
+	handler := idempotencyMiddleware(slow)
+
+	finished := make(chan *httptest.ResponseRecorder)
+	go func() { finished <- postWithKey(handler, "/infer", "k1") }()
+	<-entered
+	if w := postWithKey(handler, "/infer", "k1"); w.Code != http.StatusConflict {
+		t.Errorf("while in flight: status %d, want 409", w.Code)
+	}
+	close(release)
+	if w := <-finished; w.Code != http.StatusOK {
+		t.Fatalf("first request: status %d", w.Code)
+	}
+	if w := postWithKey(handler, "/infer", "k1"); w.Body.String() != "done" || w.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Errorf("after it finished: %q, replayed %q; want the recorded response", w.Body, w.Header().Get(idempotentReplayedHeader))
+	}
+}
+
+// Server errors and event streams aren't recorded, so a retry runs again.
+func TestIdempotencyNotRecorded(t *testing.T) {
+	for _, header := range [][]string{
+		{"X-Status", "500"},
+		{"X-Status", "503"},
+		{"X-Type", "text/event-stream"},
+	} {
+		handler, calls := idempotentHandler(t, 10)
+		postWithKey(handler, "/infer", "k1", header...)
+		w := postWithKey(handler, "/infer", "k1", header...)
+		if calls.Load() != 2 || w.Header().Get(idempotentReplayedHeader) != "" {
+			t.Errorf("%s: handler ran %d times, replayed %q; want it run again", header, calls.Load(), w.Header().Get(idempotentReplayedHeader))
+		}
+	}
+}
+
+func TestIdempotencyExpires(t *testing.T) {
+	handler, calls := idempotentHandler(t, 1)
+	postWithKey(handler, "/infer", "k1")
+
+	// A full cache with nothing expired runs new keys unrecorded
+	postWithKey(handler, "/infer", "k2")
+	postWithKey(handler, "/infer", "k2")
+	if calls.Load() != 3 {
+		t.Fatalf("handler ran %d times, want k2 run twice", calls.Load())
+	}
+
+	idempotency.entries["/infer\x00k1"].expires = time.Now().Add(-time.Second)
+	if w := postWithKey(handler, "/infer", "k1"); w.Body.String() != "call 4" {
+		t.Errorf("expired key: %q, want it run again", w.Body)
+	}
+	if w := postWithKey(handler, "/infer", "k1"); w.Body.String() != "call 4" {
+		t.Errorf("after rerunning: %q, want the new response replayed", w.Body)
+	}
+
+	// An expired entry is swept out to make room for a new key
+	idempotency.entries["/infer\x00k1"].expires = time.Now().Add(-time.Second)
+	postWithKey(handler, "/infer", "k3")
+	if w := postWithKey(handler, "/infer", "k3"); w.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Error("k3 not recorded after the expired k1 was swept")
+	}
+	if _, ok := idempotency.entries["/infer\x00k1"]; ok {
+		t.Error("expired k1 still held")
+	}
+}
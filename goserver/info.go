@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+)
+
+// Server build identity, reported by /, /info and --version. Set at build
+// time with -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+// ModelInfo describes the model being served, for verifying deployments.
+type ModelInfo struct {
+	Version           string `json:"version"`
+	Commit            string `json:"commit"`
+	ModelPath         string `json:"model_path"`
+	ModelSHA256       string `json:"model_sha256"`
+	Quantized         bool   `json:"quantized"`
+	TokenizerPath     string `json:"tokenizer_path"`
+	TokenizerSHA256   string `json:"tokenizer_sha256"`
+	VocabSize         int    `json:"vocab_size"`
+	MaxLength         int    `json:"max_length"`
+	Stride            int    `json:"stride"`
+	BatchSize         int    `json:"batch_size"`
+	AttentionMask     bool   `json:"attention_mask"`
+	KVCache           bool   `json:"kv_cache"`     // Model takes past_key_values, so prefixes can be cached
+	LogitsDType       string `json:"logits_dtype"` // "float32", or "float16" for half-precision exports
+	ExecutionProvider string `json:"execution_provider"`
+	GPU               bool   `json:"gpu"`
+
+	// TokenizerTruncation is set if the tokenizer cuts every text at
+	// MaxLength tokens, so texts are never windowed
+	TokenizerTruncation bool `json:"tokenizer_truncation"`
+}
+
+// Info reports the model's identity and windowing settings.
+func (m *GPT2Model) Info() ModelInfo {
+	return ModelInfo{
+		Version:           version,
+		Commit:            commit,
+		ModelPath:         m.modelPath,
+		ModelSHA256:       m.modelHash,
+		Quantized:         m.quantized,
+		TokenizerPath:     m.tokenizerPath,
+		TokenizerSHA256:   m.tokenizerHash,
+		VocabSize:         m.vocabSize,
+		MaxLength:         m.maxLength,
+		Stride:            m.stride,
+		BatchSize:         m.batchSize,
+		AttentionMask:     m.hasAttentionMask,
+		KVCache:           m.kv != nil,
+		LogitsDType:       logitsTypeName(m.logitsType),
+		ExecutionProvider: "cpu", // Sessions are created without a GPU provider
+		GPU:               false,
+
+		TokenizerTruncation: m.tokenizerTruncation,
+	}
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func infoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	m := model.Load()
+	if m == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{
+			"version": version,
+			"commit":  commit,
+			"status":  "model not loaded",
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(m.Info())
+}
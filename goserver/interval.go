@@ -0,0 +1,38 @@
+package main
+
+import "math"
+
+const defaultCILevel = 0.95
+
+// perplexityCI returns a confidence interval for the document perplexity
+// ppl at the given level, from the spread of the per-line perplexities.
+// It uses a normal approximation on the lines' mean NLLs (log perplexities):
+// the bounds are exp(ln ppl ± z·s/√n), where s is their standard deviation
+// over n lines. With fewer than two lines there is no spread, so it returns
+// nil.
+func perplexityCI(ppl float64, lines []float64, level float64) *ConfidenceInterval {
+	n := len(lines)
+	if n < 2 || !isFinite(ppl) || ppl <= 0 {
+		return nil
+	}
+
+	mean := 0.0
+	for _, p := range lines {
+		mean += math.Log(p)
+	}
+	mean /= float64(n)
+	variance := 0.0
+	for _, p := range lines {
+		d := math.Log(p) - mean
+		variance += d * d
+	}
+	se := math.Sqrt(variance/float64(n-1)) / math.Sqrt(float64(n))
+
+	z := math.Sqrt2 * math.Erfinv(level)
+	center := math.Log(ppl)
+	return &ConfidenceInterval{
+		Level: level,
+		Low:   math.Exp(center - z*se),
+		High:  math.Exp(center + z*se),
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job statuses, in the order a job goes through them.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// job is one analysis submitted to POST /jobs. Its fields are guarded by
+// jobStore.mu once the job is stored.
+type job struct {
+	id             string
+	req            InferenceRequest
+	acceptLanguage string
+	requestID      string // Of the POST /jobs that submitted it
+	idempotencyKey string
+	status         string
+	result         *InferenceResponse
+	err            string
+	finished       time.Time
+
+	// While the job runs: its scoring passes, and the sentences scored so far
+	progress  progress
+	sentences []SentenceDetail
+}
+
+// jobStore holds the jobs of the async API. Queued jobs wait in queue, which
+// bounds how many can be waiting at once; finished jobs are kept for ttl so
+// clients can collect them, the oldest dropped early beyond maxFinished.
+type jobStore struct {
+	mu          sync.Mutex
+	jobs        map[string]*job
+	queue       chan *job
+	ttl         time.Duration
+	maxFinished int
+	finished    []*job // Finished jobs still held, oldest first
+}
+
+var jobs jobStore
+
+// startJobWorkers sets up the queue and starts workers goroutines running
+// its jobs. It does nothing if size is 0, leaving /jobs disabled.
+func startJobWorkers(size, workers int, ttl time.Duration, maxFinished int) {
+	if size <= 0 {
+		return
+	}
+	jobs.jobs = make(map[string]*job)
+	jobs.queue = make(chan *job, size)
+	jobs.ttl = ttl
+	jobs.maxFinished = maxFinished
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range jobs.queue {
+				jobs.run(j)
+			}
+		}()
+	}
+}
+
+// submit queues j, reporting false if the queue is full.
+func (s *jobStore) submit(j *job) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	select {
+	case s.queue <- j:
+		s.jobs[j.id] = j
+		return true
+	default:
+		return false
+	}
+}
+
+// sweep drops finished jobs older than ttl, and the oldest beyond
+// maxFinished. s.mu must be held.
+func (s *jobStore) sweep() {
+	now := time.Now()
+	for len(s.finished) > 0 && (now.Sub(s.finished[0].finished) > s.ttl || len(s.finished) > s.maxFinished) {
+		delete(s.jobs, s.finished[0].id)
+		s.finished[0] = nil
+		s.finished = s.finished[1:]
+	}
+}
+
+// get returns a snapshot of the job with id, or false if there is none.
+func (s *jobStore) get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	snapshot := Job{ID: j.id, Status: j.status, Result: j.result, Error: j.err}
+	switch j.status {
+	case jobRunning:
+		snapshot.WindowsDone, snapshot.WindowsTotal = j.progress.counts()
+		percent := 0.0
+		if snapshot.WindowsTotal > 0 {
+			percent = min(100*float64(snapshot.WindowsDone)/float64(snapshot.WindowsTotal), 100)
+		}
+		snapshot.Progress = &percent
+		snapshot.Sentences = append([]SentenceDetail(nil), j.sentences...)
+	case jobDone:
+		percent := 100.0
+		snapshot.Progress = &percent
+	}
+	return snapshot, true
+}
+
+// run analyzes j. Options are resolved again now, so a max_inference_ms
+// budget counts from when the job starts rather than when it was queued. A
+// panic fails just this job, rather than killing the worker and leaving the
+// job running forever.
+func (s *jobStore) run(j *job) {
+	defer func() {
+		if v := recover(); v != nil {
+			slog.Error("job panicked", "job", j.id, "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+			s.setStatus(j, jobFailed, nil, "internal error")
+		}
+	}()
+	s.setStatus(j, jobRunning, nil, "")
+
+	m := model.Load()
+	if m == nil {
+		s.setStatus(j, jobFailed, nil, "model is not loaded")
+		return
+	}
+	params, err := resolveParams(j.req, j.acceptLanguage)
+	if err != nil {
+		s.setStatus(j, jobFailed, nil, err.Error())
+		return
+	}
+
+	ctx := context.Background()
+	start := time.Now()
+	var result *InferenceResponse
+	if j.req.Method == "detectgpt" {
+		result, err = m.DetectGPT(ctx, j.req.Sentence, params)
+	} else {
+		params.score.progress = &j.progress
+		result, err = m.Infer(ctx, j.req.Sentence, params, func(detail SentenceDetail) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			j.sentences = append(j.sentences, detail)
+		})
+	}
+	recentStats.record(result, err, time.Since(start))
+	if err != nil {
+		slog.Error("job failed", "job", j.id, "error", err)
+		s.setStatus(j, jobFailed, nil, err.Error())
+		return
+	}
+	notifyInference(j.requestID, j.idempotencyKey, inferenceEvent{Endpoint: "/jobs", JobID: j.id}, result, time.Since(start))
+	s.setStatus(j, jobDone, result, "")
+}
+
+func (s *jobStore) setStatus(j *job, status string, result *InferenceResponse, errMsg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.status, j.result, j.err = status, result, errMsg
+	if (status == jobDone || status == jobFailed) && j.finished.IsZero() {
+		j.finished = time.Now()
+		j.sentences = nil // A done job's result has them all
+		s.finished = append(s.finished, j)
+		s.sweep()
+	}
+}
+
+// jobsHandler accepts an analysis for background processing: it takes the
+// same body as /infer and answers 202 with the job's id, or 429 if the
+// queue is full.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed - use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if jobs.queue == nil {
+		http.Error(w, "The job queue is disabled (JOB_QUEUE_SIZE=0)", http.StatusNotFound)
+		return
+	}
+	if acquireModel(w, r) == nil {
+		return
+	}
+
+	var req InferenceRequest
+	if !decodeRequest(w, r, &req, &req.Sentence) {
+		return
+	}
+	// Reject bad options now rather than when the job runs
+	if _, err := resolveParams(req, r.Header.Get("Accept-Language")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.StripMarkup {
+		req.Sentence = stripMarkup(req.Sentence)
+	}
+
+	j := &job{
+		id:             newRequestID(),
+		req:            req,
+		acceptLanguage: r.Header.Get("Accept-Language"),
+		requestID:      requestIDFromContext(r.Context()),
+		idempotencyKey: r.Header.Get(idempotencyKeyHeader),
+		status:         jobQueued,
+	}
+	if !jobs.submit(j) {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "The job queue is full; retry later", http.StatusTooManyRequests)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+j.id)
+	w.WriteHeader(http.StatusAccepted)
+	encodeJSON(w, Job{ID: j.id, Status: jobQueued})
+}
+
+// jobHandler reports the status of a job: its progress and the sentences
+// scored so far while it runs, and its result once done. Jobs are forgotten
+// JOB_TTL after they finish.
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed - use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if jobs.queue == nil {
+		http.Error(w, "The job queue is disabled (JOB_QUEUE_SIZE=0)", http.StatusNotFound)
+		return
+	}
+	j, ok := jobs.get(strings.TrimPrefix(r.URL.Path, "/jobs/"))
+	if !ok {
+		http.Error(w, "No such job", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encodeJSON(w, j)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/daulet/tokenizers"
+)
+
+// panicTokenizer panics on every encoding, standing in for a bug anywhere in
+// the analysis.
+type panicTokenizer struct{ fakeTokenizer }
+
+func (panicTokenizer) EncodeWithOptions(string, bool, ...tokenizers.EncodeOption) tokenizers.Encoding {
+	panic("tokenizer bug")
+}
+
+// A panic while a job runs fails that job and leaves the worker running.
+func TestJobPanicFailsJob(t *testing.T) {
+	m, _ := newTestModel(t, 64, 64)
+	m.tokenizer = panicTokenizer{}
+	serveModel(t, m)
+
+	s := &jobStore{jobs: make(map[string]*job), ttl: time.Minute, maxFinished: 10}
+	j := &job{id: "job-1", req: InferenceRequest{Sentence: "some text to analyze"}, status: jobQueued}
+	s.jobs[j.id] = j
+	s.run(j)
+
+	got, ok := s.get(j.id)
+	if !ok {
+		t.Fatal("job is gone")
+	}
+	if got.Status != jobFailed || got.Error == "" || got.Result != nil {
+		t.Errorf("job = status %q, error %q, result %v; want failed with an error", got.Status, got.Error, got.Result)
+	}
+}
+
+// Finished jobs beyond maxFinished are dropped oldest first, before their
+// ttl; queued and running jobs don't count toward it.
+func TestJobStoreCapsFinished(t *testing.T) {
+	s := &jobStore{jobs: make(map[string]*job), ttl: time.Hour, maxFinished: 2}
+	running := &job{id: "running", status: jobRunning}
+	s.jobs[running.id] = running
+	for _, id := range []string{"a", "b", "c"} {
+		j := &job{id: id, status: jobRunning}
+		s.jobs[id] = j
+		s.setStatus(j, jobDone, &InferenceResponse{}, "")
+	}
+
+	for id, want := range map[string]bool{"a": false, "b": true, "c": true, "running": true} {
+		if _, ok := s.get(id); ok != want {
+			t.Errorf("job %s held = %v, want %v", id, ok, want)
+		}
+	}
+	if len(s.finished) != 2 {
+		t.Errorf("%d finished jobs tracked, want 2", len(s.finished))
+	}
+
+	// The ttl still applies below the cap
+	s.finished[0].finished = time.Now().Add(-2 * time.Hour)
+	if _, ok := s.get("b"); ok {
+		t.Error("job b held past its ttl")
+	}
+}
+
+// Jobs count toward /stats like requests to /infer, failures included.
+func TestJobRecordsStats(t *testing.T) {
+	saved := config.StatsMaxEntries
+	config.StatsMaxEntries = 10
+	recentStats = requestStats{}
+	t.Cleanup(func() {
+		config.StatsMaxEntries = saved
+		recentStats = requestStats{}
+	})
+
+	m, runner := newTestModel(t, 64, 64)
+	serveModel(t, m)
+	s := &jobStore{jobs: make(map[string]*job), ttl: time.Minute, maxFinished: 10}
+	text := fakeText([]uint32{1, 2, 3, 4, 5, 6, 0, 1, 2, 3})
+	for _, id := range []string{"ok", "broken"} {
+		if id == "broken" {
+			runner.err = errors.New("session broke")
+		}
+		j := &job{id: id, req: InferenceRequest{Sentence: text}, status: jobQueued}
+		s.jobs[id] = j
+		s.run(j)
+	}
+
+	stats := recentStats.since(time.Time{})
+	if len(stats) != 2 {
+		t.Fatalf("%d inferences recorded, want 2", len(stats))
+	}
+	if stats[0].verdict == "error" || stats[1].verdict != "error" {
+		t.Errorf("verdicts = %q, %q; want the failed job recorded as an error", stats[0].verdict, stats[1].verdict)
+	}
+}
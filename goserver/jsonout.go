@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// encodeJSON writes v as JSON after passing it through sanitizeFloats, so a
+// stray NaN or Inf can't make the encoder fail halfway through a response.
+func encodeJSON(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(sanitizeFloats(v, config.FloatPrecision))
+}
+
+// marshalJSON is json.Marshal with the same float handling as encodeJSON.
+func marshalJSON(v interface{}) ([]byte, error) {
+	return json.Marshal(sanitizeFloats(v, config.FloatPrecision))
+}
+
+// sanitizeFloats prepares the floats in v for encoding/json, which rejects
+// NaN and Inf. A non-finite float behind a pointer or in an interface
+// becomes null; a plain float field, which can't be null, becomes 0. With
+// precision >= 0, finite floats are rounded to that many decimals.
+//
+// v is modified in place where it is reachable through pointers, slices and
+// maps; a struct passed by value is copied first.
+func sanitizeFloats(v interface{}, precision int) interface{} {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return v
+	}
+	c := reflect.New(rv.Type()).Elem()
+	c.Set(rv)
+	sanitizeValue(c, precision)
+	return c.Interface()
+}
+
+// sanitizeValue applies sanitizeFloats to v, which must be settable for
+// floats to be rewritten.
+func sanitizeValue(v reflect.Value, precision int) {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if !isFinite(f) {
+			f = 0
+		}
+		v.SetFloat(roundFloat(f, precision))
+	case reflect.Pointer:
+		if v.IsNil() {
+			return
+		}
+		if isFloatKind(v.Elem().Kind()) && !isFinite(v.Elem().Float()) {
+			v.Set(reflect.Zero(v.Type()))
+			return
+		}
+		sanitizeValue(v.Elem(), precision)
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		elem := v.Elem()
+		if isFloatKind(elem.Kind()) && !isFinite(elem.Float()) {
+			v.Set(reflect.Zero(v.Type()))
+			return
+		}
+		c := reflect.New(elem.Type()).Elem()
+		c.Set(elem)
+		sanitizeValue(c, precision)
+		v.Set(c)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.CanSet() {
+				sanitizeValue(f, precision)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			sanitizeValue(v.Index(i), precision)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			c := reflect.New(iter.Value().Type()).Elem()
+			c.Set(iter.Value())
+			sanitizeValue(c, precision)
+			v.SetMapIndex(iter.Key(), c)
+		}
+	}
+}
+
+func isFloatKind(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+// roundFloat rounds f to precision decimals; a negative precision leaves it
+// as is. It goes through the decimal text, so 0.1+0.2 rounds to exactly the
+// float that parses from "0.3".
+func roundFloat(f float64, precision int) float64 {
+	if precision < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		return f
+	}
+	r, err := strconv.ParseFloat(strconv.FormatFloat(f, 'f', precision, 64), 64)
+	if err != nil {
+		return f
+	}
+	return r
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+// A response with NaN and Inf in it still encodes to valid JSON, with null
+// (or, for omitempty fields, nothing) where a non-finite value could be left
+// out.
+func TestEncodeJSONNonFinite(t *testing.T) {
+	saved := config.FloatPrecision
+	config.FloatPrecision = -1
+	defer func() { config.FloatPrecision = saved }()
+
+	inf, nan, ppl := math.Inf(1), math.NaN(), 42.5
+	response := &InferenceResponse{
+		Perplexity:           &inf,
+		AvgPerplexityPerLine: &nan,
+		WeightedPerplexity:   &ppl,
+		Sentences:            []SentenceDetail{{Text: "A line.", Perplexity: 12, Confidence: math.NaN()}},
+	}
+	var buf bytes.Buffer
+	if err := encodeJSON(&buf, response); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("output is not valid JSON: %v\n%s", err, buf.String())
+	}
+	for _, key := range []string{"Perplexity", "avg_perplexity_per_line"} {
+		if v, ok := got[key]; ok && v != nil {
+			t.Errorf("%s = %v, want null or absent", key, v)
+		}
+	}
+	if got["weighted_perplexity_per_line"] != 42.5 {
+		t.Errorf("weighted_perplexity_per_line = %v, want 42.5", got["weighted_perplexity_per_line"])
+	}
+	// A plain float field can't be null
+	sentence := got["sentences"].([]any)[0].(map[string]any)
+	if sentence["confidence"] != 0.0 || sentence["perplexity"] != 12.0 {
+		t.Errorf("sentence = %v, want confidence 0 and perplexity 12", sentence)
+	}
+
+	// Values in a map or interface become null too
+	buf.Reset()
+	if err := encodeJSON(&buf, map[string]any{"ppl": math.NaN(), "ok": 1.5}); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"ok":1.5,"ppl":null}` + "\n"; buf.String() != want {
+		t.Errorf("got %s, want %s", buf.String(), want)
+	}
+}
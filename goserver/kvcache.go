@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// kvLayout describes the past_key_values inputs of a model exported with a
+// KV cache. Such a model needs past state on every run, so ordinary runs
+// feed one zeroed past position that the attention mask hides, and prefix
+// scoring feeds the real state of a cached prefix.
+type kvLayout struct {
+	pastInputs     []string // past_key_values.* inputs, in session order
+	presentOutputs []string // The matching present.* outputs
+	heads, headDim int64
+}
+
+// detectKV returns the KV layout of a model, or nil if it takes no
+// past_key_values inputs.
+func detectKV(inputs, outputs []ort.InputOutputInfo, hasAttentionMask bool) (*kvLayout, error) {
+	hasOutput := make(map[string]bool)
+	for _, o := range outputs {
+		hasOutput[o.Name] = true
+	}
+
+	kv := &kvLayout{}
+	for _, in := range inputs {
+		if in.Name == "use_cache_branch" {
+			return nil, fmt.Errorf("merged exports with use_cache_branch are not supported; export a decoder with past instead")
+		}
+		if !strings.HasPrefix(in.Name, "past_key_values") {
+			continue
+		}
+		present := strings.Replace(in.Name, "past_key_values", "present", 1)
+		if !hasOutput[present] {
+			return nil, fmt.Errorf("input %q has no matching %q output", in.Name, present)
+		}
+		if in.DataType != ort.TensorElementDataTypeFloat {
+			return nil, fmt.Errorf("input %q is %s, but only float is supported", in.Name, in.DataType)
+		}
+		d := in.Dimensions
+		if len(d) != 4 || d[1] <= 0 || d[3] <= 0 {
+			return nil, fmt.Errorf("input %q has shape %s, want [batch, heads, past, head_dim] with fixed heads and head_dim", in.Name, d)
+		}
+		if kv.heads != 0 && (d[1] != kv.heads || d[3] != kv.headDim) {
+			return nil, fmt.Errorf("input %q has shape %s, unlike the other past_key_values inputs", in.Name, d)
+		}
+		kv.heads, kv.headDim = d[1], d[3]
+		kv.pastInputs = append(kv.pastInputs, in.Name)
+		kv.presentOutputs = append(kv.presentOutputs, present)
+	}
+
+	if len(kv.pastInputs) == 0 {
+		return nil, nil
+	}
+	if !hasAttentionMask {
+		return nil, fmt.Errorf("past_key_values inputs need an attention_mask input")
+	}
+	return kv, nil
+}
+
+// kvState is the key/value state after a prefix, as fed back through the
+// past_key_values inputs.
+type kvState struct {
+	length     int64       // Past positions, including the masked dummy one
+	values     [][]float32 // One per kvLayout.pastInputs
+	lastLogits []float32   // Logits at the prefix's last position
+}
+
+// pastTensors returns the past_key_values inputs for a run: state's values,
+// or with a nil state a single zeroed position per row of batch. The caller
+// must destroy them.
+func (kv *kvLayout) pastTensors(batch int, state *kvState) ([]ort.Value, error) {
+	length := int64(1)
+	if state != nil {
+		length = state.length
+	}
+	shape := ort.NewShape(int64(batch), kv.heads, length, kv.headDim)
+
+	var zeros []float32
+	if state == nil {
+		zeros = make([]float32, shape.FlattenedSize())
+	}
+	values := make([]ort.Value, 0, len(kv.pastInputs))
+	for i := range kv.pastInputs {
+		data := zeros
+		if state != nil {
+			data = state.values[i]
+		}
+		t, err := newFloat32Tensor(shape, data)
+		if err != nil {
+			destroyValues(values)
+			return nil, fmt.Errorf("failed to create past tensor: %w", err)
+		}
+		values = append(values, t)
+	}
+	return values, nil
+}
+
+// destroyValues destroys every non-nil value.
+func destroyValues(values []ort.Value) {
+	for _, v := range values {
+		if v != nil {
+			v.Destroy()
+		}
+	}
+}
+
+// runKV runs the single sequence ids after past (nil for no past) and
+// returns its logits, flattened as [len(ids), vocabSize], and the state after
+// it, which includes past.
+func (m *GPT2Model) runKV(ids []uint32, past *kvState) ([]float32, *kvState, error) {
+	pastLen := int64(1)
+	if past != nil {
+		pastLen = past.length
+	}
+	n := int64(len(ids))
+
+	// Positions continue from the past, not counting its dummy slot, and the
+	// mask hides only that slot
+	idsData := make([]int64, n)
+	positionData := make([]int64, n)
+	maskData := make([]int64, pastLen+n)
+	for i, id := range ids {
+		idsData[i] = int64(id)
+		positionData[i] = pastLen - 1 + int64(i)
+	}
+	for i := int64(1); i < pastLen+n; i++ {
+		maskData[i] = 1
+	}
+
+	inputShape := ort.NewShape(1, n)
+	inputTensor, err := newInt64Tensor(inputShape, idsData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create input tensor: %w", err)
+	}
+	defer inputTensor.Destroy()
+	positionTensor, err := newInt64Tensor(inputShape, positionData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create position tensor: %w", err)
+	}
+	defer positionTensor.Destroy()
+	maskTensor, err := newInt64Tensor(ort.NewShape(1, pastLen+n), maskData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create attention mask tensor: %w", err)
+	}
+	defer maskTensor.Destroy()
+	pastValues, err := m.kv.pastTensors(1, past)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer destroyValues(pastValues)
+
+	outputTensor, err := m.newLogitsTensor(ort.NewShape(1, n, int64(m.vocabSize)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create output tensor: %w", err)
+	}
+	defer outputTensor.Destroy()
+
+	// The present outputs are left for ONNX Runtime to allocate
+	inputs := append([]ort.Value{inputTensor, positionTensor, maskTensor}, pastValues...)
+	outputs := append([]ort.Value{outputTensor.value}, make([]ort.Value, len(m.kv.presentOutputs))...)
+	defer func() { destroyValues(outputs[1:]) }()
+
+	m.mu.Lock()
+	err = m.session.Run(inputs, outputs)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, nil, fmt.Errorf("inference failed: %w", err)
+	}
+	recordInference(m)
+
+	state := &kvState{values: make([][]float32, len(m.kv.presentOutputs))}
+	for i, v := range outputs[1:] {
+		t, ok := v.(*ort.Tensor[float32])
+		if !ok {
+			return nil, nil, fmt.Errorf("output %q is not a float tensor", m.kv.presentOutputs[i])
+		}
+		// GetData is a Go copy, so it outlives the tensor
+		state.values[i] = t.GetData()
+		state.length = t.GetShape()[2]
+	}
+	return outputTensor.data(), state, nil
+}
+
+// prefixCache keeps the KV state of recently used prefixes, evicting the
+// least recently used beyond size entries.
+type prefixCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*kvState
+	order   []string // Least recently used first
+}
+
+func (c *prefixCache) get(key string) *kvState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.entries[key]
+	if ok {
+		c.touch(key)
+	}
+	return s
+}
+
+func (c *prefixCache) put(key string, s *kvState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 {
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*kvState)
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.entries[key] = s
+	c.touch(key)
+}
+
+// touch moves key to the most recently used end of c.order.
+func (c *prefixCache) touch(key string) {
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, key)
+}
+
+// idsKey encodes ids as a map key.
+func idsKey(ids []uint32) string {
+	b := make([]byte, 4*len(ids))
+	for i, id := range ids {
+		binary.LittleEndian.PutUint32(b[4*i:], id)
+	}
+	return string(b)
+}
+
+// prefixPPL returns the perplexity of ids conditioned on prefix, which is
+// context only and not scored. Both must be non-empty and fit in one window
+// together. With a KV-cache model the prefix's state is cached, so texts
+// sharing a prefix pay only for their own tokens, and cached reports whether
+// it was reused; other models run prefix and text together every time.
+func (m *GPT2Model) prefixPPL(prefix, ids []uint32, opts scoreOptions) (ppl float64, cached bool, err error) {
+	if len(prefix) == 0 || len(ids) == 0 {
+		return 0, false, errNoTokens
+	}
+
+	var nll float64
+	if m.kv == nil {
+		seq := append(append(make([]uint32, 0, len(prefix)+len(ids)), prefix...), ids...)
+		logits, err := m.runBatch([][]uint32{seq})
+		if err != nil {
+			return 0, false, err
+		}
+		nll = m.calculateNLL(logits, ids, m.vocabSize, len(prefix)-1, len(ids), opts)
+	} else {
+		key := idsKey(prefix)
+		state := m.prefixes.get(key)
+		cached = state != nil
+		if state == nil {
+			logits, s, err := m.runKV(prefix, nil)
+			if err != nil {
+				return 0, false, err
+			}
+			s.lastLogits = logits[(len(prefix)-1)*m.vocabSize:]
+			m.prefixes.put(key, s)
+			state = s
+		}
+
+		// The prefix's last logits predict the first token; the text's own
+		// logits predict the rest, so its last token needn't be run
+		nll = m.calculateNLL(state.lastLogits, ids[:1], m.vocabSize, 0, 1, opts)
+		if len(ids) > 1 {
+			logits, _, err := m.runKV(ids[:len(ids)-1], state)
+			if err != nil {
+				return 0, false, err
+			}
+			nll += m.calculateNLL(logits, ids[1:], m.vocabSize, 0, len(ids)-1, opts)
+		}
+	}
+	return math.Exp(nll / float64(len(ids))), cached, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestPrefixCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := &prefixCache{size: 2}
+	a, b, d := &kvState{length: 1}, &kvState{length: 2}, &kvState{length: 3}
+	c.put("a", a)
+	c.put("b", b)
+	if c.get("a") != a { // a is now the most recently used
+		t.Fatal("a missing")
+	}
+	c.put("d", d)
+	if want := []string{"a", "d"}; !reflect.DeepEqual(c.order, want) {
+		t.Errorf("order = %v, want %v", c.order, want)
+	}
+	if c.get("b") != nil {
+		t.Error("b kept, want it evicted as least recently used")
+	}
+	if c.get("a") != a || c.get("d") != d {
+		t.Error("a or d evicted")
+	}
+
+	// Replacing an entry refreshes it without evicting anything
+	d2 := &kvState{length: 4}
+	c.put("d", d2)
+	if len(c.entries) != 2 || c.get("d") != d2 || c.get("a") != a {
+		t.Errorf("entries = %v after replacing d", c.entries)
+	}
+
+	disabled := &prefixCache{}
+	disabled.put("a", a)
+	if disabled.get("a") != nil {
+		t.Error("a cache of size 0 kept an entry")
+	}
+}
+
+// Without a KV cache, prefix and text run together, and only the text's
+// tokens are scored: the first predicted from the prefix's last token.
+func TestPrefixPPL(t *testing.T) {
+	m, runner := newTestModel(t, 64, 64)
+	prefix := []uint32{4, 1, 5}
+	ids := []uint32{6, 0, 3, 4}
+
+	ppl, cached, err := m.prefixPPL(prefix, ids, defaultScoreOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := wantPPL(append([]uint32{prefix[len(prefix)-1]}, ids...))
+	if math.Abs(ppl-want) > 1e-9 || cached {
+		t.Errorf("prefixPPL = %v (cached %v), want %v", ppl, cached, want)
+	}
+	if len(runner.runs) != 1 || runner.runs[0] != [2]int64{1, 7} {
+		t.Errorf("runs = %v, want one of prefix and text together", runner.runs)
+	}
+
+	// Scored as the tail of prefix+text, it's the same sum of NLLs
+	full, err := m.getPPLIDs(context.Background(), append(append([]uint32(nil), prefix...), ids...), defaultScoreOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefixNLL := math.Log(wantPPL(prefix)) * float64(len(prefix)-1)
+	tailNLL := math.Log(full.Perplexity)*float64(full.ScoredTokens) - prefixNLL
+	if math.Abs(math.Log(ppl)-tailNLL/float64(len(ids))) > 1e-9 {
+		t.Errorf("prefixPPL = %v, want the text's share of the full perplexity, %v", ppl, math.Exp(tailNLL/float64(len(ids))))
+	}
+
+	for _, tc := range [][2][]uint32{{nil, ids}, {prefix, nil}} {
+		if _, _, err := m.prefixPPL(tc[0], tc[1], defaultScoreOptions); !errors.Is(err, errNoTokens) {
+			t.Errorf("prefixPPL(%v, %v): err = %v, want errNoTokens", tc[0], tc[1], err)
+		}
+	}
+}
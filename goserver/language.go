@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// minLanguageEvidence is how many stopwords a Latin-script text needs before
+// its language is reported; below that the guess is too weak to act on.
+const minLanguageEvidence = 3
+
+// scriptLanguages names the most likely language for text written mostly in
+// a non-Latin script.
+var scriptLanguages = []struct {
+	table *unicode.RangeTable
+	lang  string
+}{
+	{unicode.Cyrillic, "ru"},
+	{unicode.Greek, "el"},
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Hangul, "ko"},
+	{unicode.Han, "zh"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Devanagari, "hi"},
+	{unicode.Thai, "th"},
+}
+
+// stopwords are frequent function words that tell Latin-script languages
+// apart. Words shared by several languages count for each of them.
+var stopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "in", "that", "it", "was", "for", "with", "this", "are", "be", "have", "not", "you", "which", "they", "from"},
+	"es": {"el", "la", "los", "las", "de", "que", "y", "en", "es", "por", "para", "con", "una", "del", "se", "no", "como", "pero", "más", "su"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "zu", "den", "mit", "von", "sich", "auf", "für", "dem", "auch", "es", "ich", "wir"},
+	"fr": {"le", "la", "les", "et", "des", "est", "une", "un", "du", "que", "qui", "dans", "pour", "pas", "sur", "au", "avec", "ce", "il", "nous"},
+	"it": {"il", "la", "di", "che", "e", "non", "per", "una", "della", "sono", "gli", "con", "del", "si", "anche", "come", "ma", "questo", "nel", "le"},
+	"pt": {"o", "a", "os", "as", "de", "que", "e", "não", "uma", "um", "para", "com", "do", "da", "em", "por", "mais", "se", "como", "são"},
+	"nl": {"de", "het", "een", "en", "van", "is", "dat", "niet", "op", "te", "zijn", "met", "voor", "die", "ook", "maar", "er", "aan", "wij", "naar"},
+}
+
+var stopwordLangs = func() map[string][]string {
+	idx := make(map[string][]string)
+	for lang, words := range stopwords {
+		for _, w := range words {
+			idx[w] = append(idx[w], lang)
+		}
+	}
+	return idx
+}()
+
+// detectLanguage guesses the language of text, returning a lowercase ISO
+// 639-1 code, or "" when there isn't enough evidence. Text mostly in a
+// non-Latin script is named by its script; Latin text by which language's
+// stopwords it uses most.
+func detectLanguage(text string) string {
+	letters, latin := 0, 0
+	scripts := make(map[string]int)
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.Is(unicode.Latin, r) {
+			latin++
+			continue
+		}
+		for _, s := range scriptLanguages {
+			if unicode.Is(s.table, r) {
+				scripts[s.lang]++
+				break
+			}
+		}
+	}
+	if letters == 0 {
+		return ""
+	}
+
+	if latin*2 < letters {
+		// Japanese mixes kanji with kana; any kana at all settles it
+		if scripts["ja"] > 0 {
+			return "ja"
+		}
+		best, bestCount := "", 0
+		for lang, n := range scripts {
+			if n > bestCount || (n == bestCount && lang < best) {
+				best, bestCount = lang, n
+			}
+		}
+		return best
+	}
+
+	counts := make(map[string]int)
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		for _, lang := range stopwordLangs[w] {
+			counts[lang]++
+		}
+	}
+	best, bestCount := "", 0
+	for lang, n := range counts {
+		if n > bestCount || (n == bestCount && lang < best) {
+			best, bestCount = lang, n
+		}
+	}
+	if bestCount < minLanguageEvidence {
+		return ""
+	}
+	return best
+}
+
+// checkLanguage records the detected language of text on response and warns
+// when it isn't English, since the thresholds are calibrated on English. With
+// REQUIRE_ENGLISH set it also refuses non-English text unless the request
+// sent force, and reports whether analysis should stop.
+func checkLanguage(text string, params inferParams, response *InferenceResponse) (blocked bool) {
+	lang := detectLanguage(text)
+	response.DetectedLanguage = lang
+	if lang == "" || lang == "en" {
+		return false
+	}
+
+	response.Warning = params.msgs.get(msgNotEnglish)
+	if config.RequireEnglish && !params.force {
+		response.Status = params.msgs.get(msgNotEnglishBlocked)
+		response.Message = response.Status
+		return true
+	}
+	return false
+}
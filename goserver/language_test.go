@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"isgpt-server/api"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	for _, tc := range []struct {
+		text, want string
+	}{
+		{"The cat sat on the mat and it was happy with this.", "en"},
+		{"El perro de la casa es muy grande y no come con los gatos.", "es"},
+		{"Der Hund ist nicht groß und er spielt mit den Kindern auf dem Hof.", "de"},
+		{"Собака сидит на крыльце.", "ru"},
+		{"猫がマットの上に座っています。", "ja"},
+		{"Hello there", ""}, // Too few stopwords to tell
+		{"12345 !!!", ""},
+	} {
+		if got := detectLanguage(tc.text); got != tc.want {
+			t.Errorf("detectLanguage(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+// With REQUIRE_ENGLISH, non-English text is refused before any inference
+// unless the request sends force; either way it is flagged.
+func TestInferNonEnglish(t *testing.T) {
+	saved := config.RequireEnglish
+	config.RequireEnglish = true
+	defer func() { config.RequireEnglish = saved }()
+
+	line := "el perro de la casa es muy grande y no come con los gatos que viven en la calle con su familia"
+	text := strings.Join([]string{line, line, line}, "\n")
+
+	m, runner := newTestModel(t, 64, 64)
+	response, err := m.Infer(context.Background(), text, testParams(t, text, api.InferOptions{}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked := catalogs[defaultLocale].get(msgNotEnglishBlocked)
+	if response.Status != blocked || response.Label != nil || response.DetectedLanguage != "es" {
+		t.Errorf("without force: status %q, label %v, language %q; want refused as es", response.Status, response.Label, response.DetectedLanguage)
+	}
+	if len(runner.runs) != 0 {
+		t.Errorf("without force: %d runs, want none", len(runner.runs))
+	}
+
+	response, err = m.Infer(context.Background(), text, testParams(t, text, api.InferOptions{Force: true}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status == blocked || response.Label == nil {
+		t.Errorf("with force: status %q, label %v; want a verdict", response.Status, response.Label)
+	}
+	if response.Warning != catalogs[defaultLocale].get(msgNotEnglish) || response.DetectedLanguage != "es" {
+		t.Errorf("with force: warning %q, language %q; want the not-English warning and es", response.Warning, response.DetectedLanguage)
+	}
+}
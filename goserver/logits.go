@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errTooManyLogitsTokens rejects a return_logits request for a text longer
+// than MAX_LOGITS_TOKENS. It is the client's error, not the server's.
+var errTooManyLogitsTokens = errors.New("return_logits: text is too long")
+
+// checkLogitsLength returns errTooManyLogitsTokens, with the counts, if n
+// tokens are too many to return logits for.
+func checkLogitsLength(n int) error {
+	if n > config.MaxLogitsTokens {
+		return fmt.Errorf("%w: %d tokens, the limit is %d", errTooManyLogitsTokens, n, config.MaxLogitsTokens)
+	}
+	return nil
+}
+
+// rawLogits runs ids through the model in one window and returns the
+// unscaled logits at each position, one row of vocabSize values per token.
+// Row i is the model's prediction for token i+1.
+func (m *GPT2Model) rawLogits(ids []uint32) ([][]float32, error) {
+	logits, err := m.runBatch([][]uint32{ids})
+	if err != nil {
+		return nil, err
+	}
+	rows := make([][]float32, len(ids))
+	for i := range rows {
+		rows[i] = logits[i*m.vocabSize : (i+1)*m.vocabSize]
+	}
+	return rows, nil
+}
@@ -1,240 +1,600 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"math"
 	"net/http"
 	"os"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/daulet/tokenizers"
 	ort "github.com/yalue/onnxruntime_go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"isgpt-server/api"
+)
+
+// Runner runs the model graph on a set of input tensors, filling outputs.
+// *ort.DynamicAdvancedSession is the real implementation; the interface lets
+// the scoring code run against a fake that returns canned logits.
+type Runner interface {
+	Run(inputs, outputs []ort.Value) error
+	Destroy() error
+}
+
+// Tokenizer encodes text into the model's token ids. *tokenizers.Tokenizer
+// is the real implementation; like Runner, the interface lets tests score
+// text without the native tokenizer library.
+type Tokenizer interface {
+	Encode(str string, addSpecialTokens bool) ([]uint32, []string)
+	EncodeWithOptions(str string, addSpecialTokens bool, opts ...tokenizers.EncodeOption) tokenizers.Encoding
+	Decode(ids []uint32, skipSpecialTokens bool) string
+	VocabSize() uint32
+	Close() error
+}
+
+// The tensors of a forward pass are created through these, each wrapping a
+// Go slice the caller owns. They are variables so tests can swap in fakes
+// that work with a fake Runner, without ONNX Runtime.
+var (
+	newInt64Tensor = func(shape ort.Shape, data []int64) (ort.Value, error) {
+		return ort.NewTensor(shape, data)
+	}
+	newFloat32Tensor = func(shape ort.Shape, data []float32) (ort.Value, error) {
+		return ort.NewTensor(shape, data)
+	}
+	newCustomTensor = func(shape ort.Shape, data []byte, dataType ort.TensorElementDataType) (ort.Value, error) {
+		return ort.NewCustomDataTensor(shape, data, dataType)
+	}
 )
 
 type GPT2Model struct {
-	session   *ort.DynamicAdvancedSession
-	tokenizer *tokenizers.Tokenizer
-	maxLength int
-	stride    int
-	mu        sync.Mutex
+	session          Runner
+	tokenizer        Tokenizer
+	maxLength        int
+	stride           int
+	batchSize        int
+	vocabSize        int
+	hasAttentionMask bool                      // Model graph takes an attention_mask input
+	kv               *kvLayout                 // Non-nil for exports with past_key_values inputs
+	logitsType       ort.TensorElementDataType // float32, or float16 for half-precision exports
+	logitsName       string                    // Name of the logits output
+	prefixes         prefixCache               // KV state of recent prefixes, when kv is set
+	eosID            int                       // Token that resets the context; -1 if EOS handling is off
+	mu               sync.Mutex
+	buffers          int64Pool // Input tensor buffers, reused across runs
+	closeOnce        sync.Once
+
+	modelPath     string // As configured; may be a URL
+	modelFile     string // Local copy of modelPath
+	modelHash     string // SHA-256 of the model file
+	quantized     bool   // Graph contains quantized (e.g. int8) operators
+	tokenizerPath string
+	tokenizerHash string // SHA-256 of the tokenizer file
+
+	// tokenizerTruncation is set if the tokenizer cuts every encoding at
+	// maxLength tokens; see tokenizerCut
+	tokenizerTruncation bool
 }
 
 const minTokensPerChunk = 20 // Minimum tokens for reliable perplexity estimation
 
-type InferenceRequest struct {
-	Sentence string `json:"sentence"`
-	Detailed bool   `json:"detailed"`
-	Verbose  bool   `json:"verbose"`
+const eosToken = "<|endoftext|>" // GPT2's document separator
+
+const gpt2VocabSize = 50257
+
+// Request and response types are shared with the Go client via package api.
+type (
+	InferenceRequest   = api.InferenceRequest
+	SentenceDetail     = api.SentenceDetail
+	InferenceResponse  = api.InferenceResponse
+	PerplexityRequest  = api.PerplexityRequest
+	PerplexityResponse = api.PerplexityResponse
+	Histogram          = api.Histogram
+	ConfidenceInterval = api.ConfidenceInterval
+	ClassProbabilities = api.ClassProbabilities
+	RollingOptions     = api.RollingOptions
+	RollingPoint       = api.RollingPoint
+	WindowInfo         = api.WindowInfo
+	CharRange          = api.CharRange
+	RangeResult        = api.RangeResult
+	TokenPrediction    = api.TokenPrediction
+	TokenAlternative   = api.TokenAlternative
+	Job                = api.Job
+	Borderline         = api.Borderline
+	BorderlineLabel    = api.BorderlineLabel
+)
+
+// errNoTokens is returned by getPPL for text with no token to score: it
+// encodes to no tokens at all, such as a line of emoji the tokenizer drops,
+// or to a single token, which has no context to be predicted from.
+var errNoTokens = errors.New("text has no tokens to score")
+
+// errPositionOffset is returned by getPPL when a text doesn't fit in one
+// window after its position offset. It is the client's error.
+var errPositionOffset = errors.New("position_offset plus the text's tokens exceeds max_length")
+
+// errTooManyTokens is returned by getPPL for text that encodes to more than
+// MAX_TOKENS tokens, before any of it is run. It is the client's error.
+var errTooManyTokens = errors.New("text is too long")
+
+// pplResult is the outcome of scoring one text with getPPL.
+type pplResult struct {
+	Perplexity float64
+	Tokens     int  // Tokens the text encoded to
+	Truncated  bool // Not every window was scored: the deadline passed, or truncate applied
+	EOSFound   bool // The text had EOS markers, which reset the context
+	Sampled    bool // Only some windows were scored; see scoreOptions.sampleRate
+	Windows    int  // Forward passes run, across all segments
+
+	// NLL is the summed negative log-likelihood, in nats, of the
+	// ScoredTokens tokens that were predicted; Perplexity is
+	// exp(NLL/ScoredTokens).
+	NLL          float64
+	ScoredTokens int
+
+	// WindowInfo describes each window scored
+	WindowInfo []WindowInfo
+}
+
+// scoreOptions tune how getPPL turns logits into token probabilities.
+type scoreOptions struct {
+	temperature float64   // Logits are divided by this before softmax
+	deadline    time.Time // Stop adding windows after this; zero means never
+	sampleRate  float64   // Fraction of sliding windows scored; 1 scores them all
+	stride      int       // Tokens each window advances by; 0 uses the model's
+	truncate    bool      // Score only the first window of a longer text
+
+	// positionOffset starts position_ids here rather than at 0, for text
+	// that continues a prompt of that many tokens. The text must then fit
+	// in one window after it.
+	positionOffset int
+
+	// stats, if set, collects per-token statistics, and tokenNLLs the NLL
+	// of each token for contextual per-line scores; see withoutStats
+	stats     *tokenStats
+	tokenNLLs *tokenNLLs
+
+	// progress, if set, counts the windows scored, for job progress
+	progress *progress
+}
+
+// withoutStats returns o without its per-token collectors, for passes whose
+// tokens shouldn't be reported (per-line chunks, perturbed copies, rolling
+// windows).
+func (o scoreOptions) withoutStats() scoreOptions {
+	o.stats = nil
+	o.tokenNLLs = nil
+	return o
+}
+
+// sampleWindow reports whether the k'th sliding window of a segment should
+// be scored. Windows are picked at evenly spread positions, always including
+// the first, so results are reproducible.
+func (o scoreOptions) sampleWindow(k int) bool {
+	if o.sampleRate >= 1 || k == 0 {
+		return true
+	}
+	return math.Floor(float64(k+1)*o.sampleRate) > math.Floor(float64(k)*o.sampleRate)
+}
+
+// strideFor returns the window stride opts ask for, defaulting to the
+// model's configured STRIDE.
+func (m *GPT2Model) strideFor(opts scoreOptions) int {
+	if opts.stride > 0 {
+		return opts.stride
+	}
+	return m.stride
+}
+
+// pastDeadline reports whether the scoring budget has run out.
+func (o scoreOptions) pastDeadline() bool {
+	return !o.deadline.IsZero() && time.Now().After(o.deadline)
+}
+
+// defaultScoreOptions score text exactly as the model predicts it.
+var defaultScoreOptions = scoreOptions{temperature: 1, sampleRate: 1}
+
+var (
+	config Config
+
+	// model is set in the background once NewGPT2Model succeeds, and
+	// modelReady once its warmup inference has. Handlers take the model
+	// through acquireModel, never directly.
+	model      atomic.Pointer[GPT2Model]
+	modelReady atomic.Bool
+)
+
+// acquireModel returns the model if it is ready to serve, or answers r with
+// 503 model_unavailable and returns nil. Handlers keep the returned pointer
+// for the whole request.
+func acquireModel(w http.ResponseWriter, r *http.Request) *GPT2Model {
+	m := model.Load()
+	if m == nil || !modelReady.Load() {
+		writeJSONError(w, r, http.StatusServiceUnavailable, "model_unavailable")
+		return nil
+	}
+	return m
 }
 
-type SentenceDetail struct {
-	Text           string  `json:"text"`
-	Perplexity     float64 `json:"perplexity,omitempty"`
-	Label          int     `json:"label"`
-	Classification string  `json:"classification"`
-	Confidence     float64 `json:"confidence"`
+const warmupText = "The quick brown fox jumps over the lazy dog."
+
+var alphanumRe = regexp.MustCompile(`[a-zA-Z0-9]+`)
+
+// countValidChars counts the alphanumeric characters in text, which is what
+// the minimum-length gate measures.
+func countValidChars(text string) int {
+	total := 0
+	for _, match := range alphanumRe.FindAllString(text, -1) {
+		total += len(match)
+	}
+	return total
 }
 
-type InferenceResponse struct {
-	Status            string           `json:"status,omitempty"`
-	Perplexity        *float64         `json:"Perplexity,omitempty"`
-	PerplexityPerLine *float64         `json:"Perplexity_per_line,omitempty"`
-	Burstiness        *float64         `json:"Burstiness,omitempty"`
-	Label             *int             `json:"label,omitempty"`
-	Message           string           `json:"message,omitempty"`
-	Sentences         []SentenceDetail `json:"sentences,omitempty"`
-	MarkedText        string           `json:"marked_text,omitempty"`
+// checkLength refuses text with fewer than params.minChars alphanumeric
+// characters, reporting whether analysis should stop. With allow_short such
+// text is analyzed anyway and marked low confidence. Text with none at all is
+// always refused, even with min_chars 0.
+func checkLength(text string, params inferParams, response *InferenceResponse) (blocked bool) {
+	n := countValidChars(text)
+	if n == 0 && params.minChars == 0 {
+		response.Status = params.msgs.get(msgNoSentences)
+		response.Message = response.Status
+		return true
+	}
+	if n >= params.minChars {
+		return false
+	}
+	if params.allowShort && n > 0 {
+		response.LowConfidenceShort = true
+		return false
+	}
+	response.Status = params.msgs.tooShort(params.minChars)
+	response.Message = response.Status
+	return true
 }
 
-var model *GPT2Model
+func NewGPT2Model(cfg ModelConfig) (*GPT2Model, error) {
+	if cfg.MaxLength <= 0 || cfg.Stride <= 0 {
+		return nil, fmt.Errorf("max_length (%d) and stride (%d) must be positive", cfg.MaxLength, cfg.Stride)
+	}
+	if cfg.Stride > cfg.MaxLength {
+		return nil, fmt.Errorf("stride (%d) must not exceed max_length (%d)", cfg.Stride, cfg.MaxLength)
+	}
+	if cfg.BatchSize <= 0 {
+		return nil, fmt.Errorf("batch size (%d) must be positive", cfg.BatchSize)
+	}
 
-func NewGPT2Model(modelPath, tokenizerPath string) (*GPT2Model, error) {
-	// Initialize ONNX Runtime
-	ort.SetSharedLibraryPath("/usr/lib/libonnxruntime.so")
-	err := ort.InitializeEnvironment()
+	// Download remote files first; everything below works on local paths
+	modelFile, err := localFile(cfg.ModelPath, cfg.ModelSHA256, cfg.CacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch model: %w", err)
+	}
+	tokenizerFile, err := localFile(cfg.TokenizerPath, cfg.TokenizerSHA256, cfg.CacheDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize ONNX runtime: %w", err)
+		return nil, fmt.Errorf("failed to fetch tokenizer: %w", err)
 	}
 
-	// Load ONNX model
-	inputNames := []string{"input_ids", "position_ids"}
-	outputNames := []string{"logits"}
+	// Hash the files so /info can identify exactly what is being served, and
+	// check them against any configured checksum before loading either
+	modelHash, quantized, err := inspectModelFile(modelFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash model file: %w", err)
+	}
+	tokenizerHash, err := fileSHA256(tokenizerFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash tokenizer file: %w", err)
+	}
+	if cfg.ModelSHA256 != "" && !strings.EqualFold(modelHash, cfg.ModelSHA256) {
+		return nil, fmt.Errorf("model checksum mismatch: got %s, want %s", modelHash, cfg.ModelSHA256)
+	}
+	if cfg.TokenizerSHA256 != "" && !strings.EqualFold(tokenizerHash, cfg.TokenizerSHA256) {
+		return nil, fmt.Errorf("tokenizer checksum mismatch: got %s, want %s", tokenizerHash, cfg.TokenizerSHA256)
+	}
 
-	session, err := ort.NewDynamicAdvancedSession(modelPath, inputNames, outputNames, nil)
+	// Initialize ONNX Runtime, shared with any other loaded model
+	if err := acquireORT(); err != nil {
+		return nil, err
+	}
+	loaded := false
+	defer func() {
+		if !loaded {
+			releaseORT()
+		}
+	}()
+
+	// Load ONNX model, feeding attention_mask only if the graph declares it
+	modelInputs, modelOutputs, err := ort.GetInputOutputInfo(modelFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect ONNX model inputs: %w", err)
+	}
+	names, err := resolveIONames(cfg, modelInputs, modelOutputs)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported model: %w", err)
+	}
+	inputNames := []string{names.inputIDs, names.positionIDs}
+	outputNames := []string{names.logits}
+
+	logitsType, err := checkModelIO(names, modelInputs, modelOutputs)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported model: %w", err)
+	}
+	hasAttentionMask := false
+	for _, input := range modelInputs {
+		if input.Name == "attention_mask" {
+			hasAttentionMask = true
+			inputNames = append(inputNames, input.Name)
+		}
+	}
+
+	// Exports with a KV cache also take the past state and return the new one
+	kv, err := detectKV(modelInputs, modelOutputs, hasAttentionMask)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported model: %w", err)
+	}
+	if kv != nil {
+		inputNames = append(inputNames, kv.pastInputs...)
+		outputNames = append(outputNames, kv.presentOutputs...)
+	}
+
+	session, err := ort.NewDynamicAdvancedSession(modelFile, inputNames, outputNames, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create ONNX session: %w", err)
 	}
+	defer func() {
+		if !loaded {
+			session.Destroy()
+		}
+	}()
 
 	// Load tokenizer
-	tk, err := tokenizers.FromFile(tokenizerPath)
+	tk, err := loadTokenizer(tokenizerFile, cfg.TokenizerTruncation, cfg.MaxLength)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load tokenizer: %w", err)
 	}
+	defer func() {
+		if !loaded {
+			tk.Close()
+		}
+	}()
+	if err := checkTokenizer(tk, tokenizerFile, gpt2VocabSize, cfg.TokenizerCheckTokens); err != nil {
+		return nil, fmt.Errorf("tokenizer check failed: %w", err)
+	}
+
+	// EOS markers in the text only reach the token stream if the tokenizer
+	// knows the marker as a single special token
+	eosID := -1
+	if cfg.EOSReset {
+		if ids, _ := tk.Encode(eosToken, false); len(ids) == 1 {
+			eosID = int(ids[0])
+		} else {
+			slog.Warn("tokenizer has no single EOS token, EOS handling disabled", "token", eosToken)
+		}
+	}
 
+	loaded = true
 	return &GPT2Model{
-		session:   session,
-		tokenizer: tk,
-		maxLength: 1024, // GPT2's n_positions
-		stride:    512,
+		session:          session,
+		tokenizer:        tk,
+		maxLength:        cfg.MaxLength,
+		stride:           cfg.Stride,
+		batchSize:        cfg.BatchSize,
+		vocabSize:        gpt2VocabSize,
+		hasAttentionMask: hasAttentionMask,
+		kv:               kv,
+		logitsType:       logitsType,
+		logitsName:       names.logits,
+		prefixes:         prefixCache{size: cfg.KVCacheSize},
+		eosID:            eosID,
+		modelPath:        cfg.ModelPath,
+		modelFile:        modelFile,
+		modelHash:        modelHash,
+		quantized:        quantized,
+		tokenizerPath:    cfg.TokenizerPath,
+		tokenizerHash:    tokenizerHash,
+
+		tokenizerTruncation: cfg.TokenizerTruncation,
 	}, nil
 }
 
+// Close frees the model's session and tokenizer and releases its hold on the
+// ONNX Runtime environment. Only the first call has any effect.
 func (m *GPT2Model) Close() {
-	if m.tokenizer != nil {
-		m.tokenizer.Close()
-	}
-	if m.session != nil {
-		m.session.Destroy()
-	}
-	ort.DestroyEnvironment()
+	m.closeOnce.Do(func() {
+		if m.tokenizer != nil {
+			m.tokenizer.Close()
+		}
+		if m.session != nil {
+			m.session.Destroy()
+		}
+		releaseORT()
+	})
 }
 
-// Count tokens in a text
-func (m *GPT2Model) countTokens(text string) int {
-	ids, _ := m.tokenizer.Encode(text, false)
-	return len(ids)
+// Calculate perplexity for a given text
+func (m *GPT2Model) getPPL(ctx context.Context, text string, opts scoreOptions) (pplResult, error) {
+	// Tokenize the input, with offsets to tell if the tokenizer truncated it
+	_, tokenizeSpan := tracer.Start(ctx, "tokenize")
+	encoding := m.tokenizer.EncodeWithOptions(text, false, tokenizers.WithReturnOffsets())
+	tokenizeSpan.End()
+
+	result, err := m.getPPLIDs(ctx, encoding.IDs, opts)
+	if _, cut := m.tokenizerCut(text, encoding.Offsets); cut {
+		result.Truncated = true
+	}
+	return result, err
 }
 
-// Chunk sentences to meet minimum token threshold
-type sentenceChunk struct {
-	sentences []string
-	text      string
-}
+// getPPLIDs is getPPL for text that has already been tokenized.
+func (m *GPT2Model) getPPLIDs(ctx context.Context, ids []uint32, opts scoreOptions) (result pplResult, err error) {
+	ctx, span := tracer.Start(ctx, "getPPL")
+	defer func() { endSpan(span, err) }()
 
-func (m *GPT2Model) chunkSentences(sentences []string) []sentenceChunk {
-	var chunks []sentenceChunk
-	var currentChunk []string
-	var currentText string
-	currentTokens := 0
+	seqLen := len(ids)
+	span.SetAttributes(attribute.Int("tokens", seqLen))
 
-	for _, sentence := range sentences {
-		if sentence == "" {
-			continue
-		}
+	if seqLen == 0 {
+		return pplResult{}, errNoTokens
+	}
 
-		sentenceTokens := m.countTokens(sentence)
+	// With truncate, tokens past the first window aren't scored at all
+	if err := m.checkMaxTokens(seqLen, opts); err != nil {
+		return pplResult{}, err
+	}
+	var total windowScore
+	if opts.truncate && seqLen > m.maxLength {
+		ids = ids[:m.maxLength]
+		total.truncated = true
+	}
+	if opts.positionOffset > 0 && opts.positionOffset+len(ids) > m.maxLength {
+		return pplResult{}, fmt.Errorf("%w: %d + %d tokens > %d", errPositionOffset, opts.positionOffset, len(ids), m.maxLength)
+	}
 
-		// If adding this sentence would still be under threshold, add it to current chunk
-		if currentTokens > 0 && currentTokens+sentenceTokens < minTokensPerChunk {
-			currentChunk = append(currentChunk, sentence)
-			if currentText == "" {
-				currentText = sentence
-			} else {
-				currentText = currentText + " " + sentence
-			}
-			currentTokens += sentenceTokens
-		} else if currentTokens > 0 {
-			// Current chunk meets threshold, save it and start new chunk
-			chunks = append(chunks, sentenceChunk{
-				sentences: currentChunk,
-				text:      currentText,
-			})
-			currentChunk = []string{sentence}
-			currentText = sentence
-			currentTokens = sentenceTokens
-		} else {
-			// First sentence in chunk
-			currentChunk = []string{sentence}
-			currentText = sentence
-			currentTokens = sentenceTokens
+	// Each document between EOS markers is scored with fresh context, so
+	// one document never conditions the next
+	segments := m.splitAtEOS(ids)
+	for _, seg := range segments {
+		if len(seg.ids) < 2 {
+			continue
+		}
+		if total.windows > 0 && opts.pastDeadline() {
+			total.truncated = true
+			break
+		}
+		score, err := m.scoreSegment(ctx, seg.ids, seg.offset, opts)
+		if err != nil {
+			return pplResult{}, err
+		}
+		total.nll += score.nll
+		total.tokens += score.tokens
+		total.windows += score.windows
+		total.skipped += score.skipped
+		total.info = append(total.info, score.info...)
+		total.truncated = total.truncated || score.truncated
+		if score.truncated {
+			break
 		}
 	}
 
-	// Add final chunk if not empty
-	if len(currentChunk) > 0 {
-		chunks = append(chunks, sentenceChunk{
-			sentences: currentChunk,
-			text:      currentText,
-		})
+	// A perplexity over no tokens would be a meaningless 1, the lowest there
+	// is, so a one-token text (or documents of one token each) is refused
+	if total.tokens == 0 {
+		return pplResult{}, errNoTokens
 	}
 
-	return chunks
+	eosFound := len(segments) > 1
+	span.SetAttributes(
+		attribute.Int("windows", total.windows),
+		attribute.Bool("truncated", total.truncated),
+		attribute.Bool("eos_found", eosFound),
+		attribute.Int("windows_skipped", total.skipped),
+	)
+
+	// Average over the tokens actually scored: N-1 for a single window, fewer
+	// when non-overlapping windows leave their first token without context
+	ppl := math.Exp(total.nll / float64(total.tokens))
+	return pplResult{
+		Perplexity: ppl,
+		Tokens:     seqLen,
+		Truncated:  total.truncated,
+		EOSFound:   eosFound,
+		Sampled:    total.skipped > 0,
+		Windows:    total.windows,
+
+		NLL:          total.nll,
+		ScoredTokens: total.tokens,
+		WindowInfo:   total.info,
+	}, nil
 }
 
-// Calculate perplexity for a given text
-func (m *GPT2Model) getPPL(text string) (float64, error) {
-	// Tokenize the input - Encode returns (ids []uint32, tokens []string)
-	ids, _ := m.tokenizer.Encode(text, false)
-	seqLen := len(ids)
-
-	if seqLen == 0 {
-		return 0, fmt.Errorf("tokenization returned empty IDs")
+// checkMaxTokens refuses a text of n tokens if it is longer than MAX_TOKENS,
+// unless truncate will cut it to one window.
+func (m *GPT2Model) checkMaxTokens(n int, opts scoreOptions) error {
+	if opts.truncate && n > m.maxLength {
+		return nil
 	}
+	if config.MaxTokens > 0 && n > config.MaxTokens {
+		return fmt.Errorf("%w: %d tokens, the limit is %d", errTooManyTokens, n, config.MaxTokens)
+	}
+	return nil
+}
 
-	var nlls []float64
+// windowScore accumulates the NLL of a sliding-window pass.
+type windowScore struct {
+	nll       float64
+	tokens    int // Tokens scored
+	windows   int
+	skipped   int  // Windows left out by sampling
+	truncated bool // The deadline passed before every window was scored
+	info      []WindowInfo
+}
+
+// scoreSegment runs the sliding window over ids, which start at document
+// token offset, and returns their total NLL.
+func (m *GPT2Model) scoreSegment(ctx context.Context, ids []uint32, offset int, opts scoreOptions) (windowScore, error) {
+	var score windowScore
+	seqLen := len(ids)
 	prevEndLoc := 0
+	stride := m.strideFor(opts)
+
+	for k, beginLoc := 0, 0; beginLoc < seqLen; k, beginLoc = k+1, beginLoc+stride {
+		// Always score at least one window, then give up once over budget
+		if beginLoc > 0 && opts.pastDeadline() {
+			score.truncated = true
+			break
+		}
 
-	for beginLoc := 0; beginLoc < seqLen; beginLoc += m.stride {
 		endLoc := beginLoc + m.maxLength
 		if endLoc > seqLen {
 			endLoc = seqLen
 		}
 
-		trgLen := endLoc - prevEndLoc
-		inputIds := ids[beginLoc:endLoc]
-
-		// Convert to int64 for ONNX input
-		inputShape := ort.NewShape(1, int64(len(inputIds)))
-		tensorData := make([]int64, len(inputIds))
-		for i, id := range inputIds {
-			tensorData[i] = int64(id)
-		}
-
-		inputTensor, err := ort.NewTensor(inputShape, tensorData)
-		if err != nil {
-			return 0, fmt.Errorf("failed to create input tensor: %w", err)
-		}
-
-		// Create position_ids tensor (sequential indices)
-		positionData := make([]int64, len(inputIds))
-		for i := range positionData {
-			positionData[i] = int64(i)
-		}
-		positionTensor, err := ort.NewTensor(inputShape, positionData)
-		if err != nil {
-			inputTensor.Destroy()
-			return 0, fmt.Errorf("failed to create position tensor: %w", err)
+		// A window left out by sampling still advances prevEndLoc, so the
+		// windows that are scored keep their usual targets and context
+		if !opts.sampleWindow(k) {
+			score.skipped++
+			prevEndLoc = endLoc
+			if endLoc == seqLen {
+				break
+			}
+			continue
 		}
 
-		// Prepare output tensor
-		// GPT2 output shape: [batch_size, sequence_length, vocab_size]
-		vocabSize := 50257 // GPT2 vocab size
-		outputShape := ort.NewShape(1, int64(len(inputIds)), int64(vocabSize))
-		outputTensor, err := ort.NewEmptyTensor[float32](outputShape)
-		if err != nil {
-			inputTensor.Destroy()
-			positionTensor.Destroy()
-			return 0, fmt.Errorf("failed to create output tensor: %w", err)
-		}
+		trgLen := endLoc - prevEndLoc
+		inputIds := ids[beginLoc:endLoc]
 
-		// Run inference with both input_ids and position_ids
-		// Lock mutex only for the actual inference call
-		m.mu.Lock()
-		err = m.session.Run([]ort.Value{inputTensor, positionTensor}, []ort.Value{outputTensor})
-		m.mu.Unlock()
+		windowCtx, windowSpan := tracer.Start(ctx, "window", trace.WithAttributes(
+			attribute.Int("begin", offset+beginLoc),
+			attribute.Int("end", offset+endLoc),
+		))
+		logits, _, err := m.runBatchPadded([][]uint32{inputIds}, opts.positionOffset)
 		if err != nil {
-			inputTensor.Destroy()
-			positionTensor.Destroy()
-			outputTensor.Destroy()
-			return 0, fmt.Errorf("inference failed: %w", err)
+			endSpan(windowSpan, err)
+			return score, err
 		}
 
-		// Get logits output
-		logits := outputTensor.GetData()
-
 		// Calculate negative log likelihood
 		// Target is to predict next token: logits[i] predicts inputIds[i+1]
-		// So for a sequence of length N, we have N-1 predictions
-		// Skip the last trgLen positions for the first window (no ground truth yet)
+		// The first window scores every token after its first. Later windows
+		// score only the trgLen tokens not covered by an earlier window, each
+		// conditioned on the overlapping context before it: the logits at
+		// startIdx predict the first new token. With stride == maxLength there
+		// is no overlap, so a window's first token has no context and is skipped.
 		startIdx := 0
-		if beginLoc == 0 {
-			startIdx = 0
-		} else {
-			startIdx = len(inputIds) - trgLen
+		if beginLoc > 0 {
+			startIdx = max(len(inputIds)-trgLen-1, 0)
 		}
 
 		// Target IDs are the next tokens to predict
@@ -243,13 +603,27 @@ func (m *GPT2Model) getPPL(text string) (float64, error) {
 			targetIds[i] = inputIds[startIdx+i+1]
 		}
 
-		nll := m.calculateNLL(logits, targetIds, vocabSize, startIdx, len(targetIds))
-		nlls = append(nlls, nll)
-
-		// Explicitly destroy tensors at end of iteration
-		inputTensor.Destroy()
-		positionTensor.Destroy()
-		outputTensor.Destroy()
+		if opts.stats != nil {
+			opts.stats.base = offset + beginLoc + startIdx + 1
+		}
+		if opts.tokenNLLs != nil {
+			opts.tokenNLLs.base = offset + beginLoc + startIdx + 1
+		}
+		_, softmaxSpan := tracer.Start(windowCtx, "softmax")
+		nll := m.calculateNLL(logits, targetIds, m.vocabSize, startIdx, len(targetIds), opts)
+		softmaxSpan.End()
+		windowSpan.End()
+		score.nll += nll
+		score.tokens += len(targetIds)
+		score.windows++
+		opts.progress.advance(1)
+		score.info = append(score.info, WindowInfo{
+			StartToken:       offset + beginLoc,
+			EndToken:         offset + endLoc,
+			ScoredStart:      offset + beginLoc + startIdx + 1,
+			ContextTokens:    startIdx + 1,
+			TruncatedContext: beginLoc > 0,
+		})
 
 		prevEndLoc = endLoc
 		if endLoc == seqLen {
@@ -257,47 +631,275 @@ func (m *GPT2Model) getPPL(text string) (float64, error) {
 		}
 	}
 
-	// Calculate perplexity
-	totalNLL := 0.0
-	totalTokens := 0
-	for _, nll := range nlls {
-		totalNLL += nll
+	return score, nil
+}
+
+// contextTruncated reports whether any of windows scored tokens without the
+// full text before them.
+func contextTruncated(windows []WindowInfo) bool {
+	for _, w := range windows {
+		if w.TruncatedContext {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenSegment is a run of token ids starting at offset in the document.
+type tokenSegment struct {
+	ids    []uint32
+	offset int
+}
+
+// splitAtEOS splits ids into the documents separated by EOS tokens, dropping
+// the EOS tokens themselves. Without EOS handling, or without any EOS token,
+// it returns ids as a single segment.
+func (m *GPT2Model) splitAtEOS(ids []uint32) []tokenSegment {
+	if m.eosID < 0 {
+		return []tokenSegment{{ids: ids}}
+	}
+
+	var segments []tokenSegment
+	start := 0
+	for i, id := range ids {
+		if id == uint32(m.eosID) {
+			segments = append(segments, tokenSegment{ids: ids[start:i], offset: start})
+			start = i + 1
+		}
+	}
+	return append(segments, tokenSegment{ids: ids[start:], offset: start})
+}
+
+// containsEOS reports whether ids has an EOS token that getPPL would split
+// at.
+func (m *GPT2Model) containsEOS(ids []uint32) bool {
+	if m.eosID < 0 {
+		return false
+	}
+	for _, id := range ids {
+		if id == uint32(m.eosID) {
+			return true
+		}
+	}
+	return false
+}
+
+// getPPLBatch calculates the perplexity of each token sequence, scoring them
+// together in a single padded forward pass. Sequences that don't fit in one
+// window, or that contain an EOS marker, need the sliding-window path and are
+// scored individually with getPPLIDs. The returned slices are parallel to seqs.
+func (m *GPT2Model) getPPLBatch(ctx context.Context, seqs [][]uint32, opts scoreOptions) ([]float64, []error) {
+	ctx, span := tracer.Start(ctx, "getPPLBatch", trace.WithAttributes(attribute.Int("batch_size", len(seqs))))
+	defer span.End()
+
+	ppls := make([]float64, len(seqs))
+	errs := make([]error, len(seqs))
+
+	var batch [][]uint32
+	var batchIdx []int
+	for i, ids := range seqs {
+		switch {
+		case len(ids) < 2:
+			errs[i] = errNoTokens
+		case len(ids) > m.maxLength || m.containsEOS(ids):
+			result, err := m.getPPLIDs(ctx, ids, opts)
+			ppls[i], errs[i] = result.Perplexity, err
+		default:
+			batch = append(batch, ids)
+			batchIdx = append(batchIdx, i)
+		}
+	}
+	if len(batch) == 0 {
+		return ppls, errs
 	}
 
-	// Total tokens is sequence length minus 1 (we predict N-1 tokens for N input tokens)
-	totalTokens = seqLen - 1
-	if totalTokens <= 0 {
-		totalTokens = 1
+	logits, padLen, err := m.runBatchPadded(batch, 0)
+	if err != nil {
+		for _, i := range batchIdx {
+			errs[i] = err
+		}
+		return ppls, errs
+	}
+
+	// Only the real tokens of each row are scored; padded positions after
+	// the end of a shorter sequence are masked out by never being targets.
+	rowSize := padLen * m.vocabSize
+	for b, ids := range batch {
+		rowLogits := logits[b*rowSize : (b+1)*rowSize]
+		nll := m.calculateNLL(rowLogits, ids[1:], m.vocabSize, 0, len(ids)-1, opts)
+		ppls[batchIdx[b]] = math.Exp(nll / float64(len(ids)-1))
 	}
+	opts.progress.advance(len(batch))
 
-	ppl := math.Exp(totalNLL / float64(totalTokens))
-	return ppl, nil
+	return ppls, errs
 }
 
-func (m *GPT2Model) calculateNLL(logits []float32, targetIds []uint32, vocabSize int, startIdx int, count int) float64 {
+// runBatch runs a single forward pass over one or more equal-length token
+// sequences and returns the logits flattened as [batch, seqLen, vocabSize].
+func (m *GPT2Model) runBatch(seqs [][]uint32) ([]float32, error) {
+	logits, _, err := m.runBatchPadded(seqs, 0)
+	return logits, err
+}
+
+// runBatchPadded is runBatch for sequences of differing lengths. Shorter
+// sequences are right-padded to the longest one, whose length is returned.
+// GPT2 attention is causal, so right padding never changes the logits of real
+// tokens; when the model takes an attention_mask it is still filled in
+// (1 for real tokens, 0 for padding). Callers must ignore padded positions.
+// position_ids start at posOffset.
+func (m *GPT2Model) runBatchPadded(seqs [][]uint32, posOffset int) ([]float32, int, error) {
+	padLen := 0
+	for _, seq := range seqs {
+		if len(seq) > padLen {
+			padLen = len(seq)
+		}
+	}
+
+	// Convert to int64 for ONNX input, with sequential position_ids
+	// The buffers go back to the pool only after the tensors wrapping them
+	// are destroyed, as deferred calls run last-in first-out
+	// A KV-cache export also gets one dummy past position per row, ahead of
+	// the real tokens and hidden by the attention mask
+	pastLen := 0
+	if m.kv != nil {
+		pastLen = 1
+	}
+	inputShape := ort.NewShape(int64(len(seqs)), int64(padLen))
+	maskShape := ort.NewShape(int64(len(seqs)), int64(pastLen+padLen))
+	idsData := m.buffers.get(len(seqs) * padLen)
+	positionData := m.buffers.get(len(seqs) * padLen)
+	maskData := m.buffers.get(len(seqs) * (pastLen + padLen))
+	defer m.buffers.put(idsData)
+	defer m.buffers.put(positionData)
+	defer m.buffers.put(maskData)
+	for b, seq := range seqs {
+		row := b * padLen
+		maskRow := b*(pastLen+padLen) + pastLen
+		for i, id := range seq {
+			idsData[row+i] = int64(id)
+			positionData[row+i] = int64(posOffset + i)
+			maskData[maskRow+i] = 1
+		}
+	}
+
+	inputTensor, err := newInt64Tensor(inputShape, idsData)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create input tensor: %w", err)
+	}
+	defer inputTensor.Destroy()
+
+	positionTensor, err := newInt64Tensor(inputShape, positionData)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create position tensor: %w", err)
+	}
+	defer positionTensor.Destroy()
+
+	inputs := []ort.Value{inputTensor, positionTensor}
+	if m.hasAttentionMask {
+		maskTensor, err := newInt64Tensor(maskShape, maskData)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to create attention mask tensor: %w", err)
+		}
+		defer maskTensor.Destroy()
+		inputs = append(inputs, maskTensor)
+	}
+	if m.kv != nil {
+		past, err := m.kv.pastTensors(len(seqs), nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer destroyValues(past)
+		inputs = append(inputs, past...)
+	}
+
+	// Prepare output tensor
+	// GPT2 output shape: [batch_size, sequence_length, vocab_size]
+	outputShape := ort.NewShape(int64(len(seqs)), int64(padLen), int64(m.vocabSize))
+	outputTensor, err := m.newLogitsTensor(outputShape)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create output tensor: %w", err)
+	}
+	defer outputTensor.Destroy()
+
+	// Present outputs of a KV-cache export are allocated by ONNX Runtime and
+	// discarded
+	outputs := []ort.Value{outputTensor.value}
+	if m.kv != nil {
+		outputs = append(outputs, make([]ort.Value, len(m.kv.presentOutputs))...)
+		defer func() { destroyValues(outputs[1:]) }()
+	}
+
+	// Lock mutex only for the actual inference call
+	m.mu.Lock()
+	err = m.session.Run(inputs, outputs)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, 0, fmt.Errorf("inference failed: %w", err)
+	}
+	recordInference(m)
+
+	// The tensor's backing slice is Go memory and outlives Destroy
+	return outputTensor.data(), padLen, nil
+}
+
+// isFinite reports whether f is neither NaN nor infinite.
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+func (m *GPT2Model) calculateNLL(logits []float32, targetIds []uint32, vocabSize int, startIdx int, count int, opts scoreOptions) float64 {
 	nll := 0.0
 
+	// An optional floor caps the surprisal of any one token; by default the
+	// exact log probability is used
+	minLogProb := math.Inf(-1)
+	if config.ProbFloor > 0 {
+		minLogProb = math.Log(config.ProbFloor)
+	}
+
+	// Each position's logits are widened to float64 once, and everything
+	// after that runs in float64, so rounding doesn't build up over the
+	// vocabulary-wide sums
+	posLogits := make([]float64, vocabSize)
 	for i := 0; i < count; i++ {
 		// Get logits for position startIdx+i (predicting token at startIdx+i+1)
 		offset := (startIdx + i) * vocabSize
-		posLogits := logits[offset : offset+vocabSize]
-
-		// Apply softmax and get cross-entropy loss
-		targetId := int(targetIds[i])
-		probs := softmax(posLogits)
-		prob := float64(probs[targetId])
+		for j, v := range logits[offset : offset+vocabSize] {
+			posLogits[j] = float64(v)
+		}
 
-		// Avoid log(0)
-		if prob < 1e-10 {
-			prob = 1e-10
+		// Cross-entropy loss from the log-softmax, which stays finite even
+		// where the probability underflows
+		if opts.stats != nil {
+			opts.stats.observe(i, softmax(posLogits, opts.temperature), targetIds[i])
 		}
-		nll += -math.Log(prob)
+		logProb := logSoftmaxAt(posLogits, int(targetIds[i]), opts.temperature)
+		tokenNLL := -math.Max(logProb, minLogProb)
+		opts.tokenNLLs.record(i, tokenNLL)
+		nll += tokenNLL
 	}
 
 	return nll
 }
 
-func softmax(logits []float32) []float32 {
+// logSoftmaxAt returns the log probability of logits[target] after scaling by
+// 1/temperature, computed as a log-sum-exp.
+func logSoftmaxAt(logits []float64, target int, temperature float64) float64 {
+	maxLogit := logits[0]
+	for _, v := range logits {
+		maxLogit = math.Max(maxLogit, v)
+	}
+
+	sum := 0.0
+	for _, v := range logits {
+		sum += math.Exp((v - maxLogit) / temperature)
+	}
+	return (logits[target]-maxLogit)/temperature - math.Log(sum)
+}
+
+// softmax returns the probabilities for logits scaled by 1/temperature.
+// Temperatures above 1 flatten the distribution, below 1 sharpen it.
+func softmax(logits []float64, temperature float64) []float64 {
 	maxLogit := logits[0]
 	for _, v := range logits {
 		if v > maxLogit {
@@ -305,11 +907,11 @@ func softmax(logits []float32) []float32 {
 		}
 	}
 
-	expSum := float32(0.0)
-	result := make([]float32, len(logits))
+	expSum := 0.0
+	result := make([]float64, len(logits))
 
 	for i, v := range logits {
-		result[i] = float32(math.Exp(float64(v - maxLogit)))
+		result[i] = math.Exp((v - maxLogit) / temperature)
 		expSum += result[i]
 	}
 
@@ -320,105 +922,269 @@ func softmax(logits []float32) []float32 {
 	return result
 }
 
-func getResults(threshold float64) (string, int, float64) {
-	var label int
-	var message string
-	var confidence float64
-
+// getResults classifies a perplexity. uncertain is set for the band between
+// clearly AI and clearly Human, which keeps label 0 for compatibility but is
+// best routed to human review. AI and Human confidences are raised to at
+// least CONFIDENCE_FLOOR.
+func getResults(threshold float64, msgs catalog) (message string, label int, confidence float64, uncertain bool) {
 	if threshold < 60 {
 		label = 0
-		message = "The Text is generated by AI."
+		message = msgs.get(msgAI)
 		// Lower perplexity = higher AI confidence
 		confidence = math.Min(100.0, (60.0-threshold)/60.0*100.0)
-		if confidence < 50 {
-			confidence = 50 // Minimum 50% confidence for AI classification
-		}
+		confidence = math.Max(confidence, config.ConfidenceFloor)
 	} else if threshold < 80 {
 		label = 0
-		message = "The Text is most probably contain parts which are generated by AI."
+		message = msgs.get(msgMixed)
 		confidence = 50.0 // Uncertain range
+		uncertain = true
 	} else {
 		label = 1
-		message = "The Text is written by Human."
+		message = msgs.get(msgHuman)
 		// Higher perplexity = higher human confidence
 		confidence = math.Min(100.0, (threshold-80.0)/80.0*100.0)
-		if confidence < 50 {
-			confidence = 50 // Minimum 50% confidence for human classification
-		}
+		confidence = math.Max(confidence, config.ConfidenceFloor)
 	}
 
-	return message, label, confidence
+	return message, label, confidence, uncertain
 }
 
-func (m *GPT2Model) Infer(sentence string, detailed bool) (*InferenceResponse, error) {
-	response := &InferenceResponse{}
+// Infer runs the full analysis on sentence. When onSentence is non-nil it is
+// called with each SentenceDetail as soon as its perplexity is known, which
+// lets callers stream results before the whole document has been scored.
+func (m *GPT2Model) Infer(ctx context.Context, sentence string, params inferParams, onSentence func(SentenceDetail)) (_ *InferenceResponse, err error) {
+	ctx, span := tracer.Start(ctx, "Infer")
+	defer func() { endSpan(span, err) }()
+
+	response := &InferenceResponse{SchemaVersion: api.SchemaVersion}
 
-	// Check minimum text length
-	alphanumRe := regexp.MustCompile(`[a-zA-Z0-9]+`)
-	matches := alphanumRe.FindAllString(sentence, -1)
-	totalValidChars := 0
-	for _, match := range matches {
-		totalValidChars += len(match)
+	// Offsets are reported against the text as sent
+	chars := charOffsets{text: sentence}
+	if params.normalizeWhitespace {
+		sentence, chars.origin = cleanText(sentence)
 	}
 
-	if totalValidChars < 100 {
-		response.Status = "Please input more text (min 100 characters)"
-		response.Message = "Please input more text (min 100 characters)"
+	if checkLength(sentence, params, response) {
+		return response, nil
+	}
+	if checkLanguage(sentence, params, response) {
 		return response, nil
 	}
 
-	// Calculate overall perplexity
-	ppl, err := m.getPPL(sentence)
-	if err != nil {
-		return nil, fmt.Errorf("failed to calculate perplexity: %w", err)
+	// Tokenize once; the per-line chunks below are scored as slices of this
+	// encoding rather than tokenized again
+	_, tokenizeSpan := tracer.Start(ctx, "tokenize")
+	encoding := m.tokenizer.EncodeWithOptions(sentence, false, tokenizers.WithReturnOffsets())
+	tokenizeSpan.End()
+	sentence, tokenizerCut := m.tokenizerCut(sentence, encoding.Offsets)
+	if params.charRange != nil {
+		if err := m.inferRange(ctx, *params.charRange, encoding.IDs, encoding.Offsets, &chars, params, response); err != nil {
+			return nil, err
+		}
+		return response, nil
+	}
+	if params.returnLogits {
+		if err := checkLogitsLength(len(encoding.IDs)); err != nil {
+			return nil, err
+		}
+	}
+
+	// The document pass scores the whole encoding, keeping each token's NLL
+	// for contextual per-line scores
+	docIDs := encoding.IDs
+	if params.contextual && params.perSentence {
+		params.score.tokenNLLs = newTokenNLLs(len(docIDs))
+	}
+	if params.score.truncate && len(encoding.IDs) > m.maxLength {
+		// The document pass scores only the first window; cut the text to
+		// it too, so the analysis below covers the same part of it
+		if end := int(encoding.Offsets[m.maxLength-1][1]); end <= len(sentence) {
+			sentence = sentence[:end]
+		}
+		encoding.IDs = encoding.IDs[:m.maxLength]
+		encoding.Offsets = encoding.Offsets[:m.maxLength]
 	}
-	response.Perplexity = &ppl
 
-	// Split into sentences
-	sentenceRe := regexp.MustCompile(`(?:[.?!]\s+[\[\(]?)|(?:\n\s*)`)
-	lines := sentenceRe.Split(sentence, -1)
+	response.Repetition = repetition(encoding.IDs)
+	response.HighRepetition = response.Repetition != nil && *response.Repetition >= config.RepetitionThreshold
 
-	var validLines []string
-	for _, line := range lines {
-		if alphanumRe.MatchString(line) {
-			validLines = append(validLines, strings.TrimSpace(line))
+	// Split into sentences, then chunk them to meet minimum token threshold
+	// for reliable perplexity. This comes before any scoring, so progress
+	// can count every pass up front.
+	var chunks []sentenceChunk
+	if params.perSentence {
+		chunks = chunkSentences(segmentText(sentence, encoding.Offsets, params))
+		if params.score.tokenNLLs == nil {
+			// Each chunk costs a scoring pass unless the lines are contextual
+			chunks, response.LineInferencesCapped = capChunks(chunks, params.maxLineInferences)
+			params.score.progress.plan(m.linePasses(chunks, encoding.IDs, params.score))
 		}
 	}
+	var ppl float64
+	if params.documentPerplexity {
+		params.score.progress.plan(m.windowCount(docIDs, params.score))
+		docResult, err := m.getPPLIDs(ctx, docIDs, params.score)
+		if errors.Is(err, errNoTokens) {
+			response.Status = params.msgs.get(msgNoSentences)
+			response.Message = response.Status
+			return response, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to calculate perplexity: %w", err)
+		}
+		ppl = docResult.Perplexity
+		if isFinite(ppl) {
+			response.Perplexity = &ppl
+			response.NormalizedScore = normalizedScore(ppl)
+		} else {
+			slog.WarnContext(ctx, "non-finite document perplexity", "perplexity", ppl)
+		}
+		response.TokenCount = docResult.Tokens
+		response.Truncated = docResult.Truncated
+		response.EOSFound = docResult.EOSFound
+		response.Approximate = docResult.Sampled
+		response.WindowsProcessed = docResult.Windows
+		response.TotalNLL = &docResult.NLL
+		response.TotalTokens = docResult.ScoredTokens
+		response.ContextTruncated = contextTruncated(docResult.WindowInfo)
+		if params.windowInfo {
+			response.Windows = docResult.WindowInfo
+		}
+	} else {
+		// Only the lines are scored; they are held to MAX_TOKENS all the same
+		if err := m.checkMaxTokens(len(docIDs), params.score); err != nil {
+			return nil, fmt.Errorf("failed to calculate perplexity: %w", err)
+		}
+		response.TokenCount = len(docIDs)
+		response.Truncated = len(encoding.IDs) < len(docIDs)
+		response.EOSFound = m.containsEOS(docIDs)
+	}
+	response.Truncated = response.Truncated || tokenizerCut
+	response.Stride = m.strideFor(params.score)
+	response.MaxLength = m.maxLength
+	if params.returnLogits {
+		if response.Logits, err = m.rawLogits(encoding.IDs); err != nil {
+			return nil, fmt.Errorf("failed to compute logits: %w", err)
+		}
+	}
+	response.TopK = m.topK(params.score.stats)
+	response.MeanEntropy = params.score.stats.meanEntropy()
+	response.MeanLogRank = params.score.stats.meanLogRank()
+
+	if params.rolling != nil {
+		var truncated bool
+		opts := params.score.withoutStats()
+		opts.progress = nil // Not planned for
+		response.Rolling, truncated, err = m.rollingPerplexity(ctx, encoding.IDs, *params.rolling, opts)
+		response.Truncated = response.Truncated || truncated
+		if err != nil {
+			return nil, fmt.Errorf("failed to calculate rolling perplexity: %w", err)
+		}
+		setRollingChars(response.Rolling, encoding.Offsets, len(encoding.IDs), &chars)
+	}
+
+	if !params.perSentence {
+		if response.Perplexity == nil {
+			response.Status = params.msgs.get(msgNoSentences)
+			response.Message = response.Status
+			return response, nil
+		}
+		message, label, confidence, uncertain := getResults(ppl, params.msgs)
+		response.Label = &label
+		response.Confidence = &confidence
+		response.Message = message
+		response.IsUncertain = uncertain
+		response.Probabilities = classProbabilities(ppl)
+		response.Borderline = borderline(ppl, params.borderlineMargin)
+		if params.explain {
+			response.Explanation = explainVerdict("Document perplexity", ppl, nil)
+		}
+		return response, nil
+	}
 
-	// Chunk sentences to meet minimum token threshold for reliable perplexity
-	chunks := m.chunkSentences(validLines)
+	span.SetAttributes(attribute.Int("tokens", response.TokenCount), attribute.Int("chunks", len(chunks)))
 
 	// Calculate per-chunk perplexity
 	var perplexityPerLine []float64
+	var tokensPerLine []int
 	var sentenceDetails []SentenceDetail
 
-	for _, chunk := range chunks {
-		chunkPPL, err := m.getPPL(chunk.text)
+	var batchPPLs []float64
+	var batchErrs []error
+
+	for i, chunk := range chunks {
+		var chunkPPL float64
+		var err error
+		if params.score.tokenNLLs != nil {
+			// Contextual: the document pass already scored these tokens
+			chunkPPL, err = params.score.tokenNLLs.perplexity(chunk.start, chunk.end)
+		} else {
+			// Score chunks batchSize at a time, in order, so streaming still
+			// emits results as each batch completes
+			if i%m.batchSize == 0 {
+				if i > 0 && params.score.pastDeadline() {
+					response.Truncated = true
+					break
+				}
+				end := min(i+m.batchSize, len(chunks))
+				seqs := make([][]uint32, 0, end-i)
+				for _, c := range chunks[i:end] {
+					seqs = append(seqs, encoding.IDs[c.start:c.end])
+				}
+				batchPPLs, batchErrs = m.getPPLBatch(ctx, seqs, params.score.withoutStats())
+			}
+			chunkPPL, err = batchPPLs[i%m.batchSize], batchErrs[i%m.batchSize]
+		}
+		if errors.Is(err, errNoTokens) {
+			// Nothing to score; the chunk's span still counts toward the
+			// token offsets of the ones after it
+			continue
+		}
 		if err != nil {
-			log.Printf("Warning: failed to calculate PPL for chunk: %v", err)
+			slog.WarnContext(ctx, "failed to calculate PPL for chunk", "error", err)
+			continue
+		}
+
+		// A NaN or Inf would poison the average and max below
+		if !isFinite(chunkPPL) {
+			slog.WarnContext(ctx, "skipping chunk with non-finite perplexity",
+				"perplexity", chunkPPL, "text", chunk.text)
 			continue
 		}
 
 		perplexityPerLine = append(perplexityPerLine, chunkPPL)
+		tokensPerLine = append(tokensPerLine, chunk.end-chunk.start)
 
 		// If detailed, assign the chunk's perplexity to all sentences in the chunk
-		if detailed {
-			message, label, confidence := getResults(chunkPPL)
+		if params.detailed {
+			message, label, confidence, uncertain := getResults(chunkPPL, params.msgs)
 			for _, sentence := range chunk.sentences {
-				sentenceDetails = append(sentenceDetails, SentenceDetail{
-					Text:           sentence,
-					Perplexity:     chunkPPL,
-					Label:          label,
-					Classification: message,
-					Confidence:     confidence,
-				})
+				detail := SentenceDetail{
+					Index:           len(sentenceDetails),
+					Text:            sentence.text,
+					TokenStart:      sentence.start,
+					TokenEnd:        sentence.end,
+					CharStart:       chars.start(sentence.from),
+					CharEnd:         chars.end(sentence.to),
+					Perplexity:      chunkPPL,
+					Label:           label,
+					Classification:  message,
+					Confidence:      confidence,
+					IsUncertain:     uncertain,
+					NormalizedScore: normalizedScore(chunkPPL),
+					Borderline:      borderline(chunkPPL, params.borderlineMargin),
+				}
+				sentenceDetails = append(sentenceDetails, detail)
+				if onSentence != nil {
+					onSentence(detail)
+				}
 			}
 		}
 	}
 
 	if len(perplexityPerLine) == 0 {
-		response.Status = "No valid sentences found"
-		response.Message = "No valid sentences found"
+		response.Status = params.msgs.get(msgNoSentences)
+		response.Message = response.Status
 		return response, nil
 	}
 
@@ -433,16 +1199,56 @@ func (m *GPT2Model) Infer(sentence string, detailed bool) (*InferenceResponse, e
 	}
 	avgPPL /= float64(len(perplexityPerLine))
 
-	response.PerplexityPerLine = &avgPPL
+	weightedPPL, totalTokens := 0.0, 0
+	for i, ppl := range perplexityPerLine {
+		weightedPPL += ppl * float64(tokensPerLine[i])
+		totalTokens += tokensPerLine[i]
+	}
+	weightedPPL /= float64(totalTokens)
+
+	variance := 0.0
+	for _, ppl := range perplexityPerLine {
+		variance += (ppl - avgPPL) * (ppl - avgPPL)
+	}
+	stdPPL := math.Sqrt(variance / float64(len(perplexityPerLine)))
+	for i := range sentenceDetails {
+		z := 0.0 // Every line scored the same
+		if stdPPL > 0 {
+			z = (sentenceDetails[i].Perplexity - avgPPL) / stdPPL
+		}
+		sentenceDetails[i].ZScore = &z
+	}
+
+	response.AvgPerplexityPerLine = &avgPPL
+	response.WeightedPerplexity = &weightedPPL
 	response.Burstiness = &maxPPL
 
+	if params.histogram {
+		response.Histogram = perplexityHistogram(perplexityPerLine, params.histogramBuckets, params.histogramEdges)
+	}
+	if params.ci && response.Perplexity != nil {
+		response.CI = perplexityCI(*response.Perplexity, perplexityPerLine, params.ciLevel)
+	}
+
 	// Get final classification
-	message, label, _ := getResults(avgPPL)
+	verdictPPL, basis := avgPPL, "Average perplexity"
+	if params.weighted {
+		verdictPPL, basis = weightedPPL, "Token-weighted perplexity"
+		response.WeightedByTokens = true
+	}
+	message, label, confidence, uncertain := getResults(verdictPPL, params.msgs)
+	response.Probabilities = classProbabilities(verdictPPL)
 	response.Label = &label
+	response.Confidence = &confidence
 	response.Message = message
+	response.IsUncertain = uncertain
+	response.Borderline = borderline(verdictPPL, params.borderlineMargin)
+	if params.explain {
+		response.Explanation = explainVerdict(basis, verdictPPL, response.Burstiness)
+	}
 
 	// Add detailed results if requested
-	if detailed && len(sentenceDetails) > 0 {
+	if params.detailed && len(sentenceDetails) > 0 {
 		response.Sentences = sentenceDetails
 
 		// Create marked text
@@ -455,6 +1261,13 @@ func (m *GPT2Model) Infer(sentence string, detailed bool) (*InferenceResponse, e
 			markedParts = append(markedParts, fmt.Sprintf("<%s>%s</%s>", tag, sent.Text, tag))
 		}
 		response.MarkedText = strings.Join(markedParts, " ")
+
+		response.SentenceCount = len(sentenceDetails)
+		if params.maxSentences > 0 && len(sentenceDetails) > params.maxSentences {
+			response.Sentences = mostAnomalous(sentenceDetails, params.maxSentences)
+			response.TruncatedSentences = true
+		}
+		sortSentences(response.Sentences, params.sort)
 	}
 
 	return response, nil
@@ -463,10 +1276,15 @@ func (m *GPT2Model) Infer(sentence string, detailed bool) (*InferenceResponse, e
 func rootHandler(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"service": "isgpt API",
-		"version": "1.0",
+		"version": version,
+		"commit":  commit,
 		"endpoints": map[string]string{
-			"GET /infer":  "Inference with query parameter",
-			"POST /infer": "Inference with JSON body",
+			"GET /infer":       "Inference with query parameter",
+			"POST /infer":      "Inference with JSON body",
+			"POST /perplexity": "Raw document perplexity, no classification",
+			"POST /jobs":       "Queue an inference to run in the background",
+			"GET /jobs/{id}":   "Status and result of a queued inference",
+			"GET /stats":       "Latency and verdicts of recent inferences",
 		},
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -476,12 +1294,43 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"status":       "healthy",
-		"model_loaded": model != nil,
+		"model_loaded": model.Load() != nil,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// livezHandler reports that the process is up, regardless of model state.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "alive"})
+}
+
+// readyzHandler reports 200 only once the model is loaded and warmed up,
+// and a recent inference check has passed.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !modelReady.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":       "not ready",
+			"model_loaded": model.Load() != nil,
+		})
+		return
+	}
+	if err := inferenceError(model.Load()); err != nil {
+		slog.WarnContext(r.Context(), "model not ready", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":       "not ready",
+			"model_loaded": true,
+			"error":        err.Error(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+}
+
 func inferHandler(w http.ResponseWriter, r *http.Request) {
 	// Only accept POST
 	if r.Method != http.MethodPost {
@@ -489,80 +1338,416 @@ func inferHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	m := acquireModel(w, r)
+	if m == nil {
+		return
+	}
+
 	var req InferenceRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeRequest(w, r, &req, &req.Sentence) {
+		return
+	}
+
+	params, err := resolveParams(req, r.Header.Get("Accept-Language"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Sentences and marked text are reported against the stripped text
+	if req.StripMarkup {
+		req.Sentence = stripMarkup(req.Sentence)
+	}
+
+	if req.Method != "detectgpt" && strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		streamInfer(w, r, m, req, params)
 		return
 	}
 
-	// Always request detailed to get per-sentence analysis
-	result, err := model.Infer(req.Sentence, true)
+	start := time.Now()
+	var result *InferenceResponse
+	if req.Method == "detectgpt" {
+		result, err = m.DetectGPT(r.Context(), req.Sentence, params)
+	} else {
+		result, err = m.Infer(r.Context(), req.Sentence, params, nil)
+	}
+	logInference(r, result, err, start)
+	if errors.Is(err, errTooManyLogitsTokens) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errRange) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errTooManyTokens) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Return plain text by default, JSON if verbose
-	if req.Verbose {
+	// Borderline verdicts may get their own status, so clients can route
+	// them to review without parsing the body
+	status := http.StatusOK
+	if result.IsUncertain {
+		status = config.UncertainStatus
+		w.Header().Set(api.UncertainHeader, "true")
+	}
+
+	// Return plain text by default, JSON if Accept prefers it or verbose
+	if wantsJSON(r, req.Verbose) {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(result)
+		w.WriteHeader(status)
+		encodeJSON(w, result)
 	} else {
 		w.Header().Set("Content-Type", "text/plain")
 
-		// Format: "Sentence. <Label, confidence%>"
+		// Rendered in full first, so a template error can still become a 500
 		var output strings.Builder
-		for _, sent := range result.Sentences {
-			label := "AI"
-			if sent.Label == 1 {
-				label = "Human"
-			}
-			output.WriteString(fmt.Sprintf("%s <%s, %.0f%%>\n", sent.Text, label, sent.Confidence))
+		if err := plainTemplate.Execute(&output, result); err != nil {
+			slog.ErrorContext(r.Context(), "plain-text template failed", "error", err)
+			http.Error(w, "failed to render response", http.StatusInternalServerError)
+			return
 		}
-		output.WriteString(fmt.Sprintf("\n%s\n", result.Message))
-
+		if (req.ResultLine == nil && config.PlainResultLine) || (req.ResultLine != nil && *req.ResultLine) {
+			output.WriteString(resultLine(result))
+		}
+		w.WriteHeader(status)
 		fmt.Fprint(w, output.String())
 	}
 }
 
+// streamInfer answers an /infer request as Server-Sent Events: one "sentence"
+// event per SentenceDetail as it is scored, then a final "summary" event with
+// the document-level result (without the sentences already sent).
+func streamInfer(w http.ResponseWriter, r *http.Request, m *GPT2Model, req InferenceRequest, params inferParams) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// A stream lasts as long as the inference, so WRITE_TIMEOUT doesn't
+	// apply; the client sees progress and can hang up instead
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		slog.WarnContext(r.Context(), "failed to lift write deadline for stream", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(event string, v interface{}) {
+		data, err := marshalJSON(v)
+		if err != nil {
+			slog.WarnContext(r.Context(), "failed to encode event", "event", event, "error", err)
+			return
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+	}
+
+	start := time.Now()
+	result, err := m.Infer(r.Context(), req.Sentence, params, func(detail SentenceDetail) {
+		send("sentence", detail)
+	})
+	logInference(r, result, err, start)
+	if err != nil {
+		send("error", map[string]string{"error": err.Error()})
+		return
+	}
+
+	summary := *result
+	summary.Sentences = nil
+	summary.MarkedText = ""
+	send("summary", summary)
+}
+
+// logInference records the outcome of one Infer call, in the log and for
+// /stats.
+func logInference(r *http.Request, result *InferenceResponse, err error, start time.Time) {
+	latency := time.Since(start)
+	recentStats.record(result, err, latency)
+	if err == nil {
+		notifyInference(requestIDFromContext(r.Context()), r.Header.Get(idempotencyKeyHeader),
+			inferenceEvent{Endpoint: r.URL.Path}, result, latency)
+	}
+	attrs := []any{
+		"endpoint", r.URL.Path,
+		"latency_ms", latency.Milliseconds(),
+	}
+	switch {
+	case err != nil:
+		slog.ErrorContext(r.Context(), "inference failed", append(attrs, "error", err)...)
+	case result.Label == nil:
+		slog.InfoContext(r.Context(), "inference rejected", append(attrs, "outcome", result.Message)...)
+	default:
+		slog.InfoContext(r.Context(), "inference complete", append(attrs,
+			"tokens", result.TokenCount,
+			"label", *result.Label,
+			"outcome", result.Message,
+		)...)
+	}
+}
+
+// loadModel loads the model and runs a warmup inference, publishing progress
+// through model and modelReady. It runs in the background so liveness
+// probes are answered while the model starts.
+func loadModel(cfg ModelConfig) {
+	slog.Info("loading GPT2 model", "max_length", cfg.MaxLength, "stride", cfg.Stride)
+	m, err := NewGPT2Model(cfg)
+	if err != nil {
+		fatal("failed to load model", "error", err)
+	}
+	model.Store(m)
+	slog.Info("model loaded", "quantized", m.quantized)
+
+	if _, err := m.getPPL(context.Background(), warmupText, defaultScoreOptions); err != nil {
+		fatal("model warmup failed", "error", err)
+	}
+	modelReady.Store(true)
+	slog.Info("model warmed up and ready")
+}
+
+// perplexityHandler returns the raw document perplexity, skipping sentence
+// splitting, per-line scoring and classification.
+func perplexityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed - use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m := acquireModel(w, r)
+	if m == nil {
+		return
+	}
+
+	var req PerplexityRequest
+	if !decodeRequest(w, r, &req, &req.Sentence) {
+		return
+	}
+
+	minChars := config.MinChars
+	if req.MinChars != nil {
+		if *req.MinChars < 0 {
+			http.Error(w, "min_chars must not be negative", http.StatusBadRequest)
+			return
+		}
+		minChars = *req.MinChars
+	}
+
+	opts := defaultScoreOptions
+	if req.Temperature != nil {
+		if !isFinite(*req.Temperature) || *req.Temperature <= 0 {
+			http.Error(w, "temperature must be greater than 0", http.StatusBadRequest)
+			return
+		}
+		opts.temperature = *req.Temperature
+	}
+	if req.MaxInferenceMS < 0 {
+		http.Error(w, "max_inference_ms must not be negative", http.StatusBadRequest)
+		return
+	}
+	opts.deadline = inferenceDeadline(req.MaxInferenceMS)
+	sampleRate, err := validateSampleRate(req.SampleRate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.sampleRate = sampleRate
+	if opts.stride, err = resolveStride(req.NonOverlapping, req.StrideFraction, m.maxLength); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.truncate = req.Truncate
+	normalizeWhitespace := config.NormalizeWhitespace
+	if req.NormalizeWhitespace != nil {
+		normalizeWhitespace = *req.NormalizeWhitespace
+	}
+	if req.PositionOffset < 0 || req.PositionOffset >= m.maxLength {
+		http.Error(w, fmt.Sprintf("position_offset must be between 0 and %d", m.maxLength-1), http.StatusBadRequest)
+		return
+	}
+	if req.PositionOffset > 0 && req.Prefix != "" {
+		http.Error(w, "position_offset can't be combined with prefix, whose tokens already come first", http.StatusBadRequest)
+		return
+	}
+	opts.positionOffset = req.PositionOffset
+
+	if req.StripMarkup {
+		req.Sentence = stripMarkup(req.Sentence)
+	}
+	if normalizeWhitespace {
+		req.Sentence, _ = cleanText(req.Sentence)
+		req.Prefix, _ = cleanText(req.Prefix)
+	}
+
+	var response PerplexityResponse
+	if countValidChars(req.Sentence) < minChars {
+		response.Status = selectCatalog(req.Locale, r.Header.Get("Accept-Language")).tooShort(minChars)
+	} else if req.Prefix != "" {
+		prefix, _ := m.tokenizer.Encode(req.Prefix, false)
+		ids, _ := m.tokenizer.Encode(req.Sentence, false)
+		if len(prefix) == 0 || len(ids) == 0 || len(prefix)+len(ids) > m.maxLength {
+			http.Error(w, fmt.Sprintf("prefix and sentence must both be non-empty and together at most %d tokens", m.maxLength), http.StatusBadRequest)
+			return
+		}
+		ppl, cached, err := m.prefixPPL(prefix, ids, opts)
+		if errors.Is(err, errNoTokens) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "perplexity failed", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.Perplexity = &ppl
+		response.NormalizedScore = normalizedScore(ppl)
+		response.TokenCount = len(ids)
+		response.PrefixCached = cached
+		nll := math.Log(ppl) * float64(len(ids))
+		response.TotalNLL = &nll
+		response.TotalTokens = len(ids)
+	} else {
+		result, err := m.getPPL(r.Context(), req.Sentence, opts)
+		if errors.Is(err, errNoTokens) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errTooManyTokens) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, errPositionOffset) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "perplexity failed", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.Perplexity = &result.Perplexity
+		response.NormalizedScore = normalizedScore(result.Perplexity)
+		response.TokenCount = result.Tokens
+		response.Truncated = result.Truncated
+		response.EOSFound = result.EOSFound
+		response.Approximate = result.Sampled
+		response.WindowsProcessed = result.Windows
+		response.TotalNLL = &result.NLL
+		response.TotalTokens = result.ScoredTokens
+		response.Stride = m.strideFor(opts)
+		response.MaxLength = m.maxLength
+		response.ContextTruncated = contextTruncated(result.WindowInfo)
+		if req.WindowInfo {
+			response.Windows = result.WindowInfo
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encodeJSON(w, response)
+}
+
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "9081"
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	validate := flag.Bool("validate", false, "Check that the configured model and tokenizer load and score text, then exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Printf("isgpt-server %s (commit %s)\n", version, commit)
+		return
 	}
 
-	host := os.Getenv("HOST")
-	if host == "" {
-		host = "0.0.0.0"
+	setupLogging()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("invalid configuration", "error", err)
 	}
+	config = cfg
+	slog.Info("configuration", "config", cfg.redacted())
 
-	modelPath := os.Getenv("MODEL_PATH")
-	if modelPath == "" {
-		modelPath = "/app/models/model.onnx"
+	if *validate {
+		if err := validateModel(cfg.Model, os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		return
 	}
 
-	tokenizerPath := os.Getenv("TOKENIZER_PATH")
-	if tokenizerPath == "" {
-		tokenizerPath = "/app/models/tokenizer.json"
+	if cfg.PlainTemplate != "" {
+		if plainTemplate, err = parsePlainTemplate(cfg.PlainTemplate); err != nil {
+			fatal("invalid PLAIN_TEMPLATE", "error", err)
+		}
 	}
 
-	// Initialize model
-	log.Println("Loading GPT2 model...")
-	var err error
-	model, err = NewGPT2Model(modelPath, tokenizerPath)
+	if cfg.MessagesFile != "" {
+		if err := loadMessageFile(cfg.MessagesFile); err != nil {
+			fatal("failed to load messages", "error", err)
+		}
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
 	if err != nil {
-		log.Fatalf("Failed to load model: %v", err)
+		fatal("failed to set up tracing", "error", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	if cfg.AdminAddr != "" {
+		go serveAdmin(cfg.AdminAddr)
 	}
-	defer model.Close()
-	log.Println("Model loaded successfully!")
+
+	// Initialize model
+	go loadModel(cfg.Model)
+	defer func() {
+		if m := model.Load(); m != nil {
+			m.Close()
+		}
+	}()
+	watchBenchmarkSignal(cfg.BenchmarkRuns)
+	startJobWorkers(cfg.JobQueueSize, cfg.JobWorkers, cfg.JobTTL, cfg.JobMaxFinished)
+	startInferenceChecks()
+	startWebhook(cfg.WebhookURL, cfg.WebhookQueueSize, cfg.WebhookRetries, cfg.WebhookTimeout)
 
 	// Setup HTTP routes
-	http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/health", healthHandler)
-	http.HandleFunc("/infer", inferHandler)
-
-	addr := fmt.Sprintf("%s:%s", host, port)
-	log.Printf("Starting isgpt server on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", rootHandler)
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/livez", livezHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/info", infoHandler)
+	mux.HandleFunc("/infer", inferHandler)
+	mux.HandleFunc("/perplexity", perplexityHandler)
+	mux.HandleFunc("/jobs", jobsHandler)
+	mux.HandleFunc("/jobs/", jobHandler)
+	mux.HandleFunc("/stats", statsHandler)
+
+	var handler http.Handler = requestIDMiddleware(recoverMiddleware(tracingMiddleware(gzipMiddleware(cfg.GzipMinSize, idempotencyMiddleware(mux)))))
+	if cfg.EnableH2C {
+		// Cleartext HTTP/2, via prior knowledge or Upgrade; HTTP/1.1
+		// requests pass straight through
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+
+	if cfg.WriteTimeout > 0 && cfg.MaxInferenceMS > 0 && cfg.WriteTimeout <= time.Duration(cfg.MaxInferenceMS)*time.Millisecond {
+		slog.Warn("WRITE_TIMEOUT is not longer than MAX_INFERENCE_MS; long inferences will be cut off",
+			"write_timeout", cfg.WriteTimeout, "max_inference_ms", cfg.MaxInferenceMS)
+	}
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf("%s:%s", cfg.Host, cfg.Port),
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	slog.Info("starting isgpt server", "addr", server.Addr, "h2c", cfg.EnableH2C)
+	if err := server.ListenAndServe(); err != nil {
+		fatal("server failed", "error", err)
 	}
 }
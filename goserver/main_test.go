@@ -0,0 +1,731 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daulet/tokenizers"
+	ort "github.com/yalue/onnxruntime_go"
+
+	"isgpt-server/api"
+)
+
+// The fakes below let the scoring code run without ONNX Runtime or the
+// native tokenizer. The fake model predicts the token after id to be id+1
+// with a logit of fakePeak, and every other token with a logit of 0, so the
+// perplexity of any token sequence can be worked out by hand.
+
+const (
+	fakeVocab = 8
+	fakePeak  = 2.0
+	fakeEOS   = fakeVocab - 1
+)
+
+// fakeTensor stands in for an ONNX tensor, holding the Go slice it wraps.
+// The embedded ort.Value is nil: only Destroy is ever called.
+type fakeTensor struct {
+	ort.Value
+	shape  ort.Shape
+	ints   []int64
+	floats []float32
+}
+
+func (t *fakeTensor) Destroy() error { return nil }
+
+// fakeRunner fills the logits output with fakeLogits for every position,
+// padding included, and records the input shape of each run.
+type fakeRunner struct {
+	runs [][2]int64 // [batch, seqLen] of each Run
+	mask []int64    // attention_mask of the last Run, if it had one
+
+	nan map[uint32]bool // Tokens after which every logit is NaN
+	err error           // Returned by Run, if set, instead of any logits
+}
+
+func (r *fakeRunner) Run(inputs, outputs []ort.Value) error {
+	if r.err != nil {
+		return r.err
+	}
+	in := inputs[0].(*fakeTensor)
+	out := outputs[0].(*fakeTensor)
+	r.runs = append(r.runs, [2]int64{in.shape[0], in.shape[1]})
+	if len(inputs) > 2 {
+		r.mask = append([]int64(nil), inputs[2].(*fakeTensor).ints...)
+	}
+	for pos, id := range in.ints {
+		row := out.floats[pos*fakeVocab : (pos+1)*fakeVocab]
+		copy(row, fakeLogits(uint32(id)))
+		if r.nan[uint32(id)] {
+			for i := range row {
+				row[i] = float32(math.NaN())
+			}
+		}
+	}
+	return nil
+}
+
+func (r *fakeRunner) Destroy() error { return nil }
+
+// fakeLogits is the fake model's prediction after token id.
+func fakeLogits(id uint32) []float32 {
+	row := make([]float32, fakeVocab)
+	row[(id+1)%fakeVocab] = fakePeak
+	return row
+}
+
+// fakeNLL is the fake model's NLL of next following prev.
+func fakeNLL(prev, next uint32) float64 {
+	logSum := math.Log(math.Exp(fakePeak) + fakeVocab - 1)
+	if next == (prev+1)%fakeVocab {
+		return logSum - fakePeak
+	}
+	return logSum
+}
+
+// wantPPL is the perplexity the fake model gives ids in one context.
+func wantPPL(ids []uint32) float64 {
+	nll := 0.0
+	for i := 1; i < len(ids); i++ {
+		nll += fakeNLL(ids[i-1], ids[i])
+	}
+	return math.Exp(nll / float64(len(ids)-1))
+}
+
+// fakeTokenizer encodes each space-separated word as one token: eosToken as
+// fakeEOS, and any other word by the sum of its bytes. Like GPT2's BPE
+// dropping characters it can't encode, words without an ASCII letter or
+// digit encode to nothing.
+type fakeTokenizer struct{}
+
+func (fakeTokenizer) Encode(str string, addSpecialTokens bool) ([]uint32, []string) {
+	e := fakeTokenizer{}.EncodeWithOptions(str, addSpecialTokens)
+	return e.IDs, nil
+}
+
+func (fakeTokenizer) EncodeWithOptions(str string, _ bool, _ ...tokenizers.EncodeOption) tokenizers.Encoding {
+	var e tokenizers.Encoding
+	start := -1
+	flush := func(end int) {
+		if start < 0 {
+			return
+		}
+		word := str[start:end]
+		start = -1
+		if word == eosToken {
+			e.IDs = append(e.IDs, fakeEOS)
+		} else if countValidChars(word) > 0 {
+			sum := uint32(0)
+			for _, b := range []byte(word) {
+				sum += uint32(b)
+			}
+			e.IDs = append(e.IDs, sum%fakeEOS)
+		} else {
+			return
+		}
+		e.Offsets = append(e.Offsets, tokenizers.Offset{uint(end - len(word)), uint(end)})
+	}
+	for i, c := range str {
+		if c == ' ' || c == '\n' {
+			flush(i)
+		} else if start < 0 {
+			start = i
+		}
+	}
+	flush(len(str))
+	return e
+}
+
+func (fakeTokenizer) Decode(ids []uint32, _ bool) string {
+	words := make([]string, len(ids))
+	for i, id := range ids {
+		words[i] = fakeWord(id)
+	}
+	return strings.Join(words, " ")
+}
+
+// fakeWord is a word fakeTokenizer encodes to id, for id below fakeEOS.
+func fakeWord(id uint32) string {
+	return string(rune('a' + (id+1)%fakeEOS))
+}
+
+// fakeText is text fakeTokenizer encodes to ids, a line per slice.
+func fakeText(lines ...[]uint32) string {
+	var b strings.Builder
+	for i, ids := range lines {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(fakeTokenizer{}.Decode(ids, false))
+	}
+	return b.String()
+}
+
+func (fakeTokenizer) VocabSize() uint32 { return fakeVocab }
+
+func (fakeTokenizer) Close() error { return nil }
+
+// newTestModel returns a model backed by the fakes, and the runner so tests
+// can inspect its runs. The tensor constructors are swapped for the test's
+// duration.
+func newTestModel(t testing.TB, maxLength, stride int) (*GPT2Model, *fakeRunner) {
+	t.Helper()
+	fakeTensors(t)
+	runner := &fakeRunner{}
+	return &GPT2Model{
+		session:    runner,
+		tokenizer:  fakeTokenizer{},
+		maxLength:  maxLength,
+		stride:     stride,
+		batchSize:  4,
+		vocabSize:  fakeVocab,
+		logitsType: ort.TensorElementDataTypeFloat,
+		eosID:      -1,
+	}, runner
+}
+
+// fakeTensors swaps the tensor constructors for ones returning fakeTensors
+// until the test ends.
+func fakeTensors(t testing.TB) {
+	savedInt64, savedFloat32 := newInt64Tensor, newFloat32Tensor
+	newInt64Tensor = func(shape ort.Shape, data []int64) (ort.Value, error) {
+		return &fakeTensor{shape: shape.Clone(), ints: data[:shape.FlattenedSize()]}, nil
+	}
+	newFloat32Tensor = func(shape ort.Shape, data []float32) (ort.Value, error) {
+		return &fakeTensor{shape: shape.Clone(), floats: data}, nil
+	}
+	t.Cleanup(func() {
+		newInt64Tensor, newFloat32Tensor = savedInt64, savedFloat32
+	})
+}
+
+// testParams resolves opts as a request for text would.
+func testParams(t *testing.T, text string, opts api.InferOptions) inferParams {
+	t.Helper()
+	params, err := resolveParams(InferenceRequest{Sentence: text, InferOptions: opts}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return params
+}
+
+func TestGetPPLIDsFakeRunner(t *testing.T) {
+	m, runner := newTestModel(t, 16, 16)
+	ids := []uint32{1, 2, 3, 5, 6, 0, 4}
+
+	result, err := m.getPPLIDs(context.Background(), ids, defaultScoreOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := wantPPL(ids); math.Abs(result.Perplexity-want) > 1e-9 {
+		t.Errorf("perplexity = %v, want %v", result.Perplexity, want)
+	}
+	if result.ScoredTokens != len(ids)-1 || result.Windows != 1 {
+		t.Errorf("scored %d tokens in %d windows, want %d in 1", result.ScoredTokens, result.Windows, len(ids)-1)
+	}
+	if len(runner.runs) != 1 || runner.runs[0] != [2]int64{1, int64(len(ids))} {
+		t.Errorf("runs = %v, want one of [1 %d]", runner.runs, len(ids))
+	}
+}
+
+// With overlapping windows every token after the first is scored exactly
+// once, and the fake model only looks at the previous token, so the sliding
+// window must give the same perplexity as one window over everything.
+func TestGetPPLIDsSlidingWindow(t *testing.T) {
+	ids := []uint32{1, 2, 3, 4, 0, 6, 5, 1, 2, 2, 3, 4, 5}
+	m, runner := newTestModel(t, 4, 2)
+
+	result, err := m.getPPLIDs(context.Background(), ids, defaultScoreOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := wantPPL(ids); math.Abs(result.Perplexity-want) > 1e-9 {
+		t.Errorf("perplexity = %v, want %v", result.Perplexity, want)
+	}
+	if result.ScoredTokens != len(ids)-1 {
+		t.Errorf("scored %d tokens, want %d", result.ScoredTokens, len(ids)-1)
+	}
+	if result.Windows != len(runner.runs) || result.Windows != m.windowCount(ids, defaultScoreOptions) {
+		t.Errorf("windows = %d, runs = %d, windowCount = %d", result.Windows, len(runner.runs), m.windowCount(ids, defaultScoreOptions))
+	}
+}
+
+// TestGetPPLIDsTruncate checks truncate scores only the first window, so a
+// text that turns surprising past it scores lower than when scored in full.
+func TestGetPPLIDsTruncate(t *testing.T) {
+	ids := []uint32{1, 2, 3, 4, 0, 6, 5, 1, 2, 2, 3, 4, 5}
+	m, runner := newTestModel(t, 4, 2)
+
+	full, err := m.getPPLIDs(context.Background(), ids, defaultScoreOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := len(runner.runs)
+
+	opts := defaultScoreOptions
+	opts.truncate = true
+	truncated, err := m.getPPLIDs(context.Background(), ids, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := wantPPL(ids[:4]); math.Abs(truncated.Perplexity-want) > 1e-9 {
+		t.Errorf("truncated perplexity = %v, want %v", truncated.Perplexity, want)
+	}
+	if truncated.Perplexity >= full.Perplexity {
+		t.Errorf("truncated perplexity %v not below full %v", truncated.Perplexity, full.Perplexity)
+	}
+	if !truncated.Truncated || full.Truncated {
+		t.Errorf("truncated flags = %v (truncate), %v (full); want true, false", truncated.Truncated, full.Truncated)
+	}
+	if truncated.ScoredTokens != 3 || truncated.Tokens != len(ids) {
+		t.Errorf("truncated scored %d of %d tokens, want 3 of %d", truncated.ScoredTokens, truncated.Tokens, len(ids))
+	}
+	if got := len(runner.runs) - runs; got != 1 || m.windowCount(ids, opts) != 1 {
+		t.Errorf("truncated ran %d windows, windowCount = %d; want 1", got, m.windowCount(ids, opts))
+	}
+}
+
+func TestCalculateNLL(t *testing.T) {
+	m, _ := newTestModel(t, 16, 16)
+	prev := []uint32{3, 3, 6}
+	targets := []uint32{4, 0, 7}
+	var logits []float32
+	for _, id := range prev {
+		logits = append(logits, fakeLogits(id)...)
+	}
+
+	got := m.calculateNLL(logits, targets, fakeVocab, 0, len(targets), defaultScoreOptions)
+	want := 0.0
+	for i := range targets {
+		want += fakeNLL(prev[i], targets[i])
+	}
+	if math.Abs(got-want) > 1e-12 {
+		t.Errorf("calculateNLL = %v, want %v", got, want)
+	}
+
+	// startIdx skips the leading positions
+	got = m.calculateNLL(logits, targets[1:], fakeVocab, 1, 2, defaultScoreOptions)
+	if want -= fakeNLL(prev[0], targets[0]); math.Abs(got-want) > 1e-12 {
+		t.Errorf("calculateNLL from 1 = %v, want %v", got, want)
+	}
+}
+
+// Sequences of different lengths share one padded run, and each gets the
+// perplexity it has on its own: padding is masked and never scored.
+func TestGetPPLBatchMixedLengths(t *testing.T) {
+	m, runner := newTestModel(t, 16, 16)
+	m.hasAttentionMask = true
+	seqs := [][]uint32{
+		{1, 2},
+		{5, 6, 0, 1, 3, 3, 4, 6, 2},
+		{4, 4, 5},
+	}
+
+	ppls, errs := m.getPPLBatch(context.Background(), seqs, defaultScoreOptions)
+	for i, seq := range seqs {
+		if errs[i] != nil {
+			t.Fatalf("sequence %d: %v", i, errs[i])
+		}
+		if want := wantPPL(seq); math.Abs(ppls[i]-want) > 1e-9 {
+			t.Errorf("sequence %d: perplexity = %v, want %v", i, ppls[i], want)
+		}
+	}
+	if len(runner.runs) != 1 || runner.runs[0] != [2]int64{3, 9} {
+		t.Fatalf("runs = %v, want one of [3 9]", runner.runs)
+	}
+	for b, seq := range seqs {
+		for i, got := range runner.mask[b*9 : (b+1)*9] {
+			want := int64(0)
+			if i < len(seq) {
+				want = 1
+			}
+			if got != want {
+				t.Errorf("mask[%d][%d] = %d, want %d", b, i, got, want)
+			}
+		}
+	}
+}
+
+// A line with no sentence breaks that runs far past max_length is scored
+// with the sliding window, to the same perplexity as in one long context.
+func TestInferRunOnLine(t *testing.T) {
+	m, runner := newTestModel(t, 64, 32)
+	words := make([]string, 3000)
+	for i := range words {
+		words[i] = fmt.Sprintf("w%d", i)
+	}
+	text := strings.Join(words, " ")
+	ids, _ := m.tokenizer.Encode(text, false)
+
+	response, err := m.Infer(context.Background(), text, testParams(t, text, api.InferOptions{}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Sentences) != 1 {
+		t.Fatalf("got %d sentences, want the one run-on line", len(response.Sentences))
+	}
+	got, want := response.Sentences[0].Perplexity, wantPPL(ids)
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("line perplexity = %v, want %v", got, want)
+	}
+	if response.AvgPerplexityPerLine == nil || *response.AvgPerplexityPerLine != got {
+		t.Errorf("avg_perplexity_per_line = %v, want %v", response.AvgPerplexityPerLine, got)
+	}
+	for _, run := range runner.runs {
+		if run[1] > 64 {
+			t.Fatalf("a run of %d tokens exceeds max_length", run[1])
+		}
+	}
+}
+
+// Contextual lines are scored from the document pass, so a line's first
+// token is predicted from the line before it; isolated lines leave it
+// unscored.
+func TestInferContextualLines(t *testing.T) {
+	var lines [2][]uint32
+	for i := range lines {
+		for j := 0; j < minTokensPerChunk; j++ {
+			lines[i] = append(lines[i], uint32(3*i+j)%6)
+		}
+	}
+	text := fakeText(lines[:]...)
+	joined := append([]uint32{lines[0][len(lines[0])-1]}, lines[1]...)
+
+	for _, contextual := range []bool{false, true} {
+		m, runner := newTestModel(t, 64, 64)
+		opts := api.InferOptions{Contextual: contextual}
+		response, err := m.Infer(context.Background(), text, testParams(t, text, opts), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Sentences) != 2 {
+			t.Fatalf("contextual=%v: got %d sentences, want 2", contextual, len(response.Sentences))
+		}
+		want := []float64{wantPPL(lines[0]), wantPPL(lines[1])}
+		runs := 2 // The document pass and one batch of lines
+		if contextual {
+			want[1] = wantPPL(joined)
+			runs = 1
+		}
+		for i, s := range response.Sentences {
+			if math.Abs(s.Perplexity-want[i]) > 1e-9 {
+				t.Errorf("contextual=%v: line %d perplexity = %v, want %v", contextual, i, s.Perplexity, want[i])
+			}
+		}
+		if len(runner.runs) != runs {
+			t.Errorf("contextual=%v: %d runs, want %d", contextual, len(runner.runs), runs)
+		}
+	}
+	if wantPPL(joined) == wantPPL(lines[1]) {
+		t.Fatal("the second line scores the same with and without context")
+	}
+}
+
+// A line whose perplexity comes out NaN is left out of the aggregates, which
+// are taken over the remaining lines.
+func TestInferSkipsNaNLine(t *testing.T) {
+	m, runner := newTestModel(t, 64, 64)
+	runner.nan = map[uint32]bool{6: true}
+	var lines [3][]uint32
+	for i := range lines {
+		for j := 0; j < minTokensPerChunk; j++ {
+			lines[i] = append(lines[i], uint32(i+j)%6)
+		}
+	}
+	lines[1][5] = 6 // Every token after it is NaN
+	text := fakeText(lines[:]...)
+	if ids, _ := m.tokenizer.Encode(text, false); len(ids) != 3*minTokensPerChunk {
+		t.Fatalf("text encodes to %d tokens, want %d", len(ids), 3*minTokensPerChunk)
+	}
+
+	response, err := m.Infer(context.Background(), text, testParams(t, text, api.InferOptions{}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Sentences) != 2 || response.Sentences[0].Text != fakeText(lines[0]) || response.Sentences[1].Text != fakeText(lines[2]) {
+		t.Fatalf("sentences = %+v, want the first and last lines", response.Sentences)
+	}
+	want := (wantPPL(lines[0]) + wantPPL(lines[2])) / 2
+	if response.AvgPerplexityPerLine == nil || math.Abs(*response.AvgPerplexityPerLine-want) > 1e-9 {
+		t.Errorf("avg_perplexity_per_line = %v, want %v", response.AvgPerplexityPerLine, want)
+	}
+	if response.Label == nil {
+		t.Error("no verdict from the remaining lines")
+	}
+}
+
+func TestCheckLength(t *testing.T) {
+	for _, tc := range []struct {
+		text       string
+		minChars   int
+		allowShort bool
+		blocked    bool
+	}{
+		{"Long enough text.", 10, false, false},
+		{"Short.", 10, false, true},
+		{"Short.", 10, true, false},
+		{"", 0, false, true}, // Nothing to score, whatever min_chars says
+		{"!!! ...", 0, true, true},
+		{"Hi", 0, false, false},
+	} {
+		params := testParams(t, "", api.InferOptions{MinChars: &tc.minChars, AllowShort: tc.allowShort})
+		var response InferenceResponse
+		if blocked := checkLength(tc.text, params, &response); blocked != tc.blocked || blocked && response.Status == "" {
+			t.Errorf("checkLength(%q, min_chars %d, allow_short %v) = %v with status %q, want %v",
+				tc.text, tc.minChars, tc.allowShort, blocked, response.Status, tc.blocked)
+		}
+	}
+}
+
+// Text with nothing to score gets a status, not an error, even with
+// min_chars 0.
+func TestInferEmptyText(t *testing.T) {
+	m, runner := newTestModel(t, 64, 64)
+	zero := 0
+	for _, text := range []string{"", "  \n ", "🙂 🙂"} {
+		response, err := m.Infer(context.Background(), text, testParams(t, text, api.InferOptions{MinChars: &zero}), nil)
+		if err != nil {
+			t.Errorf("Infer(%q): %v", text, err)
+			continue
+		}
+		if response.Status == "" || response.Label != nil {
+			t.Errorf("Infer(%q) = status %q, label %v; want a status and no verdict", text, response.Status, response.Label)
+		}
+	}
+	if len(runner.runs) != 0 {
+		t.Errorf("%d runs, want none", len(runner.runs))
+	}
+}
+
+// TestSingleTokenNotScored checks text of a single token is refused rather
+// than given a perplexity of 1, which once read as certain AI.
+func TestSingleTokenNotScored(t *testing.T) {
+	m, _ := newTestModel(t, 64, 64)
+	if _, err := m.getPPLIDs(context.Background(), []uint32{3}, defaultScoreOptions); !errors.Is(err, errNoTokens) {
+		t.Errorf("getPPLIDs of one token: err = %v, want errNoTokens", err)
+	}
+	_, errs := m.getPPLBatch(context.Background(), [][]uint32{{3}, {1, 2}}, defaultScoreOptions)
+	if !errors.Is(errs[0], errNoTokens) || errs[1] != nil {
+		t.Errorf("getPPLBatch errs = %v, want [errNoTokens <nil>]", errs)
+	}
+
+	text := fakeText([]uint32{3})
+	response, err := m.Infer(context.Background(), text, testParams(t, text, api.InferOptions{AllowShort: true}), nil)
+	if err != nil {
+		t.Fatalf("Infer(%q): %v", text, err)
+	}
+	if response.Status == "" || response.Label != nil {
+		t.Errorf("Infer(%q) = status %q, label %v; want a status and no verdict", text, response.Status, response.Label)
+	}
+}
+
+// BenchmarkInferSameLengthLines scores a document of many lines that all
+// encode to the same length, where the input buffers are reused run to run.
+func BenchmarkInferSameLengthLines(b *testing.B) {
+	m, _ := newTestModel(b, 64, 64)
+	lines := make([][]uint32, 200)
+	for i := range lines {
+		for j := 0; j < minTokensPerChunk; j++ {
+			lines[i] = append(lines[i], uint32(i*j)%fakeEOS)
+		}
+	}
+	text := fakeText(lines...)
+	params, err := resolveParams(InferenceRequest{Sentence: text}, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.Infer(context.Background(), text, params, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAcquireModelUnavailable(t *testing.T) {
+	modelReady.Store(false)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/infer", nil)
+	r = r.WithContext(withRequestID(r.Context(), "req-1"))
+
+	if m := acquireModel(w, r); m != nil {
+		t.Fatal("acquireModel returned a model that isn't ready")
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", w.Code)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q is not JSON: %v", w.Body, err)
+	}
+	if body["error"] != "model_unavailable" || body["request_id"] != "req-1" {
+		t.Errorf("body = %v, want model_unavailable for req-1", body)
+	}
+}
+
+// Two documents joined by an EOS token are scored each in its own context:
+// the first token of the second is not predicted from the end of the first.
+func TestGetPPLTwoDocumentsJoinedByEOS(t *testing.T) {
+	m, _ := newTestModel(t, 64, 64)
+	m.eosID = fakeEOS
+	first := []uint32{1, 2, 3, 4, 0}
+	second := []uint32{5, 5, 6, 0, 1, 2}
+	text := fakeText(first) + " " + eosToken + " " + fakeText(second)
+	ids, _ := m.tokenizer.Encode(text, false)
+
+	segments := m.splitAtEOS(ids)
+	if len(segments) != 2 {
+		t.Fatalf("split into %d segments, want 2", len(segments))
+	}
+	for i, want := range []tokenSegment{{ids: first, offset: 0}, {ids: second, offset: len(first) + 1}} {
+		if fmt.Sprint(segments[i]) != fmt.Sprint(want) {
+			t.Errorf("segment %d = %v, want %v", i, segments[i], want)
+		}
+	}
+
+	result, err := m.getPPL(context.Background(), text, defaultScoreOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.EOSFound {
+		t.Error("EOSFound = false, want true")
+	}
+	nll := 0.0
+	for _, doc := range [][]uint32{first, second} {
+		nll += math.Log(wantPPL(doc)) * float64(len(doc)-1)
+	}
+	want := math.Exp(nll / float64(len(first)+len(second)-2))
+	if math.Abs(result.Perplexity-want) > 1e-9 {
+		t.Errorf("perplexity = %v, want %v", result.Perplexity, want)
+	}
+	if result.ScoredTokens != len(first)+len(second)-2 {
+		t.Errorf("scored %d tokens, want %d", result.ScoredTokens, len(first)+len(second)-2)
+	}
+
+	// Without EOS handling the marker is just another token
+	m.eosID = -1
+	if segments := m.splitAtEOS(ids); len(segments) != 1 || len(segments[0].ids) != len(ids) {
+		t.Errorf("without EOS handling, split into %v", segments)
+	}
+}
+
+// A line of emoji encodes to no tokens, which is reported as errNoTokens so
+// callers can skip it.
+func TestGetPPLEmojiLine(t *testing.T) {
+	m, runner := newTestModel(t, 64, 64)
+	const emoji = "🙂 🎉 🚀"
+
+	if _, err := m.getPPL(context.Background(), emoji, defaultScoreOptions); !errors.Is(err, errNoTokens) {
+		t.Errorf("getPPL = %v, want errNoTokens", err)
+	}
+	ids, _ := m.tokenizer.Encode(emoji, false)
+	_, errs := m.getPPLBatch(context.Background(), [][]uint32{ids, {1, 2, 3}}, defaultScoreOptions)
+	if !errors.Is(errs[0], errNoTokens) || errs[1] != nil {
+		t.Errorf("getPPLBatch errors = %v, want errNoTokens for the emoji line only", errs)
+	}
+	if len(runner.runs) != 1 || runner.runs[0][0] != 1 {
+		t.Errorf("runs = %v, want one over the other line", runner.runs)
+	}
+}
+
+// A file that fails its checksum is refused before ONNX Runtime is even
+// initialized.
+func TestNewGPT2ModelChecksumFirst(t *testing.T) {
+	calls := fakeORT(t, nil)
+	dir := t.TempDir()
+	modelPath := filepath.Join(dir, "model.onnx")
+	tokenizerPath := filepath.Join(dir, "tokenizer.json")
+	for _, path := range []string{modelPath, tokenizerPath} {
+		if err := os.WriteFile(path, []byte("not what was expected"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := ModelConfig{
+		ModelPath:     modelPath,
+		TokenizerPath: tokenizerPath,
+		ModelSHA256:   strings.Repeat("0", 64),
+		MaxLength:     64,
+		Stride:        64,
+		BatchSize:     1,
+	}
+
+	if _, err := NewGPT2Model(cfg); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("NewGPT2Model = %v, want a checksum mismatch", err)
+	}
+	if calls.inits != 0 {
+		t.Errorf("ONNX Runtime was initialized %d times, want never", calls.inits)
+	}
+}
+
+// PROB_FLOOR caps the surprisal of an out-of-distribution token, so higher
+// floors give lower perplexity; with no floor the exact log-softmax is used.
+func TestCalculateNLLProbFloor(t *testing.T) {
+	m, _ := newTestModel(t, 16, 16)
+	saved := config.ProbFloor
+	defer func() { config.ProbFloor = saved }()
+
+	// The target's logit is far below the rest of the vocabulary
+	logits := make([]float32, fakeVocab)
+	logits[3] = -40
+	exact := 40 + math.Log(fakeVocab-1+math.Exp(-40))
+
+	for _, tc := range []struct {
+		floor float64
+		want  float64
+	}{
+		{0, exact},
+		{1e-20, exact}, // Below the token's probability, so no effect
+		{1e-10, -math.Log(1e-10)},
+		{1e-5, -math.Log(1e-5)},
+	} {
+		config.ProbFloor = tc.floor
+		got := m.calculateNLL(logits, []uint32{3}, fakeVocab, 0, 1, defaultScoreOptions)
+		if math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("floor %g: NLL = %v, want %v", tc.floor, got, tc.want)
+		}
+	}
+}
+
+// logSoftmaxAt and softmax work in float64 throughout: both must match
+// closed forms far more closely than float32's 1e-7 or so would allow.
+func TestSoftmaxPrecision(t *testing.T) {
+	const tolerance = 1e-12
+
+	// Logits log(k) at temperature T give probabilities k^(1/T) / sum j^(1/T)
+	logits := []float64{0, math.Log(2), math.Log(3), math.Log(4)}
+	for _, temperature := range []float64{1, 0.7, 1.5} {
+		sum := 0.0
+		for k := 1; k <= len(logits); k++ {
+			sum += math.Pow(float64(k), 1/temperature)
+		}
+		probs := softmax(logits, temperature)
+		for i := range logits {
+			want := math.Pow(float64(i+1), 1/temperature) / sum
+			if math.Abs(probs[i]-want) > tolerance {
+				t.Errorf("T=%g: softmax[%d] = %.17g, want %.17g", temperature, i, probs[i], want)
+			}
+			if got := logSoftmaxAt(logits, i, temperature); math.Abs(got-math.Log(want)) > tolerance {
+				t.Errorf("T=%g: logSoftmaxAt(%d) = %.17g, want %.17g", temperature, i, got, math.Log(want))
+			}
+		}
+	}
+
+	// Large logits a millionth apart, a difference float32 can't even hold
+	near := []float64{1000, 1000 + 1e-6}
+	if got, want := logSoftmaxAt(near, 1, 1), -math.Log1p(math.Exp(-1e-6)); math.Abs(got-want) > tolerance {
+		t.Errorf("logSoftmaxAt of near logits = %.17g, want %.17g", got, want)
+	}
+	if float32(near[0]) != float32(near[1]) {
+		t.Fatal("the near logits are distinct in float32; the case proves nothing")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	htmlCommentRe = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlBlockRe   = regexp.MustCompile(`(?is)<(script|style)\b[^>]*>.*?</(?:script|style)>`)
+	htmlTagRe     = regexp.MustCompile(`</?[a-zA-Z][a-zA-Z0-9-]*(?:\s[^<>]*)?/?>`)
+	mdImageRe     = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	mdLinkRe      = regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`)
+	mdHeadingRe   = regexp.MustCompile(`^\s{0,3}#{1,6}\s+`)
+	mdQuoteRe     = regexp.MustCompile(`^\s{0,3}(?:>\s?)+`)
+	mdListRe      = regexp.MustCompile(`^\s*(?:[-*+]|\d+[.)])\s+`)
+	mdRuleRe      = regexp.MustCompile(`^\s{0,3}(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+	mdCodeSpanRe  = regexp.MustCompile("`([^`]+)`")
+
+	// Emphasis markers only count at word edges, so 2*3*4 and snake_case
+	// are left alone. RE2 has no backreferences, hence one pattern each.
+	mdEmphasisRes = []*regexp.Regexp{
+		regexp.MustCompile(`(^|[^\w*])\*\*(\S(?:.*?\S)?)\*\*`),
+		regexp.MustCompile(`(^|[^\w_])__(\S(?:.*?\S)?)__`),
+		regexp.MustCompile(`(^|[^\w~])~~(\S(?:.*?\S)?)~~`),
+		regexp.MustCompile(`(^|[^\w*])\*(\S(?:[^*]*?\S)?)\*`),
+		regexp.MustCompile(`(^|[^\w_])_(\S(?:[^_]*?\S)?)_(\W|$)`),
+	}
+)
+
+// stripMarkup removes markdown syntax and HTML tags from text so that only
+// the prose is scored. It is deliberately conservative: fenced and indented
+// code blocks are kept verbatim (only the fence lines are dropped), inline
+// code keeps its contents, and emphasis markers inside words are left alone
+// so snake_case identifiers and arithmetic survive. Line structure is preserved so sentence
+// splitting still sees the original paragraph breaks.
+func stripMarkup(text string) string {
+	text = htmlCommentRe.ReplaceAllString(text, "")
+	text = htmlBlockRe.ReplaceAllString(text, "")
+
+	lines := strings.Split(text, "\n")
+	out := make([]string, 0, len(lines))
+	inFence := false
+	fence := ""
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+
+		// Fenced code: drop the fences, keep the body untouched
+		if inFence {
+			if strings.HasPrefix(trimmed, fence) {
+				inFence = false
+				continue
+			}
+			out = append(out, line)
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = true
+			fence = trimmed[:3]
+			continue
+		}
+
+		// Indented code blocks are also left alone
+		if strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t") {
+			out = append(out, line)
+			continue
+		}
+
+		if mdRuleRe.MatchString(line) {
+			out = append(out, "")
+			continue
+		}
+
+		line = htmlTagRe.ReplaceAllString(line, "")
+		line = mdHeadingRe.ReplaceAllString(line, "")
+		line = mdQuoteRe.ReplaceAllString(line, "")
+		line = mdListRe.ReplaceAllString(line, "")
+		line = mdImageRe.ReplaceAllString(line, "$1")
+		line = mdLinkRe.ReplaceAllString(line, "$1")
+		line = mdCodeSpanRe.ReplaceAllString(line, "$1")
+		for _, re := range mdEmphasisRes {
+			line = re.ReplaceAllString(line, "$1$2$3")
+		}
+		out = append(out, html.UnescapeString(line))
+	}
+
+	return strings.Join(out, "\n")
+}
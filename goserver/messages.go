@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Message keys. The same keys are used in MESSAGES_FILE.
+const (
+	msgAI          = "ai"           // Text classified as AI
+	msgMixed       = "mixed"        // Text in the uncertain band
+	msgHuman       = "human"        // Text classified as Human
+	msgTooShort    = "too_short"    // Below the minimum length; %d is the minimum
+	msgNoSentences = "no_sentences" // Nothing left to score after splitting
+
+	msgNotEnglish        = "not_english"         // Warning that thresholds are calibrated on English
+	msgNotEnglishBlocked = "not_english_blocked" // Non-English text refused without force
+)
+
+const defaultLocale = "en"
+
+// catalog maps message keys to the strings of one locale.
+type catalog map[string]string
+
+// catalogs holds the messages of every supported locale, keyed by lowercase
+// language tag. MESSAGES_FILE can override or extend them at startup.
+var catalogs = map[string]catalog{
+	"en": {
+		msgAI:          "This text was likely generated by AI.",
+		msgMixed:       "This text likely contains passages generated by AI.",
+		msgHuman:       "This text was likely written by a human.",
+		msgTooShort:    "Please input more text (min %d characters)",
+		msgNoSentences: "No valid sentences found",
+
+		msgNotEnglish:        "The text does not appear to be English; the AI/Human thresholds are calibrated on English and may not apply.",
+		msgNotEnglishBlocked: "The text does not appear to be English. Send force=true to analyze it anyway.",
+	},
+	"es": {
+		msgAI:          "Este texto probablemente fue generado por IA.",
+		msgMixed:       "Este texto probablemente contiene partes generadas por IA.",
+		msgHuman:       "Este texto probablemente fue escrito por una persona.",
+		msgTooShort:    "Introduzca más texto (mínimo %d caracteres)",
+		msgNoSentences: "No se encontraron oraciones válidas",
+
+		msgNotEnglish:        "El texto no parece estar en inglés; los umbrales de IA/humano están calibrados para inglés y pueden no ser aplicables.",
+		msgNotEnglishBlocked: "El texto no parece estar en inglés. Envíe force=true para analizarlo de todos modos.",
+	},
+	"de": {
+		msgAI:          "Dieser Text wurde wahrscheinlich von einer KI erzeugt.",
+		msgMixed:       "Dieser Text enthält wahrscheinlich von einer KI erzeugte Passagen.",
+		msgHuman:       "Dieser Text wurde wahrscheinlich von einem Menschen geschrieben.",
+		msgTooShort:    "Bitte geben Sie mehr Text ein (mindestens %d Zeichen)",
+		msgNoSentences: "Keine gültigen Sätze gefunden",
+
+		msgNotEnglish:        "Der Text scheint nicht auf Englisch zu sein; die KI/Mensch-Schwellenwerte sind für Englisch kalibriert und gelten möglicherweise nicht.",
+		msgNotEnglishBlocked: "Der Text scheint nicht auf Englisch zu sein. Senden Sie force=true, um ihn trotzdem zu analysieren.",
+	},
+	"fr": {
+		msgAI:          "Ce texte a probablement été généré par une IA.",
+		msgMixed:       "Ce texte contient probablement des passages générés par une IA.",
+		msgHuman:       "Ce texte a probablement été écrit par un humain.",
+		msgTooShort:    "Veuillez saisir plus de texte (au moins %d caractères)",
+		msgNoSentences: "Aucune phrase valide trouvée",
+
+		msgNotEnglish:        "Le texte ne semble pas être en anglais ; les seuils IA/humain sont calibrés pour l'anglais et peuvent ne pas s'appliquer.",
+		msgNotEnglishBlocked: "Le texte ne semble pas être en anglais. Envoyez force=true pour l'analyser quand même.",
+	},
+}
+
+// get returns the message for key, falling back to English for keys the
+// locale doesn't define.
+func (c catalog) get(key string) string {
+	if s, ok := c[key]; ok {
+		return s
+	}
+	return catalogs[defaultLocale][key]
+}
+
+// tooShort explains that text is below the minChars gate.
+func (c catalog) tooShort(minChars int) string {
+	return fmt.Sprintf(c.get(msgTooShort), minChars)
+}
+
+// selectCatalog picks the catalog for an explicit locale if it is supported,
+// else for the best match in an Accept-Language header, else English. Only
+// the primary language subtag is matched, so "en-GB" selects "en".
+func selectCatalog(locale, acceptLanguage string) catalog {
+	if c, ok := lookupCatalog(locale); ok {
+		return c
+	}
+	for _, tag := range parseAcceptLanguage(acceptLanguage) {
+		if c, ok := lookupCatalog(tag); ok {
+			return c
+		}
+	}
+	return catalogs[defaultLocale]
+}
+
+func lookupCatalog(tag string) (catalog, bool) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if c, ok := catalogs[tag]; ok {
+		return c, true
+	}
+	if primary, _, found := strings.Cut(tag, "-"); found {
+		c, ok := catalogs[primary]
+		return c, ok
+	}
+	return nil, false
+}
+
+// parseAcceptLanguage returns the language tags of an Accept-Language header
+// in order of preference, dropping those with q=0.
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	out := make([]string, len(tags))
+	for i, t := range tags {
+		out[i] = t.tag
+	}
+	return out
+}
+
+// loadMessageFile merges a JSON file of {"locale": {"key": "message"}} into
+// catalogs, so deployments can correct strings or add locales.
+func loadMessageFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var overrides map[string]map[string]string
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for locale, messages := range overrides {
+		locale = strings.ToLower(locale)
+		c, ok := catalogs[locale]
+		if !ok {
+			c = catalog{}
+			catalogs[locale] = c
+		}
+		for key, msg := range messages {
+			if _, known := catalogs[defaultLocale][key]; !known {
+				return fmt.Errorf("%s: unknown message key %q for locale %q", path, key, locale)
+			}
+			c[key] = msg
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestIDMiddleware tags each request with an id, honoring an incoming
+// X-Request-ID header, echoes it on the response, and logs the request's
+// status and latency once it completes.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(withRequestID(r.Context(), id))
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		slog.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"endpoint", r.URL.Path,
+			"status", sw.status,
+			"latency_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
+
+// statusWriter records the status code written by a handler, and whether
+// the response has been started.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// gzipMiddleware compresses responses for clients that accept gzip (see
+// acceptsGzip). Output is buffered until minSize bytes have been
+// written, so small responses (e.g. short plain-text verdicts) go out
+// uncompressed. Event streams are never compressed.
+func gzipMiddleware(minSize int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Not deferred: if the handler panics, nothing buffered should go out
+		// before recoverMiddleware writes its error
+		gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize, status: http.StatusOK}
+		next.ServeHTTP(gw, r)
+		gw.Close()
+	})
+}
+
+// acceptsGzip reports whether r's Accept-Encoding allows gzip: named with a
+// q-value above 0, or covered by a "*" that is. gzip;q=0 refuses it.
+func acceptsGzip(r *http.Request) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch coding {
+		case "gzip", "x-gzip":
+			gzipQ = math.Max(gzipQ, q)
+		case "*":
+			anyQ = math.Max(anyQ, q)
+		}
+	}
+	if gzipQ < 0 {
+		gzipQ = anyQ
+	}
+	return gzipQ > 0
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	started bool         // Headers sent and compression decided
+	gz      *gzip.Writer // Nil when passing through uncompressed
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if !g.started {
+		g.status = status
+	}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.started {
+		if g.gz != nil {
+			return g.gz.Write(p)
+		}
+		return g.ResponseWriter.Write(p)
+	}
+
+	g.buf = append(g.buf, p...)
+	if len(g.buf) >= g.minSize {
+		if err := g.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start sends the headers, choosing compression only if asked and the
+// response is compressible, then writes out anything buffered so far.
+func (g *gzipResponseWriter) start(compress bool) error {
+	g.started = true
+	h := g.Header()
+
+	// Sniff before compressing, since sniffing gzip bytes is meaningless
+	if h.Get("Content-Type") == "" && len(g.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(g.buf))
+	}
+	if strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") || h.Get("Content-Encoding") != "" {
+		compress = false
+	}
+
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+
+	if len(g.buf) == 0 {
+		return nil
+	}
+	buf := g.buf
+	g.buf = nil
+	_, err := g.Write(buf)
+	return err
+}
+
+// Flush commits to the current decision (uncompressed if still under the
+// threshold) so streaming handlers can push data immediately.
+func (g *gzipResponseWriter) Flush() {
+	if !g.started {
+		g.start(false)
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes out a response that never reached the threshold and
+// finishes the gzip stream if one was started.
+func (g *gzipResponseWriter) Close() error {
+	if !g.started {
+		if err := g.start(false); err != nil {
+			return err
+		}
+	}
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
+// recoverMiddleware turns a panic in a handler into a 500 JSON error for that
+// request instead of a crash of the whole server, logging the panic with its
+// stack and request id. If the handler had already started its response
+// (e.g. a stream), the status can't change and the response is just cut off.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Deliberate abort; net/http handles it quietly
+				panic(v)
+			}
+
+			slog.ErrorContext(r.Context(), "handler panicked",
+				"panic", fmt.Sprint(v),
+				"stack", string(debug.Stack()),
+				"endpoint", r.URL.Path,
+			)
+			if sw.wroteHeader {
+				return
+			}
+			w.Header().Del("Content-Encoding")
+			writeJSONError(w, r, http.StatusInternalServerError, "internal_error")
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// writeJSONError answers r with status and a JSON body naming the error and
+// the request's id, the shape of errors that aren't the client's fault.
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":      code,
+		"request_id": requestIDFromContext(r.Context()),
+	})
+}
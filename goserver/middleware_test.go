@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecoverMiddleware(t *testing.T) {
+	handler := requestIDMiddleware(recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/infer", nil)
+	r.Header.Set("X-Request-ID", "req-42")
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q is not JSON: %v", w.Body, err)
+	}
+	if body["error"] != "internal_error" || body["request_id"] != "req-42" {
+		t.Errorf("body = %v, want internal_error for req-42", body)
+	}
+}
+
+// A handler that panics after starting its response keeps the status it
+// sent, and nothing is appended to what it wrote.
+func TestRecoverMiddlewareStartedResponse(t *testing.T) {
+	handler := recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("data: partial\n\n"))
+		panic("boom")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/infer", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want the 200 already sent", w.Code)
+	}
+	if got := w.Body.String(); got != "data: partial\n\n" {
+		t.Errorf("body = %q, want only what the handler wrote", got)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want it unchanged", ct)
+	}
+}
+
+func TestGzipMiddlewareAcceptEncoding(t *testing.T) {
+	handler := gzipMiddleware(0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"label":1}`))
+	}))
+	for _, tc := range []struct {
+		acceptEncoding string
+		want           bool
+	}{
+		{"gzip", true},
+		{"gzip, deflate, br", true},
+		{"GZIP;q=0.5", true},
+		{"*", true},
+		{"gzip;q=0", false},
+		{"gzip;q=0.0, identity", false},
+		{"*;q=0.5, gzip;q=0", false},
+		{"identity", false},
+		{"", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/info", nil)
+		r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Header().Get("Content-Encoding") == "gzip"; got != tc.want {
+			t.Errorf("Accept-Encoding %q: gzipped = %v, want %v", tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// quantizedOps are ONNX operators that only appear in quantized graphs. Op
+// types are stored as plain strings in the model protobuf, so finding one in
+// the file's bytes is enough to tell a quantized export apart.
+var quantizedOps = [][]byte{
+	[]byte("DynamicQuantizeLinear"),
+	[]byte("QuantizeLinear"),
+	[]byte("DequantizeLinear"),
+	[]byte("MatMulInteger"),
+	[]byte("QLinearMatMul"),
+	[]byte("ConvInteger"),
+}
+
+// opScanner is an io.Writer that looks for quantizedOps in the bytes written
+// to it, carrying a short tail between writes so names split across chunks
+// are still found.
+type opScanner struct {
+	tail  []byte
+	found bool
+}
+
+func (s *opScanner) Write(p []byte) (int, error) {
+	if s.found {
+		return len(p), nil
+	}
+	buf := append(s.tail, p...)
+	for _, op := range quantizedOps {
+		if bytes.Contains(buf, op) {
+			s.found = true
+			return len(p), nil
+		}
+	}
+	keep := min(len(buf), 32) // Longer than any name in quantizedOps
+	s.tail = append(s.tail[:0], buf[len(buf)-keep:]...)
+	return len(p), nil
+}
+
+// inspectModelFile returns the hex SHA-256 of the model at path and whether
+// its graph is quantized, reading the file once.
+func inspectModelFile(path string) (hash string, quantized bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	scanner := &opScanner{}
+	if _, err := io.Copy(io.MultiWriter(h, scanner), f); err != nil {
+		return "", false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), scanner.found, nil
+}
+
+// ioNames are the names of the model inputs and output the tensor code
+// feeds and reads.
+type ioNames struct {
+	inputIDs, positionIDs, logits string
+}
+
+// resolveIONames picks the model's token id, position id and logits names.
+// A name set in cfg is used as given. Otherwise the usual input_ids,
+// position_ids and logits are used if the model has them; failing that,
+// the remaining int64 inputs are taken in order as token ids then position
+// ids, and the first output that isn't a present.* KV output as the logits,
+// which covers exports with generated names such as input.1.
+func resolveIONames(cfg ModelConfig, inputs, outputs []ort.InputOutputInfo) (ioNames, error) {
+	names := ioNames{inputIDs: cfg.InputIDsName, positionIDs: cfg.PositionIDsName, logits: cfg.LogitsName}
+
+	taken := map[string]bool{names.inputIDs: true, names.positionIDs: true}
+	has := func(name string) bool {
+		for _, input := range inputs {
+			if input.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+	detect := func(name *string, usual string) {
+		if *name != "" {
+			return
+		}
+		if has(usual) && !taken[usual] {
+			*name = usual
+			taken[usual] = true
+			return
+		}
+		for _, input := range inputs {
+			if taken[input.Name] || input.Name == "attention_mask" || strings.HasPrefix(input.Name, "past_key_values") ||
+				input.DataType != ort.TensorElementDataTypeInt64 {
+				continue
+			}
+			*name = input.Name
+			taken[input.Name] = true
+			return
+		}
+	}
+	detect(&names.inputIDs, "input_ids")
+	detect(&names.positionIDs, "position_ids")
+	if names.inputIDs == "" || names.positionIDs == "" {
+		return names, fmt.Errorf("model has no inputs to use as token and position ids; set INPUT_IDS_NAME and POSITION_IDS_NAME")
+	}
+
+	if names.logits == "" {
+		for _, output := range outputs {
+			if output.Name == "logits" {
+				names.logits = output.Name
+				break
+			}
+			if names.logits == "" && !strings.HasPrefix(output.Name, "present") {
+				names.logits = output.Name
+			}
+		}
+	}
+	if names.logits == "" {
+		return names, fmt.Errorf("model has no output to use as logits; set LOGITS_NAME")
+	}
+
+	slog.Info("model input and output names",
+		"input_ids", names.inputIDs, "position_ids", names.positionIDs, "logits", names.logits)
+	return names, nil
+}
+
+// checkModelIO verifies the model's inputs and outputs have the types the
+// tensor code feeds and reads, and returns the type of its logits: float32,
+// or float16 for half-precision exports. Quantized exports usually keep
+// int64 inputs and float32 logits, with int8 only inside the graph; exports
+// that quantize the I/O as well cannot be served.
+func checkModelIO(names ioNames, inputs, outputs []ort.InputOutputInfo) (ort.TensorElementDataType, error) {
+	want := map[string]ort.TensorElementDataType{
+		names.inputIDs:    ort.TensorElementDataTypeInt64,
+		names.positionIDs: ort.TensorElementDataTypeInt64,
+	}
+	for _, input := range inputs {
+		if input.Name == "attention_mask" {
+			want[input.Name] = ort.TensorElementDataTypeInt64
+		}
+	}
+	if err := checkTypes("input", inputs, want); err != nil {
+		return 0, err
+	}
+	for _, output := range outputs {
+		if output.Name != names.logits {
+			continue
+		}
+		switch output.DataType {
+		case ort.TensorElementDataTypeFloat, ort.TensorElementDataTypeFloat16:
+			return output.DataType, nil
+		}
+		return 0, fmt.Errorf("model output %q is %s, but only float and float16 are supported", names.logits, output.DataType)
+	}
+	return 0, fmt.Errorf("model has no output named %q", names.logits)
+}
+
+// checkTypes reports the first name in want that is missing from infos or
+// has a different element type.
+func checkTypes(kind string, infos []ort.InputOutputInfo, want map[string]ort.TensorElementDataType) error {
+	for name, dataType := range want {
+		found := false
+		for _, info := range infos {
+			if info.Name != name {
+				continue
+			}
+			found = true
+			if info.DataType != dataType {
+				return fmt.Errorf("model %s %q is %s, but only %s is supported", kind, name, info.DataType, dataType)
+			}
+		}
+		if !found {
+			return fmt.Errorf("model has no %s named %q", kind, name)
+		}
+	}
+	return nil
+}
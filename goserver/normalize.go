@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+)
+
+// referenceDists describe the natural log of perplexity that the loaded model
+// assigns to known AI and known human text, each as a normal distribution.
+// They make scores portable across models, whose raw perplexities differ.
+type referenceDists struct {
+	aiMean, aiStd       float64
+	humanMean, humanStd float64
+}
+
+// aiLikeness maps ppl to the posterior probability, from 0 to 1, that it came
+// from the AI distribution rather than the human one, with equal priors.
+func (d *referenceDists) aiLikeness(ppl float64) float64 {
+	x := math.Log(ppl)
+	ai := normalLogPDF(x, d.aiMean, d.aiStd)
+	human := normalLogPDF(x, d.humanMean, d.humanStd)
+	return 1 / (1 + math.Exp(human-ai))
+}
+
+func normalLogPDF(x, mean, std float64) float64 {
+	z := (x - mean) / std
+	return -0.5*z*z - math.Log(std) - 0.5*math.Log(2*math.Pi)
+}
+
+// loadReferenceDists reads the REF_* variables. It returns nil if none are
+// set, and an error if only some are or a value is invalid.
+func loadReferenceDists() (*referenceDists, error) {
+	names := []string{"REF_AI_LOGPPL_MEAN", "REF_AI_LOGPPL_STD", "REF_HUMAN_LOGPPL_MEAN", "REF_HUMAN_LOGPPL_STD"}
+	values := make([]float64, len(names))
+	set := 0
+	for i, name := range names {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || !isFinite(f) {
+			return nil, fmt.Errorf("invalid %s %q", name, v)
+		}
+		values[i] = f
+		set++
+	}
+
+	switch {
+	case set == 0:
+		return nil, nil
+	case set < len(names):
+		return nil, fmt.Errorf("REF_AI_LOGPPL_MEAN, REF_AI_LOGPPL_STD, REF_HUMAN_LOGPPL_MEAN and REF_HUMAN_LOGPPL_STD must be set together")
+	case values[1] <= 0 || values[3] <= 0:
+		return nil, fmt.Errorf("REF_AI_LOGPPL_STD and REF_HUMAN_LOGPPL_STD must be positive")
+	}
+	return &referenceDists{aiMean: values[0], aiStd: values[1], humanMean: values[2], humanStd: values[3]}, nil
+}
+
+// classProbabilities returns the probability of each class for ppl, or nil
+// if ppl isn't usable. With reference distributions they come from
+// aiLikeness. Otherwise they follow a logistic curve in log perplexity,
+// centered between the AI and Human thresholds (60 and 80), which map to
+// 0.75 and 0.25 AI.
+func classProbabilities(ppl float64) *ClassProbabilities {
+	if !isFinite(ppl) || ppl <= 0 {
+		return nil
+	}
+	var ai float64
+	if config.Reference != nil {
+		ai = config.Reference.aiLikeness(ppl)
+	} else {
+		mid := (math.Log(60) + math.Log(80)) / 2
+		half := (math.Log(80) - math.Log(60)) / 2
+		ai = 1 / (1 + math.Exp((math.Log(ppl)-mid)/half*math.Log(3)))
+	}
+	return &ClassProbabilities{AI: ai, Human: 1 - ai}
+}
+
+// normalizedScore returns the AI-likeness of ppl, or nil when no reference
+// distributions are configured or ppl isn't usable.
+func normalizedScore(ppl float64) *float64 {
+	if config.Reference == nil || !isFinite(ppl) || ppl <= 0 {
+		return nil
+	}
+	score := config.Reference.aiLikeness(ppl)
+	return &score
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+const ortLibraryPath = "/usr/lib/libonnxruntime.so"
+
+// ortEnv reference-counts the process-wide ONNX Runtime environment, so
+// several models can share it and closing one doesn't pull it out from under
+// the others.
+var ortEnv struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// initORT and destroyORT set up and tear down the environment. They are
+// variables so tests can count the calls without ONNX Runtime.
+var (
+	initORT = func() error {
+		ort.SetSharedLibraryPath(ortLibraryPath)
+		return ort.InitializeEnvironment()
+	}
+	destroyORT = ort.DestroyEnvironment
+)
+
+// acquireORT initializes the ONNX Runtime environment if no model holds it
+// yet, and takes a reference. Each successful call must be paired with
+// releaseORT.
+func acquireORT() error {
+	ortEnv.mu.Lock()
+	defer ortEnv.mu.Unlock()
+
+	if ortEnv.refs == 0 {
+		if err := initORT(); err != nil {
+			return fmt.Errorf("failed to initialize ONNX runtime: %w", err)
+		}
+	}
+	ortEnv.refs++
+	return nil
+}
+
+// releaseORT drops a reference taken by acquireORT, destroying the
+// environment when the last one goes.
+func releaseORT() {
+	ortEnv.mu.Lock()
+	defer ortEnv.mu.Unlock()
+
+	if ortEnv.refs == 0 {
+		return
+	}
+	ortEnv.refs--
+	if ortEnv.refs == 0 {
+		destroyORT()
+	}
+}
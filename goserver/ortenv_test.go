@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// ortCalls counts the calls to the fake environment hooks.
+type ortCalls struct {
+	inits int // Attempts to initialize
+	live  int // Environments initialized and not yet destroyed
+}
+
+// fakeORT swaps in environment hooks that count their calls, until the test
+// ends.
+func fakeORT(t *testing.T, initErr error) *ortCalls {
+	t.Helper()
+	savedInit, savedDestroy := initORT, destroyORT
+	calls := &ortCalls{}
+	initORT = func() error {
+		calls.inits++
+		if initErr != nil {
+			return initErr
+		}
+		calls.live++
+		return nil
+	}
+	destroyORT = func() error {
+		calls.live--
+		return nil
+	}
+	t.Cleanup(func() {
+		initORT, destroyORT = savedInit, savedDestroy
+		ortEnv.refs = 0
+	})
+	return calls
+}
+
+func TestORTRefcount(t *testing.T) {
+	calls := fakeORT(t, nil)
+
+	for i := 0; i < 2; i++ {
+		if err := acquireORT(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls.live != 1 {
+		t.Fatalf("%d environments after two acquires, want 1", calls.live)
+	}
+
+	releaseORT()
+	if calls.live != 1 {
+		t.Fatalf("%d environments after one release, want it kept", calls.live)
+	}
+	releaseORT()
+	if calls.live != 0 {
+		t.Fatalf("%d environments after the last release, want it destroyed", calls.live)
+	}
+
+	// An extra release is ignored rather than destroying it twice
+	releaseORT()
+	if calls.live != 0 {
+		t.Fatalf("%d environments after an extra release", calls.live)
+	}
+}
+
+func TestORTInitFailure(t *testing.T) {
+	calls := fakeORT(t, errors.New("no library"))
+
+	if err := acquireORT(); err == nil {
+		t.Fatal("acquireORT succeeded although initialization failed")
+	}
+	if ortEnv.refs != 0 || calls.live != 0 {
+		t.Errorf("refs = %d, environments = %d after a failed acquire, want 0", ortEnv.refs, calls.live)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// inferParams are the per-request settings honored by Infer and DetectGPT,
+// resolved from an InferenceRequest against the server defaults.
+type inferParams struct {
+	detailed      bool
+	returnLogits  bool
+	explain       bool   // Describe why the verdict was reached
+	force         bool   // Analyze text even if it isn't English
+	allowShort    bool   // Analyze text below minChars instead of refusing it
+	maxSentences  int    // Most sentence details returned; 0 means all
+	perSentence   bool   // Score each line, not just the document
+	weighted      bool   // Classify on the token-weighted mean line perplexity
+	contextual    bool   // Score lines within the document pass, not in isolation
+	sort          string // Order of the sentences array; "document" by default
+	minChars      int    // Minimum alphanumeric characters to analyze
+	perturbations int    // DetectGPT perturbation count
+	msgs          catalog
+	score         scoreOptions
+
+	segmentation  string // "sentence", "paragraph" or "window"
+	segmentTokens int    // Window size for segmentation=window
+
+	rolling *rollingParams // nil unless a rolling track was requested
+
+	normalizeWhitespace bool // Clean invisible characters and odd spaces before tokenizing
+	maxLineInferences   int  // Most per-line scoring passes; 0 means no cap
+	windowInfo          bool // Return the document perplexity's windows
+	documentPerplexity  bool // Score the whole document, not just its lines
+
+	charRange *CharRange // Score only these characters; nil scores the whole text
+
+	borderlineMargin float64 // Mark perplexities this close to a threshold as borderline
+
+	histogram        bool
+	histogramBuckets int
+	histogramEdges   []float64
+
+	ci      bool
+	ciLevel float64
+}
+
+// resolveParams validates the options in req and fills in server defaults.
+// acceptLanguage is the request's Accept-Language header, used to pick the
+// message locale when req doesn't name one. Errors are meant to be shown to
+// the client.
+func resolveParams(req InferenceRequest, acceptLanguage string) (p inferParams, err error) {
+	p = inferParams{
+		// Always request detailed to get per-sentence analysis
+		detailed:      true,
+		minChars:      config.MinChars,
+		perturbations: config.DetectGPTPerturbations,
+		score:         defaultScoreOptions,
+		msgs:          selectCatalog(req.Locale, acceptLanguage),
+	}
+
+	switch req.Method {
+	case "", "perplexity", "detectgpt":
+	default:
+		return p, fmt.Errorf("unknown method %q", req.Method)
+	}
+	if req.ReturnLogits && req.Method == "detectgpt" {
+		return p, fmt.Errorf("return_logits is not supported with method detectgpt")
+	}
+	if req.Explain && req.Method == "detectgpt" {
+		return p, fmt.Errorf("explain is not supported with method detectgpt")
+	}
+	p.returnLogits = req.ReturnLogits
+	p.explain = req.Explain
+	p.borderlineMargin = config.BorderlineMargin
+	if req.BorderlineMargin != nil {
+		if !isFinite(*req.BorderlineMargin) || *req.BorderlineMargin < 0 {
+			return p, fmt.Errorf("borderline_margin must not be negative")
+		}
+		p.borderlineMargin = *req.BorderlineMargin
+	}
+	p.force = req.Force
+	p.allowShort = req.AllowShort
+	p.normalizeWhitespace = config.NormalizeWhitespace
+	if req.NormalizeWhitespace != nil {
+		p.normalizeWhitespace = *req.NormalizeWhitespace
+	}
+
+	if req.MaxSentences < 0 {
+		return p, fmt.Errorf("max_sentences must not be negative")
+	}
+	p.maxSentences = req.MaxSentences
+
+	if req.MaxLineInferences < 0 {
+		return p, fmt.Errorf("max_line_inferences must not be negative")
+	}
+	p.maxLineInferences = config.MaxLineInferences
+	if req.MaxLineInferences > 0 && (p.maxLineInferences == 0 || req.MaxLineInferences < p.maxLineInferences) {
+		p.maxLineInferences = req.MaxLineInferences
+	}
+
+	switch req.Sort {
+	case "", "document":
+		p.sort = "document"
+	case "perplexity_asc", "confidence_desc":
+		p.sort = req.Sort
+	default:
+		return p, fmt.Errorf("unknown sort %q", req.Sort)
+	}
+
+	p.perSentence = req.PerSentence == nil || *req.PerSentence
+	p.contextual = req.Contextual
+	p.weighted = config.WeightByTokens
+	if req.WeightByTokens != nil {
+		p.weighted = *req.WeightByTokens
+	}
+	if !p.perSentence && (req.Histogram || req.CI) {
+		return p, fmt.Errorf("histogram and ci need per_sentence")
+	}
+
+	if req.Perturbations != 0 && (req.Perturbations < minPerturbations || req.Perturbations > maxPerturbations) {
+		return p, fmt.Errorf("perturbations must be between %d and %d, or 0 for the server default", minPerturbations, maxPerturbations)
+	}
+	if req.Perturbations > 0 {
+		p.perturbations = req.Perturbations
+	}
+
+	if req.MinChars != nil {
+		if *req.MinChars < 0 {
+			return p, fmt.Errorf("min_chars must not be negative")
+		}
+		p.minChars = *req.MinChars
+	}
+
+	if req.Temperature != nil {
+		if !isFinite(*req.Temperature) || *req.Temperature <= 0 {
+			return p, fmt.Errorf("temperature must be greater than 0")
+		}
+		p.score.temperature = *req.Temperature
+	}
+
+	if req.MaxInferenceMS < 0 {
+		return p, fmt.Errorf("max_inference_ms must not be negative")
+	}
+	p.score.deadline = inferenceDeadline(req.MaxInferenceMS)
+	if p.score.sampleRate, err = validateSampleRate(req.SampleRate); err != nil {
+		return p, err
+	}
+	if p.score.stride, err = resolveStride(req.NonOverlapping, req.StrideFraction, config.Model.MaxLength); err != nil {
+		return p, err
+	}
+	p.score.truncate = req.Truncate
+	p.windowInfo = req.WindowInfo
+	if p.charRange, err = validateRange(req); err != nil {
+		return p, err
+	}
+
+	if req.TopK < 0 || req.TopK > config.MaxTopK {
+		return p, fmt.Errorf("topk must be between 0 and %d", config.MaxTopK)
+	}
+	if req.TopK > 0 || req.Entropy || req.LogRank {
+		p.score.stats = &tokenStats{
+			topK:         req.TopK,
+			maxPositions: config.MaxTopKPositions,
+			entropy:      req.Entropy,
+			logRank:      req.LogRank,
+		}
+	}
+
+	p.documentPerplexity = req.DocumentPerplexity == nil || *req.DocumentPerplexity
+	if !p.documentPerplexity {
+		switch {
+		case req.Method == "detectgpt":
+			return p, fmt.Errorf("document_perplexity is not supported with method detectgpt")
+		case !p.perSentence:
+			return p, fmt.Errorf("document_perplexity=false needs per_sentence")
+		case req.Contextual, req.CI, req.WindowInfo, p.score.stats != nil:
+			return p, fmt.Errorf("contextual, ci, window_info, topk, entropy and log_rank need document_perplexity")
+		}
+	}
+
+	switch req.Segmentation {
+	case "", "sentence":
+		p.segmentation = "sentence"
+	case "paragraph", "window":
+		p.segmentation = req.Segmentation
+	default:
+		return p, fmt.Errorf("unknown segmentation %q", req.Segmentation)
+	}
+	if req.SegmentTokens < 0 || req.SegmentTokens > config.Model.MaxLength {
+		return p, fmt.Errorf("segment_tokens must be between 0 and %d", config.Model.MaxLength)
+	}
+	p.segmentTokens = req.SegmentTokens
+	if p.segmentTokens == 0 {
+		p.segmentTokens = defaultSegmentTokens
+	}
+
+	if p.rolling, err = validateRolling(req.Rolling, config.Model.MaxLength); err != nil {
+		return p, err
+	}
+
+	if err := validateHistogram(req.HistogramBuckets, req.HistogramEdges); err != nil {
+		return p, err
+	}
+	p.histogram = req.Histogram
+	p.histogramBuckets = req.HistogramBuckets
+	if p.histogramBuckets == 0 {
+		p.histogramBuckets = defaultHistogramBuckets
+	}
+	p.histogramEdges = req.HistogramEdges
+
+	if !isFinite(req.CILevel) || req.CILevel < 0 || req.CILevel >= 1 {
+		return p, fmt.Errorf("ci_level must be between 0 and 1")
+	}
+	p.ci = req.CI
+	p.ciLevel = req.CILevel
+	if p.ciLevel == 0 {
+		p.ciLevel = defaultCILevel
+	}
+
+	return p, nil
+}
+
+// validateSampleRate checks a request's sample_rate, where 0 means the
+// default of 1 (every window scored).
+func validateSampleRate(rate float64) (float64, error) {
+	if !isFinite(rate) || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("sample_rate must be between 0 and 1")
+	}
+	if rate == 0 {
+		return 1, nil
+	}
+	return rate, nil
+}
+
+// resolveStride returns the window stride a request asks for, through
+// non_overlapping or stride_fraction, or 0 to use the model's STRIDE.
+func resolveStride(nonOverlapping bool, fraction *float64, maxLength int) (int, error) {
+	if fraction == nil {
+		if nonOverlapping {
+			return maxLength, nil
+		}
+		return 0, nil
+	}
+	if nonOverlapping {
+		return 0, fmt.Errorf("stride_fraction can't be combined with non_overlapping")
+	}
+	f := *fraction
+	if !isFinite(f) || f < 0 || f >= 1 {
+		return 0, fmt.Errorf("stride_fraction must be at least 0 and less than 1")
+	}
+	stride := int(math.Round((1 - f) * float64(maxLength)))
+	if stride < 1 {
+		return 0, fmt.Errorf("stride_fraction %g leaves a stride of less than one token", f)
+	}
+	return stride, nil
+}
+
+// inferenceDeadline returns when a request starting now must stop adding
+// windows, given its max_inference_ms (0 uses MAX_INFERENCE_MS). The zero
+// time means no budget.
+func inferenceDeadline(requestMS int) time.Time {
+	ms := requestMS
+	if ms == 0 {
+		ms = config.MaxInferenceMS
+	}
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(ms) * time.Millisecond)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"isgpt-server/api"
+)
+
+func TestResolveParamsPerturbations(t *testing.T) {
+	for _, tc := range []struct {
+		perturbations int
+		ok            bool
+	}{
+		{0, true}, // Server default
+		{1, false},
+		{2, true},
+		{maxPerturbations, true},
+		{maxPerturbations + 1, false},
+		{-1, false},
+	} {
+		_, err := resolveParams(InferenceRequest{Sentence: "text", InferOptions: api.InferOptions{Perturbations: tc.perturbations}}, "")
+		if (err == nil) != tc.ok {
+			t.Errorf("perturbations %d: err = %v, want ok %v", tc.perturbations, err, tc.ok)
+		}
+	}
+}
+
+func TestResolveStride(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	for _, tc := range []struct {
+		name           string
+		nonOverlapping bool
+		fraction       *float64
+		maxLength      int
+		want           int
+		ok             bool
+	}{
+		{"model default", false, nil, 1024, 0, true},
+		{"non_overlapping", true, nil, 1024, 1024, true},
+		{"no overlap", false, f(0), 1024, 1024, true},
+		{"half overlap", false, f(0.5), 1024, 512, true},
+		{"rounded", false, f(0.3), 10, 7, true},
+		{"just under 1 on a long window", false, f(0.999), 1024, 1, true},
+		{"just under 1 rounds to no stride", false, f(0.999), 100, 0, false},
+		{"just under 1", false, f(math.Nextafter(1, 0)), 1024, 0, false},
+		{"a stride of half a token rounds up", false, f(0.95), 10, 1, true},
+		{"below half a token", false, f(0.96), 10, 0, false},
+		{"1", false, f(1), 1024, 0, false},
+		{"negative", false, f(-0.1), 1024, 0, false},
+		{"NaN", false, f(math.NaN()), 1024, 0, false},
+		{"with non_overlapping", true, f(0.5), 1024, 0, false},
+	} {
+		got, err := resolveStride(tc.nonOverlapping, tc.fraction, tc.maxLength)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("%s: resolveStride = %d, %v; want %d, ok %v", tc.name, got, err, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// defaultPlainTemplate is the plain-text /infer response: one
+// "Sentence <Label, confidence%>" line per sentence, a blank line, then the
+// verdict.
+const defaultPlainTemplate = `{{range .Sentences}}{{.Text}} <{{label .}}, {{printf "%.0f" .Confidence}}%>
+{{end}}
+{{.Message}}
+`
+
+// plainTemplate renders non-verbose /infer responses. It is executed with
+// the InferenceResponse.
+var plainTemplate = template.Must(parsePlainTemplate(defaultPlainTemplate))
+
+// parsePlainTemplate parses a PLAIN_TEMPLATE. Besides the text/template
+// builtins it can call label, which gives a sentence's verdict as "AI",
+// "Human" or "Uncertain".
+func parsePlainTemplate(text string) (*template.Template, error) {
+	return template.New("plain").Funcs(template.FuncMap{"label": sentenceLabel}).Parse(text)
+}
+
+// resultLine summarizes resp as one machine-readable line for the end of
+// plain-text output, e.g. "#RESULT label=1 confidence=87.5 perplexity=92.3
+// uncertain=false". Fields without a value are left out, so a text that got
+// no verdict reads "#RESULT label=none".
+func resultLine(resp *InferenceResponse) string {
+	fields := []string{"#RESULT"}
+	if resp.Label == nil {
+		fields = append(fields, "label=none")
+	} else {
+		fields = append(fields, fmt.Sprintf("label=%d", *resp.Label))
+	}
+	if resp.Confidence != nil {
+		fields = append(fields, fmt.Sprintf("confidence=%.1f", *resp.Confidence))
+	}
+	if resp.Perplexity != nil {
+		fields = append(fields, fmt.Sprintf("perplexity=%.1f", *resp.Perplexity))
+	}
+	if resp.Label != nil {
+		fields = append(fields, fmt.Sprintf("uncertain=%t", resp.IsUncertain))
+	}
+	return strings.Join(fields, " ") + "\n"
+}
+
+// sentenceLabel names a sentence's verdict for plain-text output.
+func sentenceLabel(sent SentenceDetail) string {
+	switch {
+	case sent.IsUncertain:
+		return "Uncertain"
+	case sent.Label == 1:
+		return "Human"
+	default:
+		return "AI"
+	}
+}
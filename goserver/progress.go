@@ -0,0 +1,71 @@
+package main
+
+import "sync/atomic"
+
+// progress counts the scoring passes of one analysis, for GET /jobs/{id}.
+// Infer plans every pass before scoring starts, and windows advance it as
+// they finish. A nil *progress counts nothing.
+type progress struct {
+	done, total atomic.Int64
+}
+
+// plan adds n passes still to come.
+func (p *progress) plan(n int) {
+	if p != nil {
+		p.total.Add(int64(n))
+	}
+}
+
+// advance records that n passes finished.
+func (p *progress) advance(n int) {
+	if p != nil {
+		p.done.Add(int64(n))
+	}
+}
+
+// counts returns the passes finished and planned so far.
+func (p *progress) counts() (done, total int) {
+	return int(p.done.Load()), int(p.total.Load())
+}
+
+// windowCount returns how many windows getPPLIDs scores over ids, if the
+// budget lets it finish.
+func (m *GPT2Model) windowCount(ids []uint32, opts scoreOptions) int {
+	if opts.truncate && len(ids) > m.maxLength {
+		ids = ids[:m.maxLength]
+	}
+	stride := m.strideFor(opts)
+	n := 0
+	for _, seg := range m.splitAtEOS(ids) {
+		if len(seg.ids) < 2 {
+			continue
+		}
+		for k, beginLoc := 0, 0; beginLoc < len(seg.ids); k, beginLoc = k+1, beginLoc+stride {
+			if opts.sampleWindow(k) {
+				n++
+			}
+			if beginLoc+m.maxLength >= len(seg.ids) {
+				break
+			}
+		}
+	}
+	return n
+}
+
+// linePasses returns how many passes getPPLBatch takes to score chunks of
+// ids: one for each chunk that fits a batch row, and its windows for each
+// one that doesn't. Chunks of fewer than two tokens aren't scored at all.
+func (m *GPT2Model) linePasses(chunks []sentenceChunk, ids []uint32, opts scoreOptions) int {
+	n := 0
+	for _, c := range chunks {
+		seq := ids[c.start:c.end]
+		switch {
+		case len(seq) < 2:
+		case len(seq) > m.maxLength || m.containsEOS(seq):
+			n += m.windowCount(seq, opts)
+		default:
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// Progress planned with linePasses must reach 100% once getPPLBatch has
+// scored the chunks, including one-token chunks it skips and a chunk too
+// long for a batch row.
+func TestLinePassesMatchesBatch(t *testing.T) {
+	m, _ := newTestModel(t, 8, 8)
+	ids := []uint32{1, 2, 3, 4, 5, 6, 5, 4, 3, 2, 1, 0, 1, 2, 3, 4, 5}
+	chunks := []sentenceChunk{
+		{start: 0, end: 1},   // One token: nothing to score
+		{start: 1, end: 4},   // A batch row
+		{start: 4, end: 4},   // Empty
+		{start: 4, end: 17},  // Longer than max_length: its own windows
+		{start: 16, end: 17}, // One token again
+	}
+
+	var p progress
+	opts := defaultScoreOptions
+	opts.progress = &p
+	p.plan(m.linePasses(chunks, ids, opts))
+
+	seqs := make([][]uint32, len(chunks))
+	for i, c := range chunks {
+		seqs[i] = ids[c.start:c.end]
+	}
+	m.getPPLBatch(context.Background(), seqs, opts)
+
+	done, total := p.counts()
+	if want := 1 + m.windowCount(ids[4:17], opts); total != want {
+		t.Errorf("planned %d passes, want %d", total, want)
+	}
+	if done != total {
+		t.Errorf("progress stuck at %d of %d passes", done, total)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// inferenceCheckInterval is how often a tiny inference is run in the
+// background to prove the loaded model actually works, not just that it
+// loaded. It is skipped while real inferences keep proving it.
+const inferenceCheckInterval = 30 * time.Second
+
+// inferenceStaleAfter is how long the model may go without a successful
+// inference before /readyz stops trusting it, as when the session hangs.
+const inferenceStaleAfter = 3 * inferenceCheckInterval
+
+// inferenceHealth is the outcome of the model's recent inferences, real ones
+// and background checks alike. /readyz only reads it, so a probe never waits
+// behind inferences holding the model's lock.
+var inferenceHealth struct {
+	mu     sync.Mutex
+	model  *GPT2Model // Model the outcome applies to
+	passed time.Time  // Last successful forward pass
+	err    error      // Why the last check failed, until a pass clears it
+}
+
+// recordInference notes a successful forward pass of m.
+func recordInference(m *GPT2Model) {
+	h := &inferenceHealth
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.model, h.passed, h.err = m, time.Now(), nil
+}
+
+// inferenceError returns why m can't be trusted to serve: its last check
+// failed, or nothing has run successfully for inferenceStaleAfter.
+func inferenceError(m *GPT2Model) error {
+	h := &inferenceHealth
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.model != m {
+		return fmt.Errorf("no successful inference yet")
+	}
+	if h.err != nil {
+		return h.err
+	}
+	if since := time.Since(h.passed); since > inferenceStaleAfter {
+		return fmt.Errorf("no successful inference for %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+// checkInference scores warmupText with m unless an inference has passed
+// within inferenceCheckInterval, recording why it failed if it did.
+func checkInference(ctx context.Context, m *GPT2Model) {
+	h := &inferenceHealth
+	h.mu.Lock()
+	recent := h.model == m && h.err == nil && time.Since(h.passed) < inferenceCheckInterval
+	h.mu.Unlock()
+	if recent {
+		return
+	}
+
+	result, err := m.getPPL(ctx, warmupText, defaultScoreOptions)
+	if err == nil && !isFinite(result.Perplexity) {
+		err = fmt.Errorf("inference returned non-finite perplexity %v", result.Perplexity)
+	}
+	if err != nil {
+		slog.Error("inference check failed", "error", err)
+		h.mu.Lock()
+		h.model, h.err = m, err
+		h.mu.Unlock()
+	}
+}
+
+// startInferenceChecks checks the ready model every inferenceCheckInterval
+// in the background.
+func startInferenceChecks() {
+	go func() {
+		for range time.Tick(inferenceCheckInterval) {
+			if m := model.Load(); m != nil && modelReady.Load() {
+				checkInference(context.Background(), m)
+			}
+		}
+	}()
+}
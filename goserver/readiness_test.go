@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveModel makes m the ready model until the test ends.
+func serveModel(t *testing.T, m *GPT2Model) {
+	t.Helper()
+	model.Store(m)
+	modelReady.Store(true)
+	t.Cleanup(func() {
+		model.Store(nil)
+		modelReady.Store(false)
+	})
+}
+
+func readyzStatus() int {
+	w := httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	return w.Code
+}
+
+func TestReadyzFollowsInferences(t *testing.T) {
+	m, runner := newTestModel(t, 64, 64)
+	serveModel(t, m)
+	if code := readyzStatus(); code != http.StatusServiceUnavailable {
+		t.Errorf("before any inference: status %d, want 503", code)
+	}
+
+	// Any successful inference, such as the warmup, counts as a pass
+	if _, err := m.getPPL(context.Background(), warmupText, defaultScoreOptions); err != nil {
+		t.Fatal(err)
+	}
+	if code := readyzStatus(); code != http.StatusOK {
+		t.Errorf("after an inference: status %d, want 200", code)
+	}
+
+	// A recent pass spares the check its inference
+	runs := len(runner.runs)
+	checkInference(context.Background(), m)
+	if len(runner.runs) != runs {
+		t.Errorf("check ran %d inferences after a recent pass, want none", len(runner.runs)-runs)
+	}
+
+	// A failing check makes the model unready until an inference succeeds
+	inferenceHealth.passed = time.Now().Add(-inferenceCheckInterval)
+	runner.err = errors.New("session broke")
+	checkInference(context.Background(), m)
+	if code := readyzStatus(); code != http.StatusServiceUnavailable {
+		t.Errorf("after a failed check: status %d, want 503", code)
+	}
+	runner.err = nil
+	checkInference(context.Background(), m)
+	if code := readyzStatus(); code != http.StatusOK {
+		t.Errorf("after the model recovered: status %d, want 200", code)
+	}
+
+	// A model that has done nothing for too long isn't trusted either
+	inferenceHealth.passed = time.Now().Add(-inferenceStaleAfter - time.Second)
+	if code := readyzStatus(); code != http.StatusServiceUnavailable {
+		t.Errorf("after a long silence: status %d, want 503", code)
+	}
+}
+
+// /readyz answers from the recorded outcome while inferences hold the
+// model's lock.
+func TestReadyzDoesNotBlock(t *testing.T) {
+	m, _ := newTestModel(t, 64, 64)
+	serveModel(t, m)
+	recordInference(m)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	done := make(chan int)
+	go func() { done <- readyzStatus() }()
+	select {
+	case code := <-done:
+		if code != http.StatusOK {
+			t.Errorf("status %d, want 200", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("/readyz blocked behind the model lock")
+	}
+}
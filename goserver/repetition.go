@@ -0,0 +1,30 @@
+package main
+
+// repetitionN is the length, in tokens, of the n-grams repetition counts.
+// Four tokens is long enough that natural text rarely repeats one by chance
+// outside of names and set phrases.
+const repetitionN = 4
+
+// repetition returns the fraction of the n-grams of ids that repeat an
+// earlier one: near 0 for ordinary prose, approaching 1 for text stuck in
+// a loop or pasted over and over. Such text scores a very low perplexity
+// whoever wrote it, as each repeat is easy to predict from the last. It
+// returns nil if ids is too short to have any n-grams.
+func repetition(ids []uint32) *float64 {
+	total := len(ids) - repetitionN + 1
+	if total <= 0 {
+		return nil
+	}
+	seen := make(map[[repetitionN]uint32]bool, total)
+	repeated := 0
+	for i := 0; i < total; i++ {
+		var gram [repetitionN]uint32
+		copy(gram[:], ids[i:i+repetitionN])
+		if seen[gram] {
+			repeated++
+		}
+		seen[gram] = true
+	}
+	r := float64(repeated) / float64(total)
+	return &r
+}
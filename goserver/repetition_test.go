@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"isgpt-server/api"
+)
+
+func TestRepetition(t *testing.T) {
+	for n := 0; n < repetitionN; n++ {
+		if r := repetition(make([]uint32, n)); r != nil {
+			t.Errorf("repetition of %d tokens = %v, want nil", n, *r)
+		}
+	}
+	if r := repetition([]uint32{1, 2, 3, 4}); r == nil || *r != 0 {
+		t.Errorf("repetition of one n-gram = %v, want 0", r)
+	}
+	if r := repetition([]uint32{1, 2, 3, 4, 5, 1, 2, 3, 4}); r == nil || *r != 1.0/6 {
+		t.Errorf("repetition with one repeat in 6 n-grams = %v, want 1/6", r)
+	}
+
+	// A loop repeats every n-gram after its first pass, approaching 1
+	loop := []uint32{1, 2, 3, 4, 5}
+	var ids []uint32
+	last := 0.0
+	for i := 0; i < 200; i++ {
+		ids = append(ids, loop...)
+		r := repetition(ids)
+		if r == nil || *r < last || *r >= 1 {
+			t.Fatalf("repetition of %d loops = %v, want rising toward 1 from %v", i+1, r, last)
+		}
+		last = *r
+	}
+	if last < 0.99 {
+		t.Errorf("repetition of 200 loops = %v, want near 1", last)
+	}
+}
+
+// high_repetition is set from REPETITION_THRESHOLD itself upward.
+func TestInferHighRepetition(t *testing.T) {
+	saved := config.RepetitionThreshold
+	defer func() { config.RepetitionThreshold = saved }()
+
+	m, _ := newTestModel(t, 64, 64)
+	text := fakeText([]uint32{1, 2, 3, 4, 5, 1, 2, 3, 4}) // Repetition 1/6
+	for _, tc := range []struct {
+		threshold float64
+		want      bool
+	}{
+		{0.1, true},
+		{1.0 / 6, true},
+		{math.Nextafter(1.0/6, 1), false},
+		{0.5, false},
+	} {
+		config.RepetitionThreshold = tc.threshold
+		response, err := m.Infer(context.Background(), text, testParams(t, text, api.InferOptions{AllowShort: true}), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Repetition == nil || *response.Repetition != 1.0/6 {
+			t.Fatalf("repetition = %v, want 1/6", response.Repetition)
+		}
+		if response.HighRepetition != tc.want {
+			t.Errorf("threshold %v: high_repetition = %v, want %v", tc.threshold, response.HighRepetition, tc.want)
+		}
+	}
+}
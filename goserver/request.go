@@ -0,0 +1,183 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// decodeRequest reads a request into v, answering the request itself and
+// returning false if it can't. A JSON body is decoded into v. A text/plain
+// body is stored in *text instead, with the other fields of v taken from the
+// query string (see queryToJSON); this lets clients stream large files
+// without wrapping them in JSON.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}, text *string) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "text/plain" {
+		return decodeJSON(w, r, v)
+	}
+
+	if len(r.URL.RawQuery) > 0 {
+		if err := json.Unmarshal(queryToJSON(r.URL.Query()), v); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid query parameters: %v", err), http.StatusBadRequest)
+			return false
+		}
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return false
+	}
+	*text = string(body)
+	return true
+}
+
+// wantsJSON reports whether the response to r should be JSON rather than
+// plain text, going by whichever of application/json and text/plain its
+// Accept header prefers (by q-value). When Accept names neither, or both
+// equally, the request's verbose flag decides.
+func wantsJSON(r *http.Request, verbose bool) bool {
+	jsonQ, textQ := -1.0, -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue // Explicitly not acceptable
+		}
+		switch mediaType {
+		case "application/json":
+			jsonQ = math.Max(jsonQ, q)
+		case "text/plain":
+			textQ = math.Max(textQ, q)
+		}
+	}
+	if jsonQ == textQ {
+		return verbose
+	}
+	return jsonQ > textQ
+}
+
+// queryToJSON turns query parameters into a JSON object, so they decode into
+// the same request structs as a JSON body. Values that are valid JSON, such
+// as numbers, booleans and arrays, are used as they are; anything else is
+// taken as a string. Only the first value of each parameter counts.
+func queryToJSON(query url.Values) []byte {
+	obj := make(map[string]json.RawMessage, len(query))
+	for key, values := range query {
+		v := values[0]
+		if json.Valid([]byte(v)) {
+			obj[key] = json.RawMessage(v)
+		} else {
+			obj[key], _ = json.Marshal(v)
+		}
+	}
+	data, _ := json.Marshal(obj)
+	return data
+}
+
+// decodeJSON reads the JSON request body into v, answering the request itself
+// and returning false if it can't.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, ok := readBody(w, r)
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// readBody reads the request body, answering the request itself and
+// returning false if it can't. Bodies are read up to MAX_DECOMPRESSED_BYTES,
+// so neither a huge upload nor a small zip bomb can exhaust memory; a body
+// sent with Content-Encoding: gzip is held to it both before and after it
+// is decompressed. Bodies that aren't valid UTF-8 are rejected
+// with an invalid_encoding error, or repaired by replacing each invalid
+// sequence with U+FFFD when INVALID_UTF8=repair. Without this check the JSON
+// decoder would repair them silently.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	var body []byte
+	var err error
+	var tooLarge *http.MaxBytesError
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxDecompressedBytes)
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		body, err = io.ReadAll(r.Body)
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return nil, false
+		}
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err == nil {
+			body, err = io.ReadAll(io.LimitReader(zr, config.MaxDecompressedBytes+1))
+		}
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Malformed gzip request body: %v", err), http.StatusBadRequest)
+			return nil, false
+		}
+		if int64(len(body)) > config.MaxDecompressedBytes {
+			http.Error(w, fmt.Sprintf("Decompressed request body exceeds %d bytes", config.MaxDecompressedBytes), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported Content-Encoding %q", enc), http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+
+	if offset := invalidUTF8Offset(body); offset >= 0 {
+		if config.InvalidUTF8 != "repair" {
+			// JSON, like writeJSONError, so clients can read the offset
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]any{
+				"error":      "invalid_encoding",
+				"message":    fmt.Sprintf("request body is not valid UTF-8 (invalid byte at offset %d)", offset),
+				"offset":     offset,
+				"request_id": requestIDFromContext(r.Context()),
+			})
+			return nil, false
+		}
+		body = []byte(strings.ToValidUTF8(string(body), "\uFFFD"))
+	}
+	return body, true
+}
+
+// invalidUTF8Offset returns the byte offset of the first invalid UTF-8
+// sequence in b, or -1 if b is valid.
+func invalidUTF8Offset(b []byte) int {
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size == 1 {
+			return i
+		}
+		i += size
+	}
+	return -1
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestReadBodyLimit checks bodies over MAX_DECOMPRESSED_BYTES get 413 whether
+// they arrive as they are or gzipped.
+func TestReadBodyLimit(t *testing.T) {
+	old := config.MaxDecompressedBytes
+	config.MaxDecompressedBytes = 256
+	t.Cleanup(func() { config.MaxDecompressedBytes = old })
+
+	small := strings.Repeat("a", 256)
+	large := strings.Repeat("a", 257)
+	for _, tc := range []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     int
+	}{
+		{"identity at the limit", "", []byte(small), http.StatusOK},
+		{"identity over the limit", "", []byte(large), http.StatusRequestEntityTooLarge},
+		{"explicit identity over the limit", "identity", []byte(large), http.StatusRequestEntityTooLarge},
+		{"gzip at the limit", "gzip", gzipped(t, small), http.StatusOK},
+		{"gzip decompressing over the limit", "gzip", gzipped(t, strings.Repeat("a", 10000)), http.StatusRequestEntityTooLarge},
+		{"gzip over the limit as sent", "gzip", bytes.Repeat(gzipped(t, ""), 20), http.StatusRequestEntityTooLarge},
+		{"malformed gzip", "gzip", []byte("not gzip"), http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/infer", bytes.NewReader(tc.body))
+			if tc.encoding != "" {
+				r.Header.Set("Content-Encoding", tc.encoding)
+			}
+			w := httptest.NewRecorder()
+			body, ok := readBody(w, r)
+			if ok != (tc.want == http.StatusOK) || w.Code != tc.want {
+				t.Fatalf("readBody = %v, status %d (%s); want status %d", ok, w.Code, strings.TrimSpace(w.Body.String()), tc.want)
+			}
+			if ok && string(body) != small {
+				t.Errorf("body = %q, want %q", body, small)
+			}
+		})
+	}
+}
+
+func TestReadBodyInvalidUTF8(t *testing.T) {
+	old := config
+	t.Cleanup(func() { config = old })
+	config.MaxDecompressedBytes = 1 << 20
+	body := []byte("caf\xe9 au lait")
+
+	config.InvalidUTF8 = "reject"
+	r := httptest.NewRequest(http.MethodPost, "/infer", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	if _, ok := readBody(w, r); ok || w.Code != http.StatusBadRequest {
+		t.Fatalf("reject: readBody = %v, status %d; want false, 400", ok, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("reject: Content-Type = %q, want application/json", ct)
+	}
+	var got struct {
+		Error  string `json:"error"`
+		Offset int    `json:"offset"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("reject: body %q is not JSON: %v", w.Body, err)
+	}
+	if got.Error != "invalid_encoding" || got.Offset != 3 {
+		t.Errorf("reject: error %q at offset %d, want invalid_encoding at 3", got.Error, got.Offset)
+	}
+
+	config.InvalidUTF8 = "repair"
+	r = httptest.NewRequest(http.MethodPost, "/infer", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	repaired, ok := readBody(w, r)
+	if !ok {
+		t.Fatalf("repair: readBody failed with %d: %s", w.Code, w.Body)
+	}
+	if want := "caf� au lait"; string(repaired) != want {
+		t.Errorf("repair: body = %q, want %q", repaired, want)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/daulet/tokenizers"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// rollingParams select the token windows of a rolling perplexity track.
+type rollingParams struct {
+	window int // Tokens per window
+	step   int // Tokens between window starts
+}
+
+// validateRolling checks the rolling options of a request against the
+// model's context length.
+func validateRolling(r *RollingOptions, maxLength int) (*rollingParams, error) {
+	if r == nil {
+		return nil, nil
+	}
+	if r.Window < 2 || r.Window > maxLength {
+		return nil, fmt.Errorf("rolling.window must be between 2 and %d", maxLength)
+	}
+	if r.Step < 1 || r.Step > r.Window {
+		return nil, fmt.Errorf("rolling.step must be between 1 and rolling.window")
+	}
+	return &rollingParams{window: r.Window, step: r.Step}, nil
+}
+
+// setRollingChars fills in the character range of each point from the
+// tokenizer's byte offsets. Points keep no range if offsets weren't returned
+// for every token, or a window's offsets are empty.
+func setRollingChars(points []RollingPoint, offsets []tokenizers.Offset, ids int, chars *charOffsets) {
+	if len(offsets) != ids {
+		return
+	}
+	for i := range points {
+		p := &points[i]
+		from, to := int(offsets[p.StartToken][0]), int(offsets[p.EndToken-1][1])
+		if from >= to {
+			continue
+		}
+		start, end := chars.start(from), chars.end(to)
+		p.CharStart, p.CharEnd = &start, &end
+	}
+}
+
+// rollingPerplexity scores ids in windows of p.window tokens starting every
+// p.step tokens, and returns each window's own perplexity rather than an
+// aggregate. Each window is scored without context from before its start, so
+// the points are comparable with each other. Windows run batchSize at a time.
+// Once opts' deadline passes, the remaining windows are dropped and truncated
+// is true.
+func (m *GPT2Model) rollingPerplexity(ctx context.Context, ids []uint32, p rollingParams, opts scoreOptions) (_ []RollingPoint, truncated bool, err error) {
+	ctx, span := tracer.Start(ctx, "rollingPerplexity")
+	defer func() { endSpan(span, err) }()
+
+	if len(ids) < 2 {
+		return nil, false, nil
+	}
+
+	var points []RollingPoint
+	var windows [][]uint32
+	for start := 0; ; start += p.step {
+		end := min(start+p.window, len(ids))
+		points = append(points, RollingPoint{StartToken: start, EndToken: end})
+		windows = append(windows, ids[start:end])
+		if end == len(ids) {
+			break
+		}
+	}
+	span.SetAttributes(attribute.Int("windows", len(windows)))
+
+	for i := 0; i < len(windows); i += m.batchSize {
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
+		if i > 0 && opts.pastDeadline() {
+			points = points[:i]
+			truncated = true
+			break
+		}
+
+		batch := windows[i:min(i+m.batchSize, len(windows))]
+		logits, padLen, err := m.runBatchPadded(batch, 0)
+		if err != nil {
+			return nil, false, err
+		}
+
+		rowSize := padLen * m.vocabSize
+		for b, seq := range batch {
+			if len(seq) < 2 {
+				// A trailing single token has nothing to predict it
+				points[i+b].Perplexity = math.NaN()
+				continue
+			}
+			rowLogits := logits[b*rowSize : (b+1)*rowSize]
+			nll := m.calculateNLL(rowLogits, seq[1:], m.vocabSize, 0, len(seq)-1, opts)
+			points[i+b].Perplexity = math.Exp(nll / float64(len(seq)-1))
+		}
+	}
+
+	// Drop points that can't be encoded as JSON numbers
+	valid := points[:0]
+	for _, pt := range points {
+		if isFinite(pt.Perplexity) {
+			valid = append(valid, pt)
+		}
+	}
+	return valid, truncated, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/daulet/tokenizers"
+)
+
+// sentenceRe matches the break between two sentences: end punctuation and
+// the whitespace after it (plus an opening bracket), or a newline.
+var sentenceRe = regexp.MustCompile(`(?:[.?!]\s+[\[\(]?)|(?:\n\s*)`)
+
+// paragraphRe matches the blank line between two paragraphs.
+var paragraphRe = regexp.MustCompile(`\n[^\S\n]*\n\s*`)
+
+const defaultSegmentTokens = 128 // Window size for segmentation=window
+
+// segmentText divides text into the lines of per-line analysis, using the
+// request's segmentation: sentences (the default), paragraphs, or fixed
+// windows of the token stream.
+func segmentText(text string, offsets []tokenizers.Offset, p inferParams) []sentenceSpan {
+	switch p.segmentation {
+	case "paragraph":
+		return splitSentences(text, offsets, paragraphRe)
+	case "window":
+		return splitWindows(text, offsets, p.segmentTokens)
+	default:
+		return splitSentences(text, offsets, sentenceRe)
+	}
+}
+
+// sentenceSpan is one sentence of a document: its trimmed text, the bytes
+// [from, to) of the document it was taken from, and the tokens [start, end)
+// of the document's encoding that belong to it.
+type sentenceSpan struct {
+	text       string
+	from, to   int
+	start, end int
+}
+
+// splitSentences splits text into sentences at each match of breakRe,
+// dropping those without any alphanumeric characters, and maps each to a
+// range of the document's encoding, whose byte offsets are given. The ranges
+// partition the whole encoding: a token belongs to the last sentence starting
+// before the token ends, so end punctuation stays with the sentence it closes
+// and the tokens of dropped lines join the sentence before them.
+func splitSentences(text string, offsets []tokenizers.Offset, breakRe *regexp.Regexp) []sentenceSpan {
+	var spans []sentenceSpan
+
+	prev := 0
+	breaks := append(breakRe.FindAllStringIndex(text, -1), []int{len(text), len(text)})
+	for _, b := range breaks {
+		line := text[prev:b[0]]
+		lineStart := prev
+		prev = b[1]
+		if !alphanumRe.MatchString(line) {
+			continue
+		}
+		lead := len(line) - len(strings.TrimLeftFunc(line, unicode.IsSpace))
+		trimmed := strings.TrimSpace(line)
+		spans = append(spans, sentenceSpan{text: trimmed, from: lineStart + lead, to: lineStart + lead + len(trimmed)})
+	}
+
+	tok := 0
+	for i := range spans {
+		if i > 0 {
+			for tok < len(offsets) && int(offsets[tok][1]) <= spans[i].from {
+				tok++
+			}
+			spans[i-1].end = tok
+		}
+		spans[i].start = tok
+	}
+	if len(spans) > 0 {
+		spans[0].start = 0
+		spans[len(spans)-1].end = len(offsets)
+	}
+	return spans
+}
+
+// splitWindows splits the document's encoding into windows of size tokens,
+// each with the text its tokens cover. Windows without any alphanumeric
+// characters are dropped.
+func splitWindows(text string, offsets []tokenizers.Offset, size int) []sentenceSpan {
+	var spans []sentenceSpan
+	for start := 0; start < len(offsets); start += size {
+		end := min(start+size, len(offsets))
+		from, to := int(offsets[start][0]), int(offsets[end-1][1])
+		if from >= to || to > len(text) {
+			continue
+		}
+		line := text[from:to]
+		if !alphanumRe.MatchString(line) {
+			continue
+		}
+		lead := len(line) - len(strings.TrimLeftFunc(line, unicode.IsSpace))
+		trimmed := strings.TrimSpace(line)
+		spans = append(spans, sentenceSpan{text: trimmed, from: from + lead, to: from + lead + len(trimmed), start: start, end: end})
+	}
+	return spans
+}
+
+// capChunks merges runs of consecutive chunks so that at most n remain,
+// each covering about the same number of the original chunks, and reports
+// whether it had to. n <= 0 means no cap.
+func capChunks(chunks []sentenceChunk, n int) ([]sentenceChunk, bool) {
+	if n <= 0 || len(chunks) <= n {
+		return chunks, false
+	}
+	merged := make([]sentenceChunk, 0, n)
+	for g := 0; g < n; g++ {
+		group := chunks[g*len(chunks)/n : (g+1)*len(chunks)/n]
+		c := sentenceChunk{start: group[0].start, end: group[len(group)-1].end}
+		texts := make([]string, 0, len(group))
+		for _, part := range group {
+			c.sentences = append(c.sentences, part.sentences...)
+			texts = append(texts, part.text)
+		}
+		c.text = strings.Join(texts, " ")
+		merged = append(merged, c)
+	}
+	return merged, true
+}
+
+// charOffsets converts byte offsets into text to character (Unicode code
+// point) offsets. If text was cleaned by cleanText, origin maps the cleaned
+// offsets that start and end take back to text first. Calls with increasing
+// offsets, the usual order, only count the bytes between them.
+type charOffsets struct {
+	text       string
+	origin     *textMap
+	byte, char int
+}
+
+// start returns the character offset of a range starting at byte b.
+func (c *charOffsets) start(b int) int {
+	return c.at(c.origin.start(b))
+}
+
+// end returns the character offset of a range ending at byte b.
+func (c *charOffsets) end(b int) int {
+	return c.at(c.origin.end(b))
+}
+
+func (c *charOffsets) at(b int) int {
+	b = min(b, len(c.text))
+	if b < c.byte {
+		c.byte, c.char = 0, 0
+	}
+	c.char += utf8.RuneCountInString(c.text[c.byte:b])
+	c.byte = b
+	return c.char
+}
+
+// sentenceChunk is a run of consecutive sentences scored together, covering
+// tokens [start, end) of the document's encoding.
+type sentenceChunk struct {
+	sentences  []sentenceSpan
+	text       string
+	start, end int
+}
+
+// chunkSentences groups consecutive sentences so that short ones are scored
+// with their neighbors, since a few tokens give no reliable perplexity.
+func chunkSentences(spans []sentenceSpan) []sentenceChunk {
+	var chunks []sentenceChunk
+	var current sentenceChunk
+
+	for _, s := range spans {
+		// If adding this sentence would still be under threshold, add it to current chunk
+		if len(current.sentences) > 0 && s.end-current.start < minTokensPerChunk {
+			current.sentences = append(current.sentences, s)
+			current.text = current.text + " " + s.text
+			current.end = s.end
+			continue
+		}
+
+		// Current chunk meets threshold, save it and start new chunk
+		if len(current.sentences) > 0 {
+			chunks = append(chunks, current)
+		}
+		current = sentenceChunk{sentences: []sentenceSpan{s}, text: s.text, start: s.start, end: s.end}
+	}
+
+	// Add final chunk if not empty
+	if len(current.sentences) > 0 {
+		chunks = append(chunks, current)
+	}
+
+	return chunks
+}
+
+// mostAnomalous returns the n sentences whose perplexity is furthest from the
+// document mean, by absolute z-score, in their original order.
+func mostAnomalous(sentences []SentenceDetail, n int) []SentenceDetail {
+	idx := make([]int, len(sentences))
+	for i := range idx {
+		idx[i] = i
+	}
+	absZ := func(i int) float64 {
+		if sentences[i].ZScore == nil {
+			return 0
+		}
+		return math.Abs(*sentences[i].ZScore)
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return absZ(idx[a]) > absZ(idx[b]) })
+	idx = idx[:n]
+	sort.Ints(idx)
+
+	picked := make([]SentenceDetail, n)
+	for i, j := range idx {
+		picked[i] = sentences[j]
+	}
+	return picked
+}
+
+// sortSentences reorders sentences in place by order, a request's "sort":
+// "perplexity_asc" puts the most AI-like first, "confidence_desc" the most
+// confident verdicts first. Any other order keeps document order. Ties keep
+// document order too; Index still gives each sentence's original position.
+func sortSentences(sentences []SentenceDetail, order string) {
+	switch order {
+	case "perplexity_asc":
+		sort.SliceStable(sentences, func(a, b int) bool { return sentences[a].Perplexity < sentences[b].Perplexity })
+	case "confidence_desc":
+		sort.SliceStable(sentences, func(a, b int) bool { return sentences[a].Confidence > sentences[b].Confidence })
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/daulet/tokenizers"
+)
+
+func TestSplitSentencesCoversEveryToken(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		text    string
+		offsets []tokenizers.Offset
+		want    []string
+		tokens  [][2]int
+	}{
+		{
+			name:    "two sentences",
+			text:    "Hi there. Bye now.",
+			offsets: []tokenizers.Offset{{0, 2}, {2, 8}, {8, 9}, {9, 13}, {13, 17}, {17, 18}},
+			want:    []string{"Hi there", "Bye now."},
+			tokens:  [][2]int{{0, 3}, {3, 6}},
+		},
+		{
+			name:    "dropped line joins the one before",
+			text:    "First line\n!!!\nThird line",
+			offsets: []tokenizers.Offset{{0, 5}, {5, 10}, {10, 11}, {11, 14}, {14, 15}, {15, 20}, {20, 25}},
+			want:    []string{"First line", "Third line"},
+			tokens:  [][2]int{{0, 5}, {5, 7}},
+		},
+		{
+			name:    "leading punctuation goes to the first sentence",
+			text:    "... Start here. End",
+			offsets: []tokenizers.Offset{{0, 3}, {3, 9}, {9, 14}, {14, 15}, {15, 19}},
+			want:    []string{"Start here", "End"},
+			tokens:  [][2]int{{0, 4}, {4, 5}},
+		},
+		{
+			name:    "token across a break",
+			text:    "One.\n\nTwo",
+			offsets: []tokenizers.Offset{{0, 3}, {3, 6}, {6, 9}},
+			want:    []string{"One", "Two"},
+			tokens:  [][2]int{{0, 2}, {2, 3}},
+		},
+		{
+			name:    "one sentence",
+			text:    "no breaks at all",
+			offsets: []tokenizers.Offset{{0, 2}, {2, 9}, {9, 12}, {12, 16}},
+			want:    []string{"no breaks at all"},
+			tokens:  [][2]int{{0, 4}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			spans := splitSentences(tc.text, tc.offsets, sentenceRe)
+			if len(spans) != len(tc.want) {
+				t.Fatalf("got %d sentences %+v, want %q", len(spans), spans, tc.want)
+			}
+			covered := make([]int, len(tc.offsets))
+			for i, s := range spans {
+				if s.text != tc.want[i] {
+					t.Errorf("sentence %d = %q, want %q", i, s.text, tc.want[i])
+				}
+				if got := [2]int{s.start, s.end}; got != tc.tokens[i] {
+					t.Errorf("sentence %d has tokens %v, want %v", i, got, tc.tokens[i])
+				}
+				if tc.text[s.from:s.to] != s.text {
+					t.Errorf("sentence %d: bytes [%d, %d) = %q, want %q", i, s.from, s.to, tc.text[s.from:s.to], s.text)
+				}
+				for tok := s.start; tok < s.end; tok++ {
+					covered[tok]++
+				}
+			}
+			for tok, n := range covered {
+				if n != 1 {
+					t.Errorf("token %d is in %d sentences, want 1 (spans %+v)", tok, n, spans)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitSentencesEmpty(t *testing.T) {
+	if spans := splitSentences("?! ...", []tokenizers.Offset{{0, 2}, {2, 6}}, sentenceRe); len(spans) != 0 {
+		t.Errorf("got %+v, want no sentences", spans)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// requestStat is what /stats keeps of one inference.
+type requestStat struct {
+	at      time.Time
+	latency time.Duration
+	tokens  int
+	verdict string // "ai", "uncertain", "human", "rejected" or "error"
+}
+
+// requestStats is a ring buffer of the most recent inferences, for /stats.
+// Once full, each new entry overwrites the oldest.
+type requestStats struct {
+	mu      sync.Mutex
+	entries []requestStat
+	next    int // Where the next entry goes
+	full    bool
+}
+
+var recentStats requestStats
+
+// record adds the outcome of one Infer call. It does nothing if
+// STATS_MAX_ENTRIES is 0.
+func (s *requestStats) record(result *InferenceResponse, err error, latency time.Duration) {
+	if config.StatsMaxEntries <= 0 {
+		return
+	}
+	stat := requestStat{at: time.Now(), latency: latency}
+	switch {
+	case err != nil:
+		stat.verdict = "error"
+	case result.Label == nil:
+		stat.verdict = "rejected"
+	case result.IsUncertain:
+		stat.verdict = "uncertain"
+	case *result.Label == 0:
+		stat.verdict = "ai"
+	default:
+		stat.verdict = "human"
+	}
+	if result != nil {
+		stat.tokens = result.TokenCount
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries == nil {
+		s.entries = make([]requestStat, config.StatsMaxEntries)
+	}
+	s.entries[s.next] = stat
+	s.next = (s.next + 1) % len(s.entries)
+	s.full = s.full || s.next == 0
+}
+
+// since returns the recorded entries newer than cutoff.
+func (s *requestStats) since(cutoff time.Time) []requestStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.next
+	if s.full {
+		n = len(s.entries)
+	}
+	var recent []requestStat
+	for _, e := range s.entries[:n] {
+		if e.at.After(cutoff) {
+			recent = append(recent, e)
+		}
+	}
+	return recent
+}
+
+// StatsSummary is the response of /stats: the inferences of the last
+// Window, at most STATS_MAX_ENTRIES of them.
+type StatsSummary struct {
+	Window     string         `json:"window"`
+	Requests   int            `json:"requests"`
+	Latency    *LatencyStats  `json:"latency_ms,omitempty"`  // Omitted when there were no requests
+	MeanTokens *float64       `json:"mean_tokens,omitempty"` // Over requests that were tokenized
+	Verdicts   map[string]int `json:"verdicts"`              // Count per ai, uncertain, human, rejected and error
+}
+
+// LatencyStats summarizes request latencies, in milliseconds.
+type LatencyStats struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// summarizeStats summarizes entries, the requests of the last window.
+func summarizeStats(entries []requestStat, window time.Duration) StatsSummary {
+	summary := StatsSummary{
+		Window:   window.String(),
+		Requests: len(entries),
+		Verdicts: map[string]int{"ai": 0, "uncertain": 0, "human": 0, "rejected": 0, "error": 0},
+	}
+	if len(entries) == 0 {
+		return summary
+	}
+
+	latencies := make([]time.Duration, len(entries))
+	var total time.Duration
+	tokens, tokenized := 0, 0
+	for i, e := range entries {
+		latencies[i] = e.latency
+		total += e.latency
+		if e.tokens > 0 {
+			tokens += e.tokens
+			tokenized++
+		}
+		summary.Verdicts[e.verdict]++
+	}
+
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	summary.Latency = &LatencyStats{
+		Mean: ms(total) / float64(len(entries)),
+		P50:  ms(latencyPercentile(latencies, 50)),
+		P90:  ms(latencyPercentile(latencies, 90)),
+		P99:  ms(latencyPercentile(latencies, 99)),
+		Max:  ms(latencies[len(latencies)-1]),
+	}
+	if tokenized > 0 {
+		mean := float64(tokens) / float64(tokenized)
+		summary.MeanTokens = &mean
+	}
+	return summary
+}
+
+// statsHandler reports how recent inferences went: how many, how fast, how
+// long the texts were and how they were classified. It is meant as a quick
+// look for small deployments; it keeps only the last STATS_MAX_ENTRIES
+// requests.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed - use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if config.StatsMaxEntries <= 0 {
+		http.Error(w, "Stats are disabled (STATS_MAX_ENTRIES=0)", http.StatusNotFound)
+		return
+	}
+	window := config.StatsWindow
+	w.Header().Set("Content-Type", "application/json")
+	encodeJSON(w, summarizeStats(recentStats.since(time.Now().Add(-window)), window))
+}
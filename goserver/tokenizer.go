@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/daulet/tokenizers"
+)
+
+// tokenizerCheckText is encoded after loading to catch a broken tokenizer.
+// GPT2's BPE encodes it to 10 tokens; missing merges fall back to smaller
+// pieces and give more.
+const tokenizerCheckText = warmupText
+
+// loadTokenizer loads the tokenizer at path. With truncate, the tokenizer
+// itself keeps only the first maxLength tokens of every text it encodes, so
+// texts never need more than one window.
+func loadTokenizer(path string, truncate bool, maxLength int) (*tokenizers.Tokenizer, error) {
+	if !truncate {
+		return tokenizers.FromFile(path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("tokenizer file %s is empty", path)
+	}
+	return tokenizers.FromBytesWithTruncation(data, uint32(maxLength), tokenizers.TruncationDirectionRight)
+}
+
+// tokenizerCut returns the part of text an encoding with offsets covers,
+// and whether that is less than all of it because TOKENIZER_TRUNCATION cut
+// the encoding at max_length tokens. Trailing whitespace doesn't count.
+func (m *GPT2Model) tokenizerCut(text string, offsets []tokenizers.Offset) (string, bool) {
+	if !m.tokenizerTruncation || len(offsets) < m.maxLength {
+		return text, false
+	}
+	end := int(offsets[len(offsets)-1][1])
+	if end >= len(text) || strings.TrimSpace(text[end:]) == "" {
+		return text, false
+	}
+	return text[:end], true
+}
+
+// tokenizerJSON is the part of tokenizer.json that is summarized in the
+// startup log.
+type tokenizerJSON struct {
+	Model struct {
+		Type   string            `json:"type"`
+		Vocab  map[string]int    `json:"vocab"`
+		Merges []json.RawMessage `json:"merges"`
+	} `json:"model"`
+}
+
+// checkTokenizer verifies a freshly loaded tokenizer against the model. It
+// logs the vocab and merge counts from path, then encodes
+// tokenizerCheckText and fails if it doesn't give expectedTokens tokens (0
+// skips that check), if any id is outside the model's vocabSize, or if
+// decoding doesn't round-trip.
+func checkTokenizer(tk *tokenizers.Tokenizer, path string, vocabSize, expectedTokens int) error {
+	var file tokenizerJSON
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("tokenizer file is not valid JSON: %w", err)
+	}
+	slog.Info("tokenizer loaded",
+		"type", file.Model.Type,
+		"vocab", len(file.Model.Vocab),
+		"merges", len(file.Model.Merges),
+		"vocab_size", tk.VocabSize(),
+	)
+	if file.Model.Type == "BPE" && len(file.Model.Merges) == 0 {
+		return fmt.Errorf("tokenizer is BPE but has no merges")
+	}
+
+	ids, _ := tk.Encode(tokenizerCheckText, false)
+	if expectedTokens > 0 && len(ids) != expectedTokens {
+		return fmt.Errorf("tokenizer encodes %q to %d tokens, expected %d; its merges or version may not match the model (set TOKENIZER_CHECK_TOKENS=0 to skip this check)",
+			tokenizerCheckText, len(ids), expectedTokens)
+	}
+	for _, id := range ids {
+		if int(id) >= vocabSize {
+			return fmt.Errorf("tokenizer produced id %d, outside the model's vocab of %d", id, vocabSize)
+		}
+	}
+	if decoded := tk.Decode(ids, false); decoded != tokenizerCheckText {
+		return fmt.Errorf("tokenizer does not round-trip %q (decoded %q)", tokenizerCheckText, decoded)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daulet/tokenizers"
+
+	"isgpt-server/api"
+)
+
+// truncatingTokenizer is fakeTokenizer loaded with TOKENIZER_TRUNCATION: it
+// keeps only the first max tokens of every encoding.
+type truncatingTokenizer struct {
+	fakeTokenizer
+	max int
+}
+
+func (tk truncatingTokenizer) EncodeWithOptions(str string, addSpecialTokens bool, opts ...tokenizers.EncodeOption) tokenizers.Encoding {
+	e := tk.fakeTokenizer.EncodeWithOptions(str, addSpecialTokens, opts...)
+	if len(e.IDs) > tk.max {
+		e.IDs, e.Offsets = e.IDs[:tk.max], e.Offsets[:tk.max]
+	}
+	return e
+}
+
+func (tk truncatingTokenizer) Encode(str string, addSpecialTokens bool) ([]uint32, []string) {
+	return tk.EncodeWithOptions(str, addSpecialTokens).IDs, nil
+}
+
+// A text the tokenizer cut at max_length is reported truncated, by getPPL,
+// Infer and /info alike.
+func TestTokenizerTruncation(t *testing.T) {
+	m, _ := newTestModel(t, 8, 8)
+	m.tokenizer = truncatingTokenizer{max: 8}
+	m.tokenizerTruncation = true
+	long := strings.Repeat("alpha beta gamma delta ", 5)
+	short := "alpha beta gamma delta"
+
+	for text, want := range map[string]bool{long: true, short: false} {
+		result, err := m.getPPL(context.Background(), text, defaultScoreOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Truncated != want {
+			t.Errorf("getPPL of %d words: truncated = %v, want %v", len(strings.Fields(text)), result.Truncated, want)
+		}
+		response, err := m.Infer(context.Background(), text, testParams(t, text, api.InferOptions{AllowShort: true}), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Truncated != want {
+			t.Errorf("Infer of %d words: truncated = %v, want %v", len(strings.Fields(text)), response.Truncated, want)
+		}
+	}
+
+	serveModel(t, m)
+	w := httptest.NewRecorder()
+	infoHandler(w, httptest.NewRequest(http.MethodGet, "/info", nil))
+	var info struct {
+		TokenizerTruncation bool `json:"tokenizer_truncation"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || !info.TokenizerTruncation {
+		t.Errorf("/info = %s, want tokenizer_truncation true", w.Body)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import "math"
+
+// tokenStats collects optional per-token statistics while getPPL scores a
+// text. It is set in scoreOptions only for the document-level pass of a
+// request that asked for them, so the per-line loop stays on the fast path.
+// A nil *tokenStats collects nothing.
+type tokenStats struct {
+	topK         int  // Alternatives to keep per position; 0 disables top-k
+	maxPositions int  // Positions to report top-k for, from the start
+	entropy      bool // Accumulate predictive entropy
+	logRank      bool // Accumulate log-rank of the actual tokens
+
+	entropySum, logRankSum     float64
+	entropyCount, logRankCount int
+
+	base        int // Document position of the next target, set per window
+	predictions []tokenPrediction
+}
+
+// tokenPrediction is the raw top-k record for one position, decoded into a
+// TokenPrediction once scoring is done.
+type tokenPrediction struct {
+	position int
+	target   uint32
+	prob     float64
+	rank     int
+	topIDs   []uint32
+	topProbs []float64
+}
+
+// observe records the distribution probs predicted for the i-th target of
+// the current window.
+func (s *tokenStats) observe(i int, probs []float64, target uint32) {
+	if s == nil {
+		return
+	}
+	if s.topK > 0 && len(s.predictions) < s.maxPositions {
+		s.predictions = append(s.predictions, topKPrediction(s.base+i, probs, target, s.topK))
+	}
+	if s.entropy {
+		s.entropySum += shannonEntropy(probs)
+		s.entropyCount++
+	}
+	if s.logRank {
+		s.logRankSum += math.Log(float64(tokenRank(probs, target)))
+		s.logRankCount++
+	}
+}
+
+// tokenRank returns the rank of target in probs, 1 being the most likely
+// token. Counting the more likely tokens is a single O(vocab) pass, cheaper
+// than sorting the vocabulary.
+func tokenRank(probs []float64, target uint32) int {
+	rank := 1
+	p := probs[target]
+	for _, prob := range probs {
+		if prob > p {
+			rank++
+		}
+	}
+	return rank
+}
+
+// meanLogRank returns the mean natural log of the actual tokens' ranks, or
+// nil if log-rank wasn't collected.
+func (s *tokenStats) meanLogRank() *float64 {
+	if s == nil || !s.logRank || s.logRankCount == 0 {
+		return nil
+	}
+	mean := s.logRankSum / float64(s.logRankCount)
+	return &mean
+}
+
+// shannonEntropy returns -sum(p * ln p) over probs, in nats.
+func shannonEntropy(probs []float64) float64 {
+	h := 0.0
+	for _, p := range probs {
+		if p > 0 {
+			h -= p * math.Log(p)
+		}
+	}
+	return h
+}
+
+// meanEntropy returns the mean predictive entropy over the observed
+// positions, or nil if entropy wasn't collected.
+func (s *tokenStats) meanEntropy() *float64 {
+	if s == nil || !s.entropy || s.entropyCount == 0 {
+		return nil
+	}
+	mean := s.entropySum / float64(s.entropyCount)
+	return &mean
+}
+
+// topKPrediction finds the k most likely tokens in probs and the rank of
+// target among all tokens (1 = most likely).
+func topKPrediction(position int, probs []float64, target uint32, k int) tokenPrediction {
+	p := tokenPrediction{position: position, target: target, prob: probs[target], rank: tokenRank(probs, target)}
+
+	ids := make([]uint32, 0, k+1)
+	top := make([]float64, 0, k+1)
+	for id, prob := range probs {
+		if len(top) == k && prob <= top[k-1] {
+			continue
+		}
+
+		// Insert in descending order, dropping the smallest past k
+		j := len(top)
+		for j > 0 && top[j-1] < prob {
+			j--
+		}
+		top = append(top, 0)
+		ids = append(ids, 0)
+		copy(top[j+1:], top[j:])
+		copy(ids[j+1:], ids[j:])
+		top[j], ids[j] = prob, uint32(id)
+		if len(top) > k {
+			top, ids = top[:k], ids[:k]
+		}
+	}
+
+	p.topIDs, p.topProbs = ids, top
+	return p
+}
+
+// topK decodes the collected top-k predictions into response form.
+func (m *GPT2Model) topK(s *tokenStats) []TokenPrediction {
+	if s == nil || len(s.predictions) == 0 {
+		return nil
+	}
+
+	out := make([]TokenPrediction, len(s.predictions))
+	for i, p := range s.predictions {
+		alts := make([]TokenAlternative, len(p.topIDs))
+		for j, id := range p.topIDs {
+			alts[j] = TokenAlternative{
+				Token:       m.tokenizer.Decode([]uint32{id}, false),
+				TokenID:     id,
+				Probability: p.topProbs[j],
+			}
+		}
+		out[i] = TokenPrediction{
+			Position:     p.position,
+			Token:        m.tokenizer.Decode([]uint32{p.target}, false),
+			TokenID:      p.target,
+			Probability:  p.prob,
+			Rank:         p.rank,
+			Alternatives: alts,
+		}
+	}
+	return out
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// validateModel loads the model and tokenizer in cfg, runs warmupText
+// through them and checks the results are usable, writing a short report to
+// out. It is the --validate mode, for gating deployments on a model pair
+// without starting the server.
+func validateModel(cfg ModelConfig, out io.Writer) (err error) {
+	check := func(name string, fn func() (string, error)) {
+		if err != nil {
+			return
+		}
+		var detail string
+		if detail, err = fn(); err != nil {
+			fmt.Fprintf(out, "FAIL  %s: %v\n", name, err)
+			return
+		}
+		fmt.Fprintf(out, "ok    %s: %s\n", name, detail)
+	}
+
+	var m *GPT2Model
+	defer func() {
+		if m != nil {
+			m.Close()
+		}
+	}()
+
+	check("load", func() (string, error) {
+		var err error
+		if m, err = NewGPT2Model(cfg); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s (quantized: %t), %s", cfg.ModelPath, m.quantized, cfg.TokenizerPath), nil
+	})
+
+	check("vocab", func() (string, error) {
+		_, outputs, err := ort.GetInputOutputInfo(m.modelFile)
+		if err != nil {
+			return "", err
+		}
+		for _, o := range outputs {
+			if o.Name != m.logitsName || len(o.Dimensions) == 0 {
+				continue
+			}
+			// A dynamic dimension is negative and checked by the run below
+			if d := o.Dimensions[len(o.Dimensions)-1]; d > 0 && int(d) != m.vocabSize {
+				return "", fmt.Errorf("model logits have %d entries, expected %d", d, m.vocabSize)
+			}
+		}
+		if tv := int(m.tokenizer.VocabSize()); tv > m.vocabSize {
+			return "", fmt.Errorf("tokenizer has %d tokens, more than the model's %d", tv, m.vocabSize)
+		}
+		return fmt.Sprintf("%d tokens", m.vocabSize), nil
+	})
+
+	check("logits", func() (string, error) {
+		ids, _ := m.tokenizer.Encode(warmupText, false)
+		if len(ids) < 2 {
+			return "", fmt.Errorf("tokenizer returned %d ids for the test input", len(ids))
+		}
+		logits, err := m.runBatch([][]uint32{ids})
+		if err != nil {
+			return "", err
+		}
+		if want := len(ids) * m.vocabSize; len(logits) != want {
+			return "", fmt.Errorf("got %d logits, expected %d (%d tokens x %d vocab)", len(logits), want, len(ids), m.vocabSize)
+		}
+		for i, v := range logits {
+			if !isFinite(float64(v)) {
+				return "", fmt.Errorf("non-finite logit at index %d", i)
+			}
+		}
+		return fmt.Sprintf("[1, %d, %d]", len(ids), m.vocabSize), nil
+	})
+
+	check("perplexity", func() (string, error) {
+		result, err := m.getPPL(context.Background(), warmupText, defaultScoreOptions)
+		if err != nil {
+			return "", err
+		}
+		if !isFinite(result.Perplexity) || result.Perplexity < 1 {
+			return "", fmt.Errorf("implausible perplexity %v", result.Perplexity)
+		}
+		return fmt.Sprintf("%.2f over %d tokens", result.Perplexity, result.Tokens), nil
+	})
+
+	return err
+}
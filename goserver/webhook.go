@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// inferenceEventType is the CloudEvents type of the event sent to
+// WEBHOOK_URL after each inference.
+const inferenceEventType = "com.isgpt.inference.completed"
+
+// cloudEvent is a CloudEvents 1.0 event in structured JSON mode. requestid
+// and idempotencykey are extension attributes, so they can be routed on
+// without parsing data.
+type cloudEvent struct {
+	SpecVersion     string         `json:"specversion"`
+	ID              string         `json:"id"`
+	Source          string         `json:"source"`
+	Type            string         `json:"type"`
+	Time            string         `json:"time"`
+	DataContentType string         `json:"datacontenttype"`
+	RequestID       string         `json:"requestid,omitempty"`
+	IdempotencyKey  string         `json:"idempotencykey,omitempty"`
+	Data            inferenceEvent `json:"data"`
+}
+
+// inferenceEvent is the data of an inference event: the verdict and what
+// it was based on.
+type inferenceEvent struct {
+	Endpoint    string   `json:"endpoint"`
+	JobID       string   `json:"job_id,omitempty"` // Set for jobs run through /jobs
+	Label       *int     `json:"label,omitempty"`  // Omitted if the text was refused, e.g. as too short
+	Message     string   `json:"message,omitempty"`
+	IsUncertain bool     `json:"is_uncertain"`
+	Confidence  *float64 `json:"confidence,omitempty"`
+	Perplexity  *float64 `json:"perplexity,omitempty"`
+	TokenCount  int      `json:"token_count"`
+	Truncated   bool     `json:"truncated,omitempty"`
+	LatencyMS   int64    `json:"latency_ms"`
+}
+
+// webhook posts inference events to WEBHOOK_URL from a background
+// goroutine, so responses never wait on it. Events wait in a bounded queue;
+// once it is full, new events are dropped.
+type webhook struct {
+	url     string
+	retries int
+	backoff time.Duration // Wait before the first retry, doubling after each
+	client  *http.Client
+	queue   chan cloudEvent
+}
+
+var inferenceWebhook *webhook
+
+// startWebhook starts delivering inference events to url. It does nothing
+// if url is empty.
+func startWebhook(url string, queueSize, retries int, timeout time.Duration) {
+	if url == "" {
+		return
+	}
+	inferenceWebhook = &webhook{
+		url:     url,
+		retries: retries,
+		backoff: time.Second,
+		client:  &http.Client{Timeout: timeout},
+		queue:   make(chan cloudEvent, queueSize),
+	}
+	go func() {
+		for event := range inferenceWebhook.queue {
+			inferenceWebhook.deliver(event)
+		}
+	}()
+}
+
+// notifyInference queues an inference event for the webhook, if one is
+// configured. Failed inferences are not reported.
+func notifyInference(requestID, idempotencyKey string, data inferenceEvent, result *InferenceResponse, latency time.Duration) {
+	if inferenceWebhook == nil || result == nil {
+		return
+	}
+	data.Label = result.Label
+	data.Message = result.Message
+	data.IsUncertain = result.IsUncertain
+	data.Confidence = result.Confidence
+	data.Perplexity = result.Perplexity
+	data.TokenCount = result.TokenCount
+	data.Truncated = result.Truncated
+	data.LatencyMS = latency.Milliseconds()
+
+	event := cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              newRequestID(),
+		Source:          "/isgpt",
+		Type:            inferenceEventType,
+		Time:            time.Now().UTC().Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		RequestID:       requestID,
+		IdempotencyKey:  idempotencyKey,
+		Data:            data,
+	}
+	select {
+	case inferenceWebhook.queue <- event:
+	default:
+		slog.Warn("webhook queue full, dropping event", "event", event.ID, "request_id", requestID)
+	}
+}
+
+// deliver posts event, retrying up to w.retries times with exponential
+// backoff on network errors, 429 and 5xx. Other statuses are not retried.
+func (w *webhook) deliver(event cloudEvent) {
+	body, err := marshalJSON(event)
+	if err != nil {
+		slog.Error("failed to encode webhook event", "event", event.ID, "error", err)
+		return
+	}
+
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= w.retries {
+			slog.Error("webhook delivery failed", "event", event.ID, "request_id", event.RequestID, "attempts", attempt+1, "error", err)
+			return
+		}
+		slog.Warn("webhook delivery failed, retrying", "event", event.ID, "attempt", attempt+1, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends one delivery attempt, reporting whether a failure is worth
+// retrying.
+func (w *webhook) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer answers each delivery with the next of statuses, repeating
+// the last, and records what it was sent.
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookServer(t *testing.T, statuses ...int) *webhookServer {
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, body)
+		w.WriteHeader(s.statuses[min(len(s.requests), len(s.statuses))-1])
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *webhookServer) attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+// testWebhook installs a webhook to url until the test ends, returning the
+// events notifyInference queues for it.
+func testWebhook(t *testing.T, url string, retries int) (*webhook, chan cloudEvent) {
+	w := &webhook{
+		url:     url,
+		retries: retries,
+		backoff: time.Millisecond,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		queue:   make(chan cloudEvent, 1),
+	}
+	inferenceWebhook = w
+	t.Cleanup(func() { inferenceWebhook = nil })
+	return w, w.queue
+}
+
+func TestWebhookCloudEvent(t *testing.T) {
+	srv := newWebhookServer(t, http.StatusNoContent)
+	w, queue := testWebhook(t, srv.URL, 2)
+
+	label, ppl := 1, 92.0
+	result := &InferenceResponse{Label: &label, Perplexity: &ppl, TokenCount: 42, Message: "Human"}
+	notifyInference("req-7", "key-9", inferenceEvent{Endpoint: "/infer"}, result, 1500*time.Millisecond)
+	w.deliver(<-queue)
+
+	if srv.attempts() != 1 {
+		t.Fatalf("%d deliveries, want 1", srv.attempts())
+	}
+	if ct := srv.requests[0].Header.Get("Content-Type"); ct != "application/cloudevents+json" {
+		t.Errorf("Content-Type = %q, want application/cloudevents+json", ct)
+	}
+	var event struct {
+		SpecVersion     string `json:"specversion"`
+		ID              string `json:"id"`
+		Source          string `json:"source"`
+		Type            string `json:"type"`
+		Time            string `json:"time"`
+		DataContentType string `json:"datacontenttype"`
+		RequestID       string `json:"requestid"`
+		IdempotencyKey  string `json:"idempotencykey"`
+		Data            struct {
+			Endpoint   string   `json:"endpoint"`
+			Label      *int     `json:"label"`
+			Perplexity *float64 `json:"perplexity"`
+			TokenCount int      `json:"token_count"`
+			LatencyMS  int64    `json:"latency_ms"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(srv.bodies[0], &event); err != nil {
+		t.Fatalf("body %s: %v", srv.bodies[0], err)
+	}
+	if event.SpecVersion != "1.0" || event.ID == "" || event.Source != "/isgpt" || event.Type != inferenceEventType || event.DataContentType != "application/json" {
+		t.Errorf("event attributes = %+v", event)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, event.Time); err != nil {
+		t.Errorf("time %q: %v", event.Time, err)
+	}
+	if event.RequestID != "req-7" || event.IdempotencyKey != "key-9" {
+		t.Errorf("requestid %q, idempotencykey %q; want req-7, key-9", event.RequestID, event.IdempotencyKey)
+	}
+	d := event.Data
+	if d.Endpoint != "/infer" || d.Label == nil || *d.Label != 1 || d.Perplexity == nil || *d.Perplexity != 92 || d.TokenCount != 42 || d.LatencyMS != 1500 {
+		t.Errorf("data = %+v", d)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		retries  int
+		want     int
+	}{
+		{"retried after a 5xx", []int{http.StatusServiceUnavailable, http.StatusOK}, 3, 2},
+		{"retried after a 429", []int{http.StatusTooManyRequests, http.StatusOK}, 3, 2},
+		{"gives up after the last retry", []int{http.StatusInternalServerError}, 2, 3},
+		{"no retries", []int{http.StatusBadGateway}, 0, 1},
+		{"a 4xx isn't retried", []int{http.StatusBadRequest}, 3, 1},
+	} {
+		srv := newWebhookServer(t, tc.statuses...)
+		w, _ := testWebhook(t, srv.URL, tc.retries)
+		w.deliver(cloudEvent{ID: "event-1"})
+		if got := srv.attempts(); got != tc.want {
+			t.Errorf("%s: %d attempts, want %d", tc.name, got, tc.want)
+		}
+	}
+}